@@ -0,0 +1,804 @@
+package godata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The default maximum size in bytes of the body of a $batch request.
+const DefaultMaxBatchSize int64 = 10 << 20
+
+// The default maximum number of requests of a JSON batch that are executed at
+// the same time.
+const DefaultMaxBatchConcurrency = 8
+
+// An optional interface for providers that can execute the requests in a
+// batch change set atomically. If a provider does not implement it, the
+// requests in a change set are executed one after another, and processing
+// stops at the first failure, but earlier changes are not undone.
+type GoDataTransactionalProvider interface {
+	// Begin a transaction for a change set. The context is the context of the
+	// batch request.
+	BeginTransaction(context.Context) (GoDataTransaction, error)
+}
+
+// A transaction started by a GoDataTransactionalProvider. Every request in a
+// change set is passed to the transaction instead of the provider, so a
+// transaction should implement the same optional interfaces as the provider
+// that started it, e.g. GoDataWritableProvider.
+type GoDataTransaction interface {
+	GoDataContextProvider
+	// Make the changes of the transaction permanent.
+	Commit() error
+	// Discard the changes of the transaction.
+	Rollback() error
+}
+
+// A single request in a batch.
+type batchRequest struct {
+	// The Content-ID of the request, which can be used to reference the
+	// result of the request in later requests, e.g. $1/Orders.
+	ContentID string
+	Method    string
+	// The URL of the request, which can be absolute, relative to the service
+	// root, or start with a Content-ID reference.
+	URL    string
+	Header http.Header
+	Body   []byte
+	// The ids of requests or atomicity groups that must succeed before this
+	// request is executed. Only used by the JSON format.
+	DependsOn []string
+	// The atomicity group of the request. Only used by the JSON format, where
+	// atomicity groups take the place of change sets.
+	AtomicityGroup string
+}
+
+// An item in a batch, which is either a single request or a change set.
+type batchItem struct {
+	Request   *batchRequest
+	ChangeSet []*batchRequest
+}
+
+// The result of an item in a batch. A change set that succeeded has a
+// response for every request, while a change set that failed has a single
+// response describing the failure.
+type batchResult struct {
+	Response  *batchResponse
+	ChangeSet []*batchResponse
+}
+
+// The response to a single request in a batch. It implements
+// http.ResponseWriter so it can be handed to the request handler.
+type batchResponse struct {
+	ContentID  string
+	StatusCode int
+	// The URL of the entity created or addressed by the request, which a
+	// Content-ID reference to the request resolves to: the Location of a
+	// created entity, or else the URL of the request itself.
+	Location string
+	header   http.Header
+	body     bytes.Buffer
+}
+
+func newBatchResponse(contentID string) *batchResponse {
+	return &batchResponse{ContentID: contentID, header: http.Header{}}
+}
+
+func (r *batchResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *batchResponse) Write(b []byte) (int, error) {
+	if r.StatusCode == 0 {
+		r.StatusCode = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *batchResponse) WriteHeader(statusCode int) {
+	if r.StatusCode == 0 {
+		r.StatusCode = statusCode
+	}
+}
+
+func (r *batchResponse) failed() bool {
+	return r.StatusCode >= 400
+}
+
+// Handle a $batch request in either the multipart or the JSON format.
+func (service *GoDataService) handleBatch(w http.ResponseWriter, r *http.Request) error {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return BadRequestError("Batch request has an invalid Content-Type").SetCause(err)
+	}
+
+	// the requests of a batch are held in memory, so the size of the body is
+	// limited
+	limit := service.MaxBatchSize
+	if limit == 0 {
+		limit = DefaultMaxBatchSize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return RequestEntityTooLargeError(fmt.Sprintf("Batch requests cannot be larger than %d bytes", limit))
+		}
+		return BadRequestError("Batch request body could not be read").SetCause(err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch mediaType {
+	case "multipart/mixed":
+		if params["boundary"] == "" {
+			return BadRequestError("Multipart batch requests must have a boundary")
+		}
+		return service.handleMultipartBatch(w, r, params["boundary"])
+	case "application/json":
+		return service.handleJSONBatch(w, r)
+	default:
+		return BadRequestError("Batch requests must be multipart/mixed or application/json")
+	}
+}
+
+// Handle a $batch request in the multipart format, executing every request
+// in the batch in order, and writing a multipart response with a part for
+// each of them.
+func (service *GoDataService) handleMultipartBatch(w http.ResponseWriter, r *http.Request, boundary string) error {
+	items, err := parseMultipartBatch(r.Body, boundary)
+	if err != nil {
+		return err
+	}
+
+	results := make([]*batchResult, 0, len(items))
+	for _, item := range items {
+		if item.ChangeSet != nil {
+			responses := service.executeChangeSet(r, item.ChangeSet, map[string]string{})
+			if len(responses) == 1 && responses[0].failed() {
+				results = append(results, &batchResult{Response: responses[0]})
+			} else {
+				results = append(results, &batchResult{ChangeSet: responses})
+			}
+		} else {
+			results = append(results, &batchResult{Response: service.executeBatchRequest(r, item.Request, nil)})
+		}
+	}
+
+	return writeMultipartBatch(w, results)
+}
+
+// Execute the requests of a change set in order. If the provider supports
+// transactions, the requests are executed in a transaction that is only
+// committed if every request succeeds. If any request fails, the response to
+// the failed request is the only response returned. The locations of entities
+// created or addressed by earlier requests are used to resolve Content-ID
+// references, and are updated with the requests of the change set.
+func (service *GoDataService) executeChangeSet(
+	parent *http.Request,
+	requests []*batchRequest,
+	locations map[string]string,
+) []*batchResponse {
+	target := service
+	var tx GoDataTransaction
+	if provider, ok := service.providerImplementation().(GoDataTransactionalProvider); ok {
+		var err error
+		tx, err = provider.BeginTransaction(parent.Context())
+		if err != nil {
+			return []*batchResponse{service.batchError(parent, "", err)}
+		}
+		txService := *service
+		txService.Provider = tx
+		target = &txService
+	}
+
+	responses := make([]*batchResponse, 0, len(requests))
+	for _, request := range requests {
+		var response *batchResponse
+		if request.Method == http.MethodGet {
+			response = service.batchError(parent, request.ContentID,
+				BadRequestError("A change set cannot contain GET requests"))
+		} else {
+			response = target.executeBatchRequest(parent, request, locations)
+		}
+
+		if response.failed() {
+			if tx != nil {
+				_ = tx.Rollback()
+			}
+			return []*batchResponse{response}
+		}
+
+		if request.ContentID != "" {
+			locations[request.ContentID] = response.Location
+		}
+		responses = append(responses, response)
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return []*batchResponse{service.batchError(parent, "", err)}
+		}
+	}
+	return responses
+}
+
+// Execute a single request in a batch with the same pipeline as any other
+// request. Content-ID references in the URL are resolved with the given
+// locations of earlier requests.
+func (service *GoDataService) executeBatchRequest(
+	parent *http.Request,
+	request *batchRequest,
+	locations map[string]string,
+) *batchResponse {
+	r, err := service.buildBatchHTTPRequest(parent, request, locations)
+	if err != nil {
+		return service.batchError(parent, request.ContentID, err)
+	}
+
+	response := newBatchResponse(request.ContentID)
+	service.GoDataHTTPHandler(response, r)
+	if response.Location = response.header.Get("Location"); response.Location == "" {
+		addressed := *r.URL
+		addressed.RawQuery = ""
+		response.Location = addressed.String()
+	}
+	return response
+}
+
+// Build the response to a request in a batch that failed before it could be
+// dispatched.
+func (service *GoDataService) batchError(parent *http.Request, contentID string, err error) *batchResponse {
+	response := newBatchResponse(contentID)
+	service.writeError(response, parent, err)
+	return response
+}
+
+// Build an HTTP request for a request in a batch, resolving its URL against
+// the service root.
+func (service *GoDataService) buildBatchHTTPRequest(
+	parent *http.Request,
+	request *batchRequest,
+	locations map[string]string,
+) (*http.Request, error) {
+	rawUrl := request.URL
+	// possibly a Content-ID reference to the result of an earlier request,
+	// otherwise a resource such as $metadata
+	if reference, rest, ok := batchReference(rawUrl); ok {
+		if location, ok := locations[reference]; ok {
+			if location == "" {
+				return nil, BadRequestError("Content-ID reference $" + reference + " does not identify an entity")
+			}
+			rawUrl = location + rest
+		}
+	}
+
+	target, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, BadRequestError("Batch request has an invalid URL").SetCause(err)
+	}
+	target = service.BaseUrl.ResolveReference(target)
+
+	if service.requestPath(target.EscapedPath()) == "$batch" {
+		return nil, BadRequestError("Batch requests cannot be nested")
+	}
+
+	r, err := http.NewRequestWithContext(parent.Context(), request.Method, target.String(), bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, BadRequestError("Batch request is invalid").SetCause(err)
+	}
+	for k, v := range request.Header {
+		r.Header[k] = v
+	}
+	return r, nil
+}
+
+// Split a URL that starts with $ into the name it refers to, e.g. 1 in
+// $1/Orders, and the rest of the URL.
+func batchReference(rawUrl string) (reference string, rest string, ok bool) {
+	if !strings.HasPrefix(rawUrl, "$") {
+		return "", "", false
+	}
+	reference = rawUrl[1:]
+	if i := strings.IndexAny(reference, "/?"); i >= 0 {
+		reference, rest = reference[:i], reference[i:]
+	}
+	return reference, rest, true
+}
+
+// Parse the parts of a multipart batch request body into single requests and
+// change sets.
+func parseMultipartBatch(body io.Reader, boundary string) ([]*batchItem, error) {
+	items := []*batchItem{}
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, BadRequestError("Batch request body is invalid").SetCause(err)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, BadRequestError("Batch request part has an invalid Content-Type").SetCause(err)
+		}
+
+		switch mediaType {
+		case "application/http":
+			request, err := parseBatchHTTPRequest(part, part.Header.Get("Content-ID"))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, &batchItem{Request: request})
+		case "multipart/mixed":
+			changeSet, err := parseMultipartChangeSet(part, params["boundary"])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, &batchItem{ChangeSet: changeSet})
+		default:
+			return nil, BadRequestError("Batch request part has unsupported Content-Type " + mediaType)
+		}
+	}
+}
+
+// Parse the requests in a multipart change set.
+func parseMultipartChangeSet(body io.Reader, boundary string) ([]*batchRequest, error) {
+	if boundary == "" {
+		return nil, BadRequestError("Change set has no boundary")
+	}
+
+	requests := []*batchRequest{}
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return nil, BadRequestError("Change set is invalid").SetCause(err)
+		}
+
+		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/http" {
+			return nil, BadRequestError("Change set parts must be application/http")
+		}
+
+		request, err := parseBatchHTTPRequest(part, part.Header.Get("Content-ID"))
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+}
+
+// Parse an HTTP request embedded in a batch part, which consists of a request
+// line, headers, and an optional body.
+func parseBatchHTTPRequest(part io.Reader, contentID string) (*batchRequest, error) {
+	reader := textproto.NewReader(bufio.NewReader(part))
+
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, BadRequestError("Batch request part has no request line").SetCause(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, BadRequestError("Batch request part has an invalid request line: " + line)
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, BadRequestError("Batch request part has invalid headers").SetCause(err)
+	}
+
+	body, err := io.ReadAll(reader.R)
+	if err != nil {
+		return nil, BadRequestError("Batch request part has an invalid body").SetCause(err)
+	}
+
+	if contentID == "" {
+		contentID = header.Get("Content-ID")
+	}
+
+	return &batchRequest{
+		ContentID: contentID,
+		Method:    strings.ToUpper(fields[0]),
+		URL:       fields[1],
+		Header:    http.Header(header),
+		Body:      body,
+	}, nil
+}
+
+// Write the results of a batch as a multipart response.
+func writeMultipartBatch(w http.ResponseWriter, results []*batchResult) error {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	for _, result := range results {
+		if result.ChangeSet == nil {
+			if err := writeBatchResponsePart(writer, result.Response); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var changeSet bytes.Buffer
+		changeSetWriter := multipart.NewWriter(&changeSet)
+		for _, response := range result.ChangeSet {
+			if err := writeBatchResponsePart(changeSetWriter, response); err != nil {
+				return err
+			}
+		}
+		if err := changeSetWriter.Close(); err != nil {
+			return err
+		}
+
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/mixed; boundary=" + changeSetWriter.Boundary()},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(changeSet.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+	return nil
+}
+
+// Write the response to a single request in a batch as an application/http
+// part.
+func writeBatchResponsePart(writer *multipart.Writer, response *batchResponse) error {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {"application/http"},
+		"Content-Transfer-Encoding": {"binary"},
+	}
+	if response.ContentID != "" {
+		header.Set("Content-ID", response.ContentID)
+	}
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	if _, err := fmt.Fprintf(part, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode)); err != nil {
+		return err
+	}
+	if err := response.header.Write(part); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(part, "\r\n"); err != nil {
+		return err
+	}
+	_, err = part.Write(response.body.Bytes())
+	return err
+}
+
+// The body of a batch request in the JSON format.
+type jsonBatchRequestBody struct {
+	Requests []*jsonBatchRequest `json:"requests"`
+}
+
+type jsonBatchRequest struct {
+	ID             string            `json:"id"`
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Body           json.RawMessage   `json:"body,omitempty"`
+	DependsOn      []string          `json:"dependsOn,omitempty"`
+	AtomicityGroup string            `json:"atomicityGroup,omitempty"`
+}
+
+// The body of a batch response in the JSON format.
+type jsonBatchResponseBody struct {
+	Responses []*jsonBatchResponse `json:"responses"`
+}
+
+type jsonBatchResponse struct {
+	ID             string            `json:"id,omitempty"`
+	AtomicityGroup string            `json:"atomicityGroup,omitempty"`
+	Status         int               `json:"status"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Body           interface{}       `json:"body,omitempty"`
+}
+
+// A unit of execution in a JSON batch, which is either a single request or
+// all requests of an atomicity group.
+type jsonBatchUnit struct {
+	Requests  []*batchRequest
+	DependsOn []*jsonBatchUnit
+	Responses []*batchResponse
+	// Closed when all requests of the unit have been executed.
+	done chan struct{}
+}
+
+func (u *jsonBatchUnit) failed() bool {
+	for _, response := range u.Responses {
+		if response.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle a $batch request in the JSON format. Requests are executed
+// concurrently, up to MaxBatchConcurrency at a time, except that a request
+// waits for the requests it depends on, and fails if any of them failed. The
+// requests of an atomicity group are executed in order, like a change set.
+func (service *GoDataService) handleJSONBatch(w http.ResponseWriter, r *http.Request) error {
+	var body jsonBatchRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return BadRequestError("Batch request body is not valid JSON").SetCause(err)
+	}
+
+	units, err := parseJSONBatch(body.Requests)
+	if err != nil {
+		return err
+	}
+
+	// The locations of entities created or addressed by requests that have
+	// completed, for resolving references like $1/Orders.
+	var mu sync.Mutex
+	locations := map[string]string{}
+
+	concurrency := service.MaxBatchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultMaxBatchConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for _, unit := range units {
+		wg.Add(1)
+		go func(unit *jsonBatchUnit) {
+			defer wg.Done()
+			defer close(unit.done)
+
+			for _, dependency := range unit.DependsOn {
+				<-dependency.done
+				if dependency.failed() {
+					for _, request := range unit.Requests {
+						unit.Responses = append(unit.Responses, service.batchError(r, request.ContentID,
+							FailedDependencyError("A request that this request depends on failed")))
+					}
+					return
+				}
+			}
+
+			// a unit only takes a slot once it can run, so units waiting for
+			// their dependencies cannot starve them
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			mu.Lock()
+			snapshot := make(map[string]string, len(locations))
+			for k, v := range locations {
+				snapshot[k] = v
+			}
+			mu.Unlock()
+
+			if unit.Requests[0].AtomicityGroup != "" {
+				unit.Responses = service.executeChangeSet(r, unit.Requests, snapshot)
+			} else {
+				unit.Responses = []*batchResponse{service.executeBatchRequest(r, unit.Requests[0], snapshot)}
+			}
+
+			mu.Lock()
+			for _, response := range unit.Responses {
+				if !response.failed() && response.ContentID != "" {
+					locations[response.ContentID] = response.Location
+				}
+			}
+			mu.Unlock()
+		}(unit)
+	}
+	wg.Wait()
+
+	result := &jsonBatchResponseBody{Responses: []*jsonBatchResponse{}}
+	for _, unit := range units {
+		group := unit.Requests[0].AtomicityGroup
+		for _, response := range unit.Responses {
+			result.Responses = append(result.Responses, newJSONBatchResponse(response, group))
+		}
+	}
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+	return nil
+}
+
+// Group the requests of a JSON batch into units of execution, and resolve the
+// dependencies between them. Requests may only depend on preceding requests or
+// atomicity groups, and the requests of an atomicity group must be adjacent.
+func parseJSONBatch(requests []*jsonBatchRequest) ([]*jsonBatchUnit, error) {
+	units := []*jsonBatchUnit{}
+	ids := map[string]*jsonBatchUnit{}
+	groups := map[string]*jsonBatchUnit{}
+
+	for _, request := range requests {
+		if request.ID == "" {
+			return nil, BadRequestError("Every request in a batch must have an id")
+		}
+		if _, ok := ids[request.ID]; ok {
+			return nil, BadRequestError("Request id " + request.ID + " is not unique")
+		}
+		if request.Method == "" || request.URL == "" {
+			return nil, BadRequestError("Request " + request.ID + " must have a method and a url")
+		}
+
+		body, err := jsonBatchRequestBodyBytes(request)
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{}
+		for k, v := range request.Headers {
+			header.Set(k, v)
+		}
+		r := &batchRequest{
+			ContentID:      request.ID,
+			Method:         strings.ToUpper(request.Method),
+			URL:            request.URL,
+			Header:         header,
+			Body:           body,
+			DependsOn:      request.DependsOn,
+			AtomicityGroup: request.AtomicityGroup,
+		}
+
+		var unit *jsonBatchUnit
+		if group := request.AtomicityGroup; group != "" {
+			if _, ok := ids[group]; ok {
+				return nil, BadRequestError("Atomicity group " + group + " has the same name as a request")
+			}
+			unit = groups[group]
+			if unit != nil && unit != units[len(units)-1] {
+				return nil, BadRequestError("The requests of atomicity group " + group + " must be adjacent")
+			}
+		}
+		if unit == nil {
+			unit = &jsonBatchUnit{done: make(chan struct{})}
+			units = append(units, unit)
+			if request.AtomicityGroup != "" {
+				groups[request.AtomicityGroup] = unit
+			}
+		}
+		unit.Requests = append(unit.Requests, r)
+
+		for _, dependency := range request.DependsOn {
+			target, ok := ids[dependency]
+			if !ok {
+				target, ok = groups[dependency]
+			}
+			if !ok {
+				return nil, BadRequestError("Request " + request.ID + " depends on " + dependency +
+					", which is not a preceding request or atomicity group")
+			}
+			if target != unit {
+				unit.DependsOn = append(unit.DependsOn, target)
+			}
+		}
+
+		ids[request.ID] = unit
+	}
+
+	if err := checkJSONBatchReferences(units, ids); err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// Check that every request of a JSON batch that refers to the result of
+// another request, e.g. $1/Orders, depends on that request, either directly
+// or through its atomicity group, or follows it in the same atomicity group.
+// Otherwise the request might be executed before the request it refers to.
+func checkJSONBatchReferences(units []*jsonBatchUnit, ids map[string]*jsonBatchUnit) error {
+	for _, unit := range units {
+		for i, request := range unit.Requests {
+			reference, _, ok := batchReference(request.URL)
+			if !ok {
+				continue
+			}
+			target, ok := ids[reference]
+			if !ok {
+				// not a request of the batch, e.g. $metadata
+				continue
+			}
+
+			allowed := false
+			for _, earlier := range unit.Requests[:i] {
+				allowed = allowed || target == unit && earlier.ContentID == reference
+			}
+			for _, dependency := range request.DependsOn {
+				if dependency == reference || dependency == target.Requests[0].AtomicityGroup {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return BadRequestError("Request " + request.ContentID + " refers to $" + reference +
+					", which it does not depend on")
+			}
+		}
+	}
+	return nil
+}
+
+// Get the body of a request in a JSON batch. JSON bodies are used as they
+// are, while other bodies are given as JSON strings.
+func jsonBatchRequestBodyBytes(request *jsonBatchRequest) ([]byte, error) {
+	if len(request.Body) == 0 || string(request.Body) == "null" {
+		return nil, nil
+	}
+
+	contentType := ""
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, "Content-Type") {
+			contentType = v
+		}
+	}
+	if contentType == "" || strings.HasPrefix(contentType, "application/json") {
+		return request.Body, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(request.Body, &s); err != nil {
+		return nil, BadRequestError("Request " + request.ID + " must have a string body for " + contentType)
+	}
+	return []byte(s), nil
+}
+
+// Convert the response to a request in a batch to the JSON format. JSON
+// bodies are embedded as they are, while other bodies are given as strings.
+func newJSONBatchResponse(response *batchResponse, group string) *jsonBatchResponse {
+	result := &jsonBatchResponse{
+		ID:             response.ContentID,
+		AtomicityGroup: group,
+		Status:         response.StatusCode,
+		Headers:        map[string]string{},
+	}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	for k := range response.header {
+		result.Headers[strings.ToLower(k)] = response.header.Get(k)
+	}
+
+	if response.body.Len() > 0 {
+		body := response.body.Bytes()
+		if strings.HasPrefix(response.header.Get("Content-Type"), "application/json") && json.Valid(body) {
+			result.Body = json.RawMessage(body)
+		} else {
+			result.Body = string(body)
+		}
+	}
+	return result
+}
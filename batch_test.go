@@ -0,0 +1,553 @@
+package godata
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A provider whose change sets are executed in transactions.
+type TransactionalCustomerProvider struct {
+	EditableCustomerProvider
+	Committed  int
+	RolledBack int
+}
+
+// A transaction that records its changes in a separate provider, and only
+// passes them on to the provider that started it when committed.
+type testTransaction struct {
+	GoDataContextProvider
+	changes  *EditableCustomerProvider
+	provider *TransactionalCustomerProvider
+}
+
+func (p *TransactionalCustomerProvider) BeginTransaction(ctx context.Context) (GoDataTransaction, error) {
+	changes := &EditableCustomerProvider{}
+	return &testTransaction{AdaptProvider(changes), changes, p}, nil
+}
+
+func (tx *testTransaction) CreateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	return tx.changes.CreateEntity(ctx, r, entity)
+}
+
+func (tx *testTransaction) UpdateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	return tx.changes.UpdateEntity(ctx, r, entity)
+}
+
+func (tx *testTransaction) ReplaceEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	return tx.changes.ReplaceEntity(ctx, r, entity)
+}
+
+func (tx *testTransaction) DeleteEntity(ctx context.Context, r *GoDataRequest) error {
+	return tx.changes.DeleteEntity(ctx, r)
+}
+
+func (tx *testTransaction) Commit() error {
+	tx.provider.Committed++
+	tx.provider.Created = append(tx.provider.Created, tx.changes.Created...)
+	tx.provider.Updated = append(tx.provider.Updated, tx.changes.Updated...)
+	return nil
+}
+
+func (tx *testTransaction) Rollback() error {
+	tx.provider.RolledBack++
+	return nil
+}
+
+const testBatchBody = "--batch_1\r\n" +
+	"Content-Type: application/http\r\n" +
+	"Content-Transfer-Encoding: binary\r\n" +
+	"\r\n" +
+	"GET Customers('Bob')/Age HTTP/1.1\r\n" +
+	"Accept: application/json\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"--batch_1\r\n" +
+	"Content-Type: multipart/mixed; boundary=changeset_1\r\n" +
+	"\r\n" +
+	"--changeset_1\r\n" +
+	"Content-Type: application/http\r\n" +
+	"Content-Transfer-Encoding: binary\r\n" +
+	"Content-ID: 1\r\n" +
+	"\r\n" +
+	"POST Customers HTTP/1.1\r\n" +
+	"Content-Type: application/json\r\n" +
+	"\r\n" +
+	`{"Name":"Carol","Age":30}` + "\r\n" +
+	"--changeset_1\r\n" +
+	"Content-Type: application/http\r\n" +
+	"Content-Transfer-Encoding: binary\r\n" +
+	"Content-ID: 2\r\n" +
+	"\r\n" +
+	"PATCH $1 HTTP/1.1\r\n" +
+	"Content-Type: application/json\r\n" +
+	"\r\n" +
+	`{"Age":31}` + "\r\n" +
+	"--changeset_1--\r\n" +
+	"\r\n" +
+	"--batch_1\r\n" +
+	"Content-Type: application/http\r\n" +
+	"Content-Transfer-Encoding: binary\r\n" +
+	"\r\n" +
+	"GET /odata/Customers('Carol')/Age HTTP/1.1\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"--batch_1--\r\n"
+
+// A response part of a multipart batch response.
+type testBatchPart struct {
+	ContentID string
+	Response  *http.Response
+	Body      string
+	ChangeSet []*testBatchPart
+}
+
+// Read the parts of a multipart batch response.
+func readBatchParts(t *testing.T, body io.Reader, contentType string) []*testBatchPart {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Unexpected Content-Type %q", contentType)
+	}
+
+	parts := []*testBatchPart{}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "multipart/mixed") {
+			parts = append(parts, &testBatchPart{
+				ChangeSet: readBatchParts(t, part, part.Header.Get("Content-Type")),
+			})
+			continue
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, &testBatchPart{
+			ContentID: part.Header.Get("Content-ID"),
+			Response:  response,
+			Body:      string(b),
+		})
+	}
+}
+
+func TestMultipartBatch(t *testing.T) {
+	provider := &TransactionalCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(testBatchBody))
+	r.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	parts := readBatchParts(t, w.Body, w.Header().Get("Content-Type"))
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(parts))
+	}
+
+	if parts[0].Response.StatusCode != 200 || !strings.Contains(parts[0].Body, `"value":42`) {
+		t.Errorf("Unexpected response to GET: %d %s", parts[0].Response.StatusCode, parts[0].Body)
+	}
+
+	changeSet := parts[1].ChangeSet
+	if len(changeSet) != 2 {
+		t.Fatalf("Expected 2 change set responses, got %d", len(changeSet))
+	}
+	if changeSet[0].ContentID != "1" || changeSet[0].Response.StatusCode != 201 {
+		t.Errorf("Unexpected response to POST: %s %d", changeSet[0].ContentID, changeSet[0].Response.StatusCode)
+	}
+	if location := changeSet[0].Response.Header.Get("Location"); location != "http://localhost/odata/Customers('Carol')" {
+		t.Errorf("Location is %q", location)
+	}
+	if changeSet[1].ContentID != "2" || changeSet[1].Response.StatusCode != 204 {
+		t.Errorf("Unexpected response to PATCH: %s %d", changeSet[1].ContentID, changeSet[1].Response.StatusCode)
+	}
+
+	// Carol only exists in the change set, not in the fixed customers
+	if parts[2].Response.StatusCode != 404 {
+		t.Errorf("Expected status 404 for unknown customer, got %d", parts[2].Response.StatusCode)
+	}
+
+	if provider.Committed != 1 || provider.RolledBack != 0 {
+		t.Errorf("Expected 1 commit, got %d commits and %d rollbacks", provider.Committed, provider.RolledBack)
+	}
+	if len(provider.Created) != 1 || len(provider.Updated) != 1 {
+		t.Errorf("Expected 1 creation and 1 update, got %d and %d", len(provider.Created), len(provider.Updated))
+	}
+}
+
+func TestMultipartBatchChangeSetFailure(t *testing.T) {
+	provider := &TransactionalCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	body := "--batch_1\r\n" +
+		"Content-Type: multipart/mixed; boundary=changeset_1\r\n" +
+		"\r\n" +
+		"--changeset_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"Content-ID: 1\r\n" +
+		"\r\n" +
+		"POST Customers HTTP/1.1\r\n" +
+		"\r\n" +
+		`{"Name":"Carol","Age":30}` + "\r\n" +
+		"--changeset_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"Content-ID: 2\r\n" +
+		"\r\n" +
+		"POST Customers HTTP/1.1\r\n" +
+		"\r\n" +
+		`{"Name":"Dave","Age":"old"}` + "\r\n" +
+		"--changeset_1--\r\n" +
+		"--batch_1--\r\n"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	service.GoDataHTTPHandler(w, r)
+
+	parts := readBatchParts(t, w.Body, w.Header().Get("Content-Type"))
+	if len(parts) != 1 || parts[0].Response == nil {
+		t.Fatalf("Expected a single response for the failed change set, got %+v", parts)
+	}
+	if parts[0].ContentID != "2" || parts[0].Response.StatusCode != 400 {
+		t.Errorf("Unexpected response: %s %d", parts[0].ContentID, parts[0].Response.StatusCode)
+	}
+	if provider.Committed != 0 || provider.RolledBack != 1 || len(provider.Created) != 0 {
+		t.Errorf("Expected the change set to be rolled back, got %d commits, %d rollbacks, %d creations",
+			provider.Committed, provider.RolledBack, len(provider.Created))
+	}
+}
+
+func TestMultipartBatchAddressedReference(t *testing.T) {
+	provider := &EditableCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	body := "--batch_1\r\n" +
+		"Content-Type: multipart/mixed; boundary=changeset_1\r\n" +
+		"\r\n" +
+		"--changeset_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"Content-ID: 1\r\n" +
+		"\r\n" +
+		"PATCH Customers('Bob')?$select=Age HTTP/1.1\r\n" +
+		"\r\n" +
+		`{"Age":43}` + "\r\n" +
+		"--changeset_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"Content-ID: 2\r\n" +
+		"\r\n" +
+		"DELETE $1 HTTP/1.1\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--changeset_1--\r\n" +
+		"--batch_1--\r\n"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	service.GoDataHTTPHandler(w, r)
+
+	parts := readBatchParts(t, w.Body, w.Header().Get("Content-Type"))
+	if len(parts) != 1 || len(parts[0].ChangeSet) != 2 {
+		t.Fatalf("Expected a change set with 2 responses, got %+v", parts)
+	}
+	for _, part := range parts[0].ChangeSet {
+		if part.Response.StatusCode != 204 {
+			t.Errorf("Unexpected response to request %s: %d %s", part.ContentID, part.Response.StatusCode, part.Body)
+		}
+	}
+	if len(provider.Deleted) != 1 || provider.Deleted[0] != "'Bob'" {
+		t.Errorf("Expected the updated customer to be deleted, got %v", provider.Deleted)
+	}
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	service := buildWritableService(t, &EditableCustomerProvider{})
+	service.MaxBatchSize = 64
+
+	for _, contentType := range []string{"multipart/mixed; boundary=batch_1", "application/json"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(strings.Repeat(" ", 65)))
+		r.Header.Set("Content-Type", contentType)
+		service.GoDataHTTPHandler(w, r)
+		if w.Code != 413 {
+			t.Errorf("%s: expected status 413, got %d: %s", contentType, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestMultipartBatchErrors(t *testing.T) {
+	service := buildWritableService(t, &EditableCustomerProvider{})
+
+	testCases := []struct {
+		method      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"GET", "multipart/mixed; boundary=batch_1", "", 405},
+		{"POST", "application/xml", "", 400},
+		{"POST", "multipart/mixed", "", 400},
+		{"POST", "multipart/mixed; boundary=batch_1", "--batch_1\r\nContent-Type: text/plain\r\n\r\nhello\r\n--batch_1--\r\n", 400},
+	}
+
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(testCase.method, "/odata/$batch", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", testCase.contentType)
+		service.GoDataHTTPHandler(w, r)
+		if w.Code != testCase.status {
+			t.Errorf("%s %s: expected status %d, got %d", testCase.method, testCase.contentType, testCase.status, w.Code)
+		}
+	}
+
+	// failures of individual requests are reported in their part
+	body := "--batch_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"\r\n" +
+		"GET /odata/$batch HTTP/1.1\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--batch_1\r\n" +
+		"Content-Type: multipart/mixed; boundary=changeset_1\r\n" +
+		"\r\n" +
+		"--changeset_1\r\n" +
+		"Content-Type: application/http\r\n" +
+		"\r\n" +
+		"PATCH $9 HTTP/1.1\r\n" +
+		"\r\n" +
+		`{"Age":1}` + "\r\n" +
+		"--changeset_1--\r\n" +
+		"--batch_1--\r\n"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	service.GoDataHTTPHandler(w, r)
+
+	parts := readBatchParts(t, w.Body, w.Header().Get("Content-Type"))
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if part.Response == nil || part.Response.StatusCode != 400 {
+			t.Errorf("Expected part %d to fail with status 400, got %+v", i, part)
+		}
+	}
+}
+
+// A provider whose GetEntity only returns once two calls are in flight, which
+// can only happen if requests are executed concurrently.
+type ConcurrentCustomerProvider struct {
+	CustomerProvider
+	arrived chan struct{}
+}
+
+func (p *ConcurrentCustomerProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	select {
+	case p.arrived <- struct{}{}:
+	case <-p.arrived:
+	case <-time.After(time.Second):
+		return nil, InternalServerError("Requests were not executed concurrently")
+	}
+	return p.CustomerProvider.GetEntity(r)
+}
+
+// Send a JSON batch request and decode the responses by id.
+func serveJSONBatch(t *testing.T, service *GoDataService, body string) map[string]*jsonBatchResponse {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+
+	var result struct {
+		Responses []*struct {
+			jsonBatchResponse
+			Body json.RawMessage `json:"body"`
+		} `json:"responses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	responses := map[string]*jsonBatchResponse{}
+	for _, response := range result.Responses {
+		response.jsonBatchResponse.Body = string(response.Body)
+		responses[response.ID] = &response.jsonBatchResponse
+	}
+	return responses
+}
+
+func TestJSONBatch(t *testing.T) {
+	provider := &TransactionalCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	responses := serveJSONBatch(t, service, `{"requests":[
+		{"id":"get","method":"get","url":"Customers('Bob')/Name"},
+		{"id":"create","atomicityGroup":"g1","method":"post","url":"Customers",
+		 "headers":{"content-type":"application/json"},"body":{"Name":"Carol","Age":30}},
+		{"id":"update","atomicityGroup":"g1","method":"patch","url":"$create",
+		 "headers":{"content-type":"application/json"},"body":{"Age":31}},
+		{"id":"after","dependsOn":["g1"],"method":"delete","url":"$create"},
+		{"id":"raw","dependsOn":["get"],"method":"get","url":"Customers('Bob')/Name/$value"}
+	]}`)
+
+	if len(responses) != 5 {
+		t.Fatalf("Expected 5 responses, got %d", len(responses))
+	}
+
+	if r := responses["get"]; r.Status != 200 || !strings.Contains(r.Body.(string), `"value":"Bob"`) {
+		t.Errorf("Unexpected response to get: %d %s", r.Status, r.Body)
+	}
+	if r := responses["create"]; r.Status != 201 || r.AtomicityGroup != "g1" ||
+		r.Headers["location"] != "http://localhost/odata/Customers('Carol')" {
+		t.Errorf("Unexpected response to create: %+v", r)
+	}
+	if r := responses["update"]; r.Status != 204 {
+		t.Errorf("Unexpected response to update: %+v", r)
+	}
+	// Carol is not one of the fixed customers, so the provider cannot delete her
+	if r := responses["after"]; r.Status != 404 {
+		t.Errorf("Unexpected response to after: %+v", r)
+	}
+	if r := responses["raw"]; r.Status != 200 || r.Body != `"Bob"` {
+		t.Errorf("Unexpected response to raw: %+v", r)
+	}
+
+	if provider.Committed != 1 {
+		t.Errorf("Expected the atomicity group to be committed once, got %d", provider.Committed)
+	}
+}
+
+func TestJSONBatchFailedDependency(t *testing.T) {
+	service := buildWritableService(t, &TransactionalCustomerProvider{})
+
+	responses := serveJSONBatch(t, service, `{"requests":[
+		{"id":"1","method":"get","url":"Customers('Carol')"},
+		{"id":"2","dependsOn":["1"],"method":"get","url":"Customers('Bob')/Name"},
+		{"id":"3","dependsOn":["2"],"method":"get","url":"Customers('Bob')/Age"},
+		{"id":"4","method":"get","url":"Customers('Bob')/Age"}
+	]}`)
+
+	expected := map[string]int{"1": 404, "2": 424, "3": 424, "4": 200}
+	for id, status := range expected {
+		if responses[id] == nil || responses[id].Status != status {
+			t.Errorf("Expected status %d for request %s, got %+v", status, id, responses[id])
+		}
+	}
+}
+
+func TestJSONBatchConcurrency(t *testing.T) {
+	service := buildWritableService(t, &ConcurrentCustomerProvider{arrived: make(chan struct{})})
+
+	responses := serveJSONBatch(t, service, `{"requests":[
+		{"id":"1","method":"get","url":"Customers('Bob')/Name"},
+		{"id":"2","method":"get","url":"Customers('Alice')/Name"}
+	]}`)
+
+	for _, id := range []string{"1", "2"} {
+		if responses[id] == nil || responses[id].Status != 200 {
+			t.Errorf("Expected status 200 for request %s, got %+v", id, responses[id])
+		}
+	}
+}
+
+// A provider that records how many calls to GetEntity are in flight at once.
+type CountingCustomerProvider struct {
+	CustomerProvider
+	mu       sync.Mutex
+	inFlight int
+	Max      int
+}
+
+func (p *CountingCustomerProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	p.mu.Lock()
+	p.inFlight++
+	if p.inFlight > p.Max {
+		p.Max = p.inFlight
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.inFlight--
+		p.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	return p.CustomerProvider.GetEntity(r)
+}
+
+func TestJSONBatchConcurrencyLimit(t *testing.T) {
+	provider := &CountingCustomerProvider{}
+	service := buildWritableService(t, provider)
+	service.MaxBatchConcurrency = 2
+
+	requests := []string{}
+	for i := 0; i < 6; i++ {
+		requests = append(requests, fmt.Sprintf(`{"id":"%d","method":"get","url":"Customers('Bob')/Name"}`, i))
+	}
+	responses := serveJSONBatch(t, service, `{"requests":[`+strings.Join(requests, ",")+`]}`)
+
+	if len(responses) != 6 {
+		t.Errorf("Expected 6 responses, got %d", len(responses))
+	}
+	if provider.Max > 2 {
+		t.Errorf("Expected at most 2 requests at a time, got %d", provider.Max)
+	}
+}
+
+func TestJSONBatchErrors(t *testing.T) {
+	service := buildWritableService(t, &EditableCustomerProvider{})
+
+	testCases := []string{
+		`not json`,
+		`{"requests":[{"method":"get","url":"Customers"}]}`,
+		`{"requests":[{"id":"1","method":"get","url":"Customers"},{"id":"1","method":"get","url":"Customers"}]}`,
+		`{"requests":[{"id":"1","dependsOn":["2"],"method":"get","url":"Customers"},{"id":"2","method":"get","url":"Customers"}]}`,
+		`{"requests":[{"id":"1","atomicityGroup":"g","method":"post","url":"Customers"},{"id":"2","method":"get","url":"Customers"},{"id":"3","atomicityGroup":"g","method":"post","url":"Customers"}]}`,
+		`{"requests":[{"id":"1","method":"post","url":"Customers"},{"id":"2","method":"patch","url":"$1"}]}`,
+		`{"requests":[{"id":"1","method":"post","url":"Customers"},{"id":"2","dependsOn":["1"],"method":"get","url":"Customers"},{"id":"3","dependsOn":["2"],"method":"get","url":"$1/Orders"}]}`,
+		`{"requests":[{"id":"1","atomicityGroup":"g","method":"patch","url":"$2"},{"id":"2","atomicityGroup":"g","method":"post","url":"Customers"}]}`,
+	}
+
+	for _, body := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/odata/$batch", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		service.GoDataHTTPHandler(w, r)
+		if w.Code != 400 {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package godata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var guidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// A decimal number, with an exponent small enough to expand exactly.
+var decimalRegex = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]{1,4})?$`)
+
+// The ranges of the integer Edm types.
+var edmIntegerRanges = map[string][2]int64{
+	GoDataByte:  {0, math.MaxUint8},
+	GoDataSByte: {math.MinInt8, math.MaxInt8},
+	GoDataInt16: {math.MinInt16, math.MaxInt16},
+	GoDataInt32: {math.MinInt32, math.MaxInt32},
+	GoDataInt64: {math.MinInt64, math.MaxInt64},
+}
+
+// ParseEntity reads the JSON representation of an entity from a request body,
+// and validates it against the given entity type. Every property is converted
+// to the Go type used for its Edm type in responses, e.g. Edm.Int32 becomes an
+// int and Edm.Decimal a *big.Rat, so the result can be handed to a provider or
+// written back to the client. A property that is explicitly null is present in
+// the result with a nil value. Instance annotations, e.g. @odata.type, are
+// ignored.
+func ParseEntity(body io.Reader, service *GoDataService, entity *GoDataEntityType) (map[string]*GoDataResponseField, error) {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, BadRequestError("Request body is not a valid JSON object").SetCause(err)
+	}
+	if raw == nil {
+		return nil, BadRequestError("Request body is not a valid JSON object")
+	}
+
+	result := map[string]*GoDataResponseField{}
+	for name, value := range raw {
+		if strings.Contains(name, "@") {
+			// an instance or property annotation
+			continue
+		}
+
+		if prop, ok := service.PropertyLookup[entity][name]; ok {
+			field, err := parseEntityProperty(prop, value)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = field
+			continue
+		}
+
+		if _, ok := service.NavigationPropertyLookup[entity][name]; ok {
+			return nil, NotImplementedError("Deep insert and update of navigation property " + name +
+				" is not supported").SetTarget(name)
+		}
+
+		if entity.OpenType == "true" {
+			result[name] = &GoDataResponseField{Value: parseDynamicValue(value)}
+			continue
+		}
+
+		return nil, BadRequestError("Entity " + entity.Name + " has no property " + name).SetTarget(name)
+	}
+
+	return result, nil
+}
+
+// Check that every property of an entity that must have a value is present in
+// the parsed entity. Key properties may be omitted, as they can be generated
+// by the provider.
+func validateRequiredProperties(entity *GoDataEntityType, fields map[string]*GoDataResponseField) error {
+	keys := map[string]bool{}
+	for _, name := range entityKeyNames(entity) {
+		keys[name] = true
+	}
+
+	for _, prop := range entity.Properties {
+		if prop.Nullable != "false" || prop.DefaultValue != "" || keys[prop.Name] {
+			continue
+		}
+		if _, ok := fields[prop.Name]; !ok {
+			return BadRequestError("Property " + prop.Name + " is required").SetTarget(prop.Name)
+		}
+	}
+	return nil
+}
+
+// Convert the JSON value of a declared property to its Go representation.
+func parseEntityProperty(prop *GoDataProperty, value interface{}) (*GoDataResponseField, error) {
+	if value == nil {
+		if prop.Nullable == "false" {
+			return nil, BadRequestError("Property " + prop.Name + " cannot be null").SetTarget(prop.Name)
+		}
+		return &GoDataResponseField{Value: nil}, nil
+	}
+
+	if strings.HasPrefix(prop.Type, "Collection(") {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, BadRequestError("Property " + prop.Name + " must be an array").SetTarget(prop.Name)
+		}
+		itemType := prop.Type[len("Collection(") : len(prop.Type)-1]
+		result := make([]*GoDataResponseField, 0, len(items))
+		for _, item := range items {
+			v, err := parsePrimitiveValue(itemType, item)
+			if err != nil {
+				return nil, BadRequestError("Property " + prop.Name + " is invalid").SetCause(inputError(err)).SetTarget(prop.Name)
+			}
+			result = append(result, &GoDataResponseField{Value: v})
+		}
+		return &GoDataResponseField{Value: result}, nil
+	}
+
+	v, err := parsePrimitiveValue(prop.Type, value)
+	if err != nil {
+		return nil, BadRequestError("Property " + prop.Name + " is invalid").SetCause(inputError(err)).SetTarget(prop.Name)
+	}
+	return &GoDataResponseField{Value: v}, nil
+}
+
+// Convert a JSON value to the Go representation of the given Edm type. Types
+// that are not primitive, e.g. complex and enum types, are converted without
+// further validation.
+func parsePrimitiveValue(edmType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if bounds, ok := edmIntegerRanges[edmType]; ok {
+		var n json.Number
+		switch v := value.(type) {
+		case json.Number:
+			n = v
+		case string:
+			// IEEE754Compatible clients send Int64 values as strings
+			if edmType != GoDataInt64 {
+				return nil, fmt.Errorf("expected a number for %s", edmType)
+			}
+			n = json.Number(v)
+		default:
+			return nil, fmt.Errorf("expected a number for %s", edmType)
+		}
+		i, err := n.Int64()
+		if err != nil || i < bounds[0] || i > bounds[1] {
+			return nil, fmt.Errorf("%s is not a valid %s", n, edmType)
+		}
+		return int(i), nil
+	}
+
+	switch edmType {
+	case GoDataDecimal:
+		// parsed exactly, as a float64 would lose precision
+		var n string
+		switch v := value.(type) {
+		case json.Number:
+			n = string(v)
+		case string:
+			// IEEE754Compatible clients send Decimal values as strings
+			n = v
+		default:
+			return nil, fmt.Errorf("expected a number for %s", edmType)
+		}
+		if !decimalRegex.MatchString(n) {
+			return nil, fmt.Errorf("%s is not a valid %s", n, edmType)
+		}
+		r, ok := new(big.Rat).SetString(n)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a valid %s", n, edmType)
+		}
+		return r, nil
+	case GoDataDouble, GoDataSingle:
+		var n json.Number
+		switch v := value.(type) {
+		case json.Number:
+			n = v
+		case string:
+			// special values such as INF are always sent as strings
+			switch v {
+			case "INF":
+				return math.Inf(1), nil
+			case "-INF":
+				return math.Inf(-1), nil
+			case "NaN":
+				return math.NaN(), nil
+			}
+			n = json.Number(v)
+		default:
+			return nil, fmt.Errorf("expected a number for %s", edmType)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid %s", n, edmType)
+		}
+		return f, nil
+	case GoDataBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a boolean for %s", edmType)
+		}
+		return b, nil
+	}
+
+	if !strings.HasPrefix(edmType, "Edm.") {
+		return parseDynamicValue(value), nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string for %s", edmType)
+	}
+
+	var err error
+	switch edmType {
+	case GoDataBinary:
+		// OData uses base64url, but be lenient with standard base64
+		b, e := base64.URLEncoding.DecodeString(s)
+		if e != nil {
+			b, e = base64.StdEncoding.DecodeString(s)
+		}
+		if e != nil {
+			return nil, fmt.Errorf("%q is not valid base64 for %s", s, edmType)
+		}
+		return b, nil
+	case GoDataGuid:
+		if !guidRegex.MatchString(s) {
+			err = fmt.Errorf("%q is not a valid %s", s, edmType)
+		}
+	case GoDataDate:
+		_, err = time.Parse("2006-01-02", s)
+	case GoDataDateTimeOffset:
+		_, err = time.Parse(time.RFC3339Nano, s)
+	case GoDataTimeOfDay:
+		if _, e := time.Parse("15:04:05.999999999", s); e != nil {
+			_, err = time.Parse("15:04", s)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid %s", s, edmType)
+	}
+	return s, nil
+}
+
+// Convert a JSON value of unknown type, e.g. a dynamic property of an open
+// type, to a response field value.
+func parseDynamicValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		result := make([]*GoDataResponseField, 0, len(v))
+		for _, item := range v {
+			result = append(result, &GoDataResponseField{Value: parseDynamicValue(item)})
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]*GoDataResponseField{}
+		for k, item := range v {
+			result[k] = &GoDataResponseField{Value: parseDynamicValue(item)}
+		}
+		return result
+	default:
+		return v
+	}
+}
@@ -0,0 +1,36 @@
+package godata
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestParseDecimalValue(t *testing.T) {
+	testCases := []struct {
+		value    interface{}
+		expected *big.Rat
+	}{
+		{json.Number("12.50"), big.NewRat(25, 2)},
+		{json.Number("1234567890123456.78"), big.NewRat(123456789012345678, 100)},
+		{"1234567890123456.78", big.NewRat(123456789012345678, 100)},
+		{json.Number("-1e-3"), big.NewRat(-1, 1000)},
+		{"7", big.NewRat(7, 1)},
+	}
+	for _, testCase := range testCases {
+		value, err := parsePrimitiveValue(GoDataDecimal, testCase.value)
+		if err != nil {
+			t.Errorf("%v: %v", testCase.value, err)
+			continue
+		}
+		if r, ok := value.(*big.Rat); !ok || r.Cmp(testCase.expected) != 0 {
+			t.Errorf("%v: expected %v, got %#v", testCase.value, testCase.expected, value)
+		}
+	}
+
+	for _, value := range []interface{}{"1/3", "INF", "0x10", "1e100000", "", true} {
+		if _, err := parsePrimitiveValue(GoDataDecimal, value); err == nil {
+			t.Errorf("%v: expected an error", value)
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package godata
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 type GoDataError struct {
 	ResponseCode int
 	Message      string
 	Cause        error
+	// The target of the error, e.g. the query option or property that caused
+	// it. Used to populate the "target" member of the OData error response.
+	Target string
 }
 
 func (err *GoDataError) Error() string {
@@ -24,32 +33,66 @@ func (err *GoDataError) SetCause(e error) *GoDataError {
 	return err
 }
 
+func (err *GoDataError) SetTarget(target string) *GoDataError {
+	err.Target = target
+	return err
+}
+
 func BadRequestError(message string) *GoDataError {
-	return &GoDataError{400, message, nil}
+	return &GoDataError{ResponseCode: 400, Message: message}
 }
 
 func NotFoundError(message string) *GoDataError {
-	return &GoDataError{404, message, nil}
+	return &GoDataError{ResponseCode: 404, Message: message}
 }
 
 func MethodNotAllowedError(message string) *GoDataError {
-	return &GoDataError{405, message, nil}
+	return &GoDataError{ResponseCode: 405, Message: message}
+}
+
+func NotAcceptableError(message string) *GoDataError {
+	return &GoDataError{ResponseCode: 406, Message: message}
 }
 
 func GoneError(message string) *GoDataError {
-	return &GoDataError{410, message, nil}
+	return &GoDataError{ResponseCode: 410, Message: message}
 }
 
 func PreconditionFailedError(message string) *GoDataError {
-	return &GoDataError{412, message, nil}
+	return &GoDataError{ResponseCode: 412, Message: message}
+}
+
+func RequestEntityTooLargeError(message string) *GoDataError {
+	return &GoDataError{ResponseCode: 413, Message: message}
+}
+
+func FailedDependencyError(message string) *GoDataError {
+	return &GoDataError{ResponseCode: 424, Message: message}
 }
 
 func InternalServerError(message string) *GoDataError {
-	return &GoDataError{500, message, nil}
+	return &GoDataError{ResponseCode: 500, Message: message}
 }
 
 func NotImplementedError(message string) *GoDataError {
-	return &GoDataError{501, message, nil}
+	return &GoDataError{ResponseCode: 501, Message: message}
+}
+
+func ServiceUnavailableError(message string) *GoDataError {
+	return &GoDataError{ResponseCode: 503, Message: message}
+}
+
+func GatewayTimeoutError(message string) *GoDataError {
+	return &GoDataError{ResponseCode: 504, Message: message}
+}
+
+// Convert the error of a done request context to the error reported to the
+// client.
+func contextError(err error) *GoDataError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return GatewayTimeoutError("The request timed out").SetCause(err)
+	}
+	return ServiceUnavailableError("The request was canceled").SetCause(err)
 }
 
 type UnsupportedQueryParameterError struct {
@@ -67,3 +110,111 @@ type DuplicateQueryParameterError struct {
 func (err *DuplicateQueryParameterError) Error() string {
 	return fmt.Sprintf("Query parameter '%s' cannot be specified more than once", err.Parameter)
 }
+
+// The body of an OData JSON error response, as defined in section 19 of the
+// OData JSON format specification.
+type GoDataErrorResponse struct {
+	// The HTTP status code to send with the error. It is not serialized.
+	StatusCode int                `json:"-"`
+	Error      *GoDataErrorDetail `json:"error"`
+}
+
+// A single error, as found in the "error" member of an error response, or in
+// its "details" list.
+type GoDataErrorDetail struct {
+	Code       string                 `json:"code"`
+	Message    string                 `json:"message"`
+	Target     string                 `json:"target,omitempty"`
+	Details    []*GoDataErrorDetail   `json:"details,omitempty"`
+	InnerError map[string]interface{} `json:"innererror,omitempty"`
+}
+
+// A function that converts an error returned while handling a request into the
+// error response sent to the client. Services may provide their own formatter,
+// e.g. to attach request identifiers in the innererror member.
+type GoDataErrorFormatter func(r *http.Request, err error) *GoDataErrorResponse
+
+// The default error formatter. A GoDataError, including one wrapped by
+// another error, is mapped to its response code, query parameter errors are
+// mapped to 400 Bad Request, and any other error is treated as an internal
+// server error. The causes of internal server errors are not sent to the
+// client, as they may reveal details of the provider; the service logs them
+// instead. The cause of any other error is only described in the details of
+// the response if it is a GoDataError.
+func DefaultErrorFormatter(r *http.Request, err error) *GoDataErrorResponse {
+	var godataErr *GoDataError
+	var unsupported *UnsupportedQueryParameterError
+	var duplicate *DuplicateQueryParameterError
+
+	detail := &GoDataErrorDetail{}
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.As(err, &godataErr):
+		if godataErr.ResponseCode != 0 {
+			status = godataErr.ResponseCode
+		}
+		detail.Code = errorCode(status)
+		detail.Message = godataErr.Message
+		detail.Target = godataErr.Target
+		if errors.As(godataErr.Cause, &unsupported) {
+			detail.Code = "UnsupportedQueryParameter"
+			detail.Target = unsupported.Parameter
+		} else if errors.As(godataErr.Cause, &duplicate) {
+			detail.Code = "DuplicateQueryParameter"
+			detail.Target = duplicate.Parameter
+		} else if cause := errorDetail(godataErr.Cause, status); cause != nil && status != http.StatusInternalServerError {
+			detail.Details = []*GoDataErrorDetail{cause}
+		}
+	case errors.As(err, &unsupported):
+		status = http.StatusBadRequest
+		detail.Code = "UnsupportedQueryParameter"
+		detail.Message = unsupported.Error()
+		detail.Target = unsupported.Parameter
+	case errors.As(err, &duplicate):
+		status = http.StatusBadRequest
+		detail.Code = "DuplicateQueryParameter"
+		detail.Message = duplicate.Error()
+		detail.Target = duplicate.Parameter
+	default:
+		detail.Code = errorCode(status)
+		detail.Message = "The service encountered an unexpected error"
+	}
+
+	return &GoDataErrorResponse{StatusCode: status, Error: detail}
+}
+
+// Build a nested error detail from the cause of an error with the given
+// status. Only a GoDataError is described; any other cause may come from a
+// provider, so its message is withheld, and nil is returned.
+func errorDetail(err error, status int) *GoDataErrorDetail {
+	var e *GoDataError
+	if err == nil || !errors.As(err, &e) {
+		return nil
+	}
+	if e.ResponseCode != 0 {
+		status = e.ResponseCode
+	}
+	return &GoDataErrorDetail{Code: errorCode(status), Message: e.Message, Target: e.Target}
+}
+
+// Wrap an error found in the input of a client, e.g. a syntax error in a
+// query option, so that its message is sent to the client as the detail of
+// an error response it causes.
+func inputError(err error) *GoDataError {
+	var e *GoDataError
+	if errors.As(err, &e) {
+		return e
+	}
+	return BadRequestError(err.Error()).SetCause(err)
+}
+
+// Convert an HTTP status code into an OData error code, e.g. 404 becomes
+// "NotFound".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return fmt.Sprintf("Error%d", status)
+	}
+	return strings.NewReplacer(" ", "", "-", "").Replace(text)
+}
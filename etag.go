@@ -0,0 +1,94 @@
+package godata
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Get the ETag of an entity returned by a provider, or "" if it has none.
+func entityETag(fields map[string]*GoDataResponseField) string {
+	if field, ok := fields[ODataFieldETag]; ok && field != nil {
+		if etag, ok := field.Value.(string); ok {
+			return etag
+		}
+	}
+	return ""
+}
+
+// Evaluate the If-Match and If-None-Match headers of a request against the
+// ETag of the entity it addresses, which is "" if the entity has no ETag. A
+// read whose If-None-Match header matches is not modified; any other failed
+// precondition is an error.
+func checkPreconditions(r *http.Request, etag string) (notModified bool, err error) {
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !etagMatches(header, etag) {
+			return false, PreconditionFailedError("The entity has been modified").SetTarget("If-Match")
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etagMatches(header, etag) {
+			if r.Method == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+				return true, nil
+			}
+			return false, PreconditionFailedError("The entity has not been modified").SetTarget("If-None-Match")
+		}
+	}
+	return false, nil
+}
+
+// Check if a list of ETags from an If-Match or If-None-Match header contains
+// the given ETag. The wildcard * matches any existing entity.
+func etagMatches(header string, etag string) bool {
+	return ETagMatches(parseETags(header), etag)
+}
+
+// Check if a list of ETags, e.g. GoDataRequest.IfMatch, contains the given
+// ETag. The wildcard * matches any existing entity.
+func ETagMatches(etags []string, etag string) bool {
+	for _, candidate := range etags {
+		if candidate == "*" || (etag != "" && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split the value of an If-Match or If-None-Match header into its ETags, or
+// nil if it is empty.
+func parseETags(header string) []string {
+	var etags []string
+	for _, candidate := range strings.Split(header, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			etags = append(etags, candidate)
+		}
+	}
+	return etags
+}
+
+// Check the preconditions of a request that modifies an entity against the
+// current ETag of the entity, as returned by GetEntity. This fails early
+// without calling the provider to make the change, but is not atomic with the
+// change; see GoDataRequest.IfMatch.
+func (service *GoDataService) checkEntityPreconditions(r *http.Request, request *GoDataRequest) error {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return nil
+	}
+
+	result := <-service.callProvider(r, request, "GetEntity", func() (*GoDataResponseField, error) {
+		return service.Provider.GetEntity(r.Context(), request)
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.Field == nil {
+		return InternalServerError("Provider did not return a valid response from GetEntity()")
+	}
+	fields, ok := result.Field.Value.(map[string]*GoDataResponseField)
+	if !ok {
+		return InternalServerError("Provider did not return a valid response from GetEntity()")
+	}
+
+	_, err := checkPreconditions(r, entityETag(fields))
+	return err
+}
@@ -0,0 +1,182 @@
+package godata
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A provider whose customers carry an ETag.
+type VersionedCustomerProvider struct {
+	EditableCustomerProvider
+}
+
+func (p *VersionedCustomerProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	result, err := p.EditableCustomerProvider.GetEntity(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Value.(map[string]*GoDataResponseField)[ODataFieldETag] = &GoDataResponseField{Value: `W/"1"`}
+	return result, nil
+}
+
+func (p *VersionedCustomerProvider) UpdateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	result, err := p.EditableCustomerProvider.UpdateEntity(ctx, r, entity)
+	if err != nil {
+		return nil, err
+	}
+	result.Value.(map[string]*GoDataResponseField)[ODataFieldETag] = &GoDataResponseField{Value: `W/"2"`}
+	return result, nil
+}
+
+func TestETagRead(t *testing.T) {
+	service := buildWritableService(t, &VersionedCustomerProvider{})
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/odata/Customers('Bob')", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if etag := w.Header().Get("ETag"); etag != `W/"1"` {
+		t.Errorf("ETag is %q", etag)
+	}
+	if !strings.Contains(w.Body.String(), `"@odata.etag":"W/\"1\""`) {
+		t.Errorf("Response has no @odata.etag annotation: %s", w.Body.String())
+	}
+
+	testCases := []struct {
+		header string
+		value  string
+		status int
+	}{
+		{"If-None-Match", `W/"1"`, 304},
+		{"If-None-Match", `W/"0", W/"1"`, 304},
+		{"If-None-Match", `*`, 304},
+		{"If-None-Match", `W/"0"`, 200},
+		{"If-Match", `W/"1"`, 200},
+		{"If-Match", `W/"0"`, 412},
+	}
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/odata/Customers('Bob')", nil)
+		r.Header.Set(testCase.header, testCase.value)
+		service.GoDataHTTPHandler(w, r)
+		if w.Code != testCase.status {
+			t.Errorf("%s: %s: expected status %d, got %d", testCase.header, testCase.value, testCase.status, w.Code)
+		}
+		if w.Code == 304 && w.Body.Len() != 0 {
+			t.Errorf("%s: %s: 304 response has a body: %s", testCase.header, testCase.value, w.Body.String())
+		}
+	}
+}
+
+func TestETagUpdate(t *testing.T) {
+	provider := &VersionedCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	testCases := []struct {
+		header string
+		value  string
+		status int
+	}{
+		{"If-Match", `W/"0"`, 412},
+		{"If-Match", `W/"1"`, 204},
+		{"If-Match", `*`, 204},
+		{"If-None-Match", `*`, 412},
+		{"If-None-Match", `W/"0"`, 204},
+		{"", "", 204},
+	}
+	for _, testCase := range testCases {
+		provider.Updated = nil
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/odata/Customers('Bob')", strings.NewReader(`{"Age":43}`))
+		if testCase.header != "" {
+			r.Header.Set(testCase.header, testCase.value)
+		}
+		service.GoDataHTTPHandler(w, r)
+
+		if w.Code != testCase.status {
+			t.Errorf("%s: %s: expected status %d, got %d: %s", testCase.header, testCase.value,
+				testCase.status, w.Code, w.Body.String())
+		}
+		if updated := len(provider.Updated) == 1; updated != (testCase.status == 204) {
+			t.Errorf("%s: %s: provider updated the entity %d times", testCase.header, testCase.value, len(provider.Updated))
+		}
+		if testCase.status == 204 && w.Header().Get("ETag") != `W/"2"` {
+			t.Errorf("%s: %s: ETag is %q", testCase.header, testCase.value, w.Header().Get("ETag"))
+		}
+	}
+
+	// a missing entity has no ETag to compare
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/odata/Customers('Carol')", strings.NewReader(`{"Age":43}`))
+	r.Header.Set("If-Match", `W/"1"`)
+	service.GoDataHTTPHandler(w, r)
+	if w.Code != 404 {
+		t.Errorf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestETagDelete(t *testing.T) {
+	provider := &VersionedCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/odata/Customers('Bob')", nil)
+	r.Header.Set("If-Match", `W/"0"`)
+	service.GoDataHTTPHandler(w, r)
+	if w.Code != 412 {
+		t.Errorf("Expected status 412, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Deleted) != 0 {
+		t.Error("Provider deleted an entity whose precondition failed")
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/odata/Customers('Bob')", nil)
+	r.Header.Set("If-Match", `W/"1"`)
+	service.GoDataHTTPHandler(w, r)
+	if w.Code != 204 {
+		t.Errorf("Expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Deleted) != 1 {
+		t.Errorf("Provider deleted %d entities", len(provider.Deleted))
+	}
+}
+
+// A provider whose customer is changed by another client after the service
+// checks its ETag, so only the provider itself can detect the conflict.
+type ConflictingCustomerProvider struct {
+	VersionedCustomerProvider
+	IfMatch []string
+}
+
+func (p *ConflictingCustomerProvider) UpdateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	p.IfMatch = r.IfMatch
+	if !ETagMatches(r.IfMatch, `W/"2"`) {
+		return nil, PreconditionFailedError("The entity has been modified")
+	}
+	return p.VersionedCustomerProvider.UpdateEntity(ctx, r, entity)
+}
+
+func TestETagConditionalUpdate(t *testing.T) {
+	provider := &ConflictingCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/odata/Customers('Bob')", strings.NewReader(`{"Age":43}`))
+	r.Header.Set("If-Match", `W/"0", W/"1"`)
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 412 {
+		t.Errorf("Expected status 412, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.IfMatch) != 2 || provider.IfMatch[0] != `W/"0"` || provider.IfMatch[1] != `W/"1"` {
+		t.Errorf("Expected the provider to receive the ETags of If-Match, got %q", provider.IfMatch)
+	}
+	if len(provider.Updated) != 0 {
+		t.Error("Provider updated an entity whose precondition failed")
+	}
+}
@@ -1,21 +1,63 @@
 package example
 
-/*
 import (
-	. "godata"
+	"net/http"
+	"strings"
+	"sync"
+
+	. "github.com/devinsburke/godata"
 )
-*/
 
 func HelloWorld() {
 
 }
 
-func CacheMiddleware() {
-
+// Cache the results of provider reads for the lifetime of the process. The
+// cached results are shared by concurrent requests, which is safe as long as
+// nothing modifies them; the service copies the fields of provider results
+// before adding control information.
+func CacheMiddleware() *GoDataMiddleware {
+	var lock sync.Mutex
+	cache := map[string]*GoDataResponseField{}
+
+	return &GoDataMiddleware{
+		Provider: func(r *http.Request, request *GoDataRequest, operation string, next GoDataProviderCall) (*GoDataResponseField, error) {
+			if !strings.HasPrefix(operation, "Get") {
+				return next()
+			}
+			key := operation + " " + r.URL.String()
+
+			lock.Lock()
+			cached, ok := cache[key]
+			lock.Unlock()
+			if ok {
+				return cached, nil
+			}
+
+			result, err := next()
+			if err == nil {
+				lock.Lock()
+				cache[key] = result
+				lock.Unlock()
+			}
+			return result, err
+		},
+	}
 }
 
-func AuthorizationMiddleware() {
-
+// Only allow requests with an Authorization header to modify entity sets.
+func AuthorizationMiddleware() *GoDataMiddleware {
+	return &GoDataMiddleware{
+		Semanticized: func(r *http.Request, request *GoDataRequest) error {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				return nil
+			}
+			if r.Header.Get("Authorization") == "" {
+				return &GoDataError{ResponseCode: 401, Message: "Authorization is required"}
+			}
+			return nil
+		},
+	}
 }
 
 /*
@@ -73,8 +115,8 @@ func main() {
 		service := BuildService(provider)
 		service.ListenAndServe(":8080", "http://localhost")
 
-	//service.AttachMiddleware(CacheMiddleware)
-	//service.AttachMiddleware(AuthorizationMiddleware)
+	//service.AttachMiddleware(CacheMiddleware())
+	//service.AttachMiddleware(AuthorizationMiddleware())
 	//service.BindAction(HelloWorld)
 	//service.BindFunction(HelloWorld)
 }
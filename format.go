@@ -0,0 +1,364 @@
+package godata
+
+import (
+	"math/big"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The media types the response to a request can be written in, in order of
+// preference. Responses that are raw values, e.g. $count, are not negotiated.
+func responseMediaTypes(request *GoDataRequest) []string {
+	switch request.RequestKind {
+	case RequestKindMetadata:
+		return []string{"application/xml", "application/json"}
+	case RequestKindCollection:
+		return []string{"application/json", "text/csv", "application/x-ndjson"}
+	case RequestKindService, RequestKindEntity, RequestKindProperty, RequestKindRef:
+		return []string{"application/json"}
+	default:
+		return nil
+	}
+}
+
+// Select the format of the response to a request from the $format query
+// option, or else from the Accept header, and store it in the query of the
+// request. If the client accepts no format the service can produce, a 406
+// error is returned.
+func (service *GoDataService) negotiateFormat(r *http.Request, request *GoDataRequest) error {
+	mediaTypes := responseMediaTypes(request)
+	if len(mediaTypes) == 0 || r.Method == http.MethodDelete {
+		// the response has no body to negotiate
+		request.Query.Format = nil
+		return nil
+	}
+
+	if format := request.Query.Format; format != nil {
+		for _, mediaType := range mediaTypes {
+			if format.MediaType == mediaType {
+				return nil
+			}
+		}
+		return NotAcceptableError("The format " + format.RawValue + " is not supported for this request").
+			SetTarget("$format")
+	}
+
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		request.Query.Format = &GoDataFormatQuery{MediaType: mediaTypes[0]}
+		return nil
+	}
+
+	type mediaRange struct {
+		mediaType string
+		params    map[string]string
+		quality   float64
+	}
+	ranges := []*mediaRange{}
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+			delete(params, "q")
+		}
+		if quality > 0 {
+			ranges = append(ranges, &mediaRange{mediaType, params, quality})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	for _, accepted := range ranges {
+		for _, mediaType := range mediaTypes {
+			if !mediaTypeMatches(accepted.mediaType, mediaType) {
+				continue
+			}
+			format, err := newFormatQuery(mediaType, accepted.params)
+			if err != nil {
+				continue
+			}
+			format.RawValue = accepted.mediaType
+			request.Query.Format = format
+			return nil
+		}
+	}
+	return NotAcceptableError("None of the accepted media types are supported for this request").
+		SetTarget("Accept")
+}
+
+// Check if a media range of an Accept header, e.g. application/*, includes a
+// media type.
+func mediaTypeMatches(mediaRange string, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+	}
+	return false
+}
+
+// Shape a JSON response for the format of the request: the control
+// information for the odata.metadata level is added or removed, and Int64
+// and Decimal values are written as strings for IEEE754Compatible clients.
+func (service *GoDataService) applyFormat(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+	format := request.Query.Format
+	if format == nil || (format.Metadata == "" || format.Metadata == ODataMetadataMinimal) && !format.IEEE754Compatible {
+		return nil
+	}
+
+	if request.LastSegment != nil {
+		switch reference := request.LastSegment.SemanticReference.(type) {
+		case *GoDataEntitySet:
+			entityType, err := service.LookupEntityType(reference.EntityType)
+			if err != nil {
+				return err
+			}
+			if value, ok := response.Fields[ODataFieldValue]; ok && request.RequestKind == RequestKindCollection &&
+				(r.Method == "" || r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				entities, _ := value.Value.([]*GoDataResponseField)
+				formatted := make([]*GoDataResponseField, len(entities))
+				for i, entity := range entities {
+					formatted[i] = entity
+					if entity == nil {
+						continue
+					}
+					if fields, ok := entity.Value.(map[string]*GoDataResponseField); ok {
+						fields, err := service.formatEntity(format, reference, entityType, fields)
+						if err != nil {
+							return err
+						}
+						formatted[i] = &GoDataResponseField{Value: fields}
+					}
+				}
+				response.Fields[ODataFieldValue] = &GoDataResponseField{Value: formatted}
+			} else {
+				fields, err := service.formatEntity(format, reference, entityType, response.Fields)
+				if err != nil {
+					return err
+				}
+				response.Fields = fields
+			}
+		case *GoDataProperty:
+			if value, ok := response.Fields[ODataFieldValue]; ok && value != nil && format.IEEE754Compatible {
+				response.Fields[ODataFieldValue] = &GoDataResponseField{Value: formatIEEE754(reference.Type, value.Value)}
+			}
+		}
+	}
+
+	if count, ok := response.Fields[ODataFieldCount]; ok && count != nil && format.IEEE754Compatible {
+		response.Fields[ODataFieldCount] = &GoDataResponseField{Value: formatIEEE754(GoDataInt64, count.Value)}
+	}
+	if format.Metadata == ODataMetadataNone {
+		for name := range response.Fields {
+			if isControlInformation(name) && name != ODataFieldCount && name != ODataFieldNextLink {
+				delete(response.Fields, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Shape the fields of a single entity for the format of the request, and
+// return them in a new map. The given fields are left unchanged, as a
+// provider may share them between responses.
+func (service *GoDataService) formatEntity(
+	format *GoDataFormatQuery,
+	entitySet *GoDataEntitySet,
+	entityType *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+) (map[string]*GoDataResponseField, error) {
+	fields = copyFields(fields)
+	if format.IEEE754Compatible {
+		for name, field := range fields {
+			if prop, ok := service.PropertyLookup[entityType][name]; ok && field != nil {
+				fields[name] = &GoDataResponseField{Value: formatIEEE754(prop.Type, field.Value)}
+			}
+		}
+	}
+
+	switch format.Metadata {
+	case ODataMetadataNone:
+		for name := range fields {
+			if isControlInformation(name) {
+				delete(fields, name)
+			}
+		}
+	case ODataMetadataFull:
+		fields[ODataFieldType] = &GoDataResponseField{Value: "#" + entitySet.EntityType}
+		id, err := service.entityUrl(entitySet, entityType, fields)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			fields[ODataFieldId] = &GoDataResponseField{Value: id}
+			for _, prop := range entityType.NavigationProperties {
+				fields[prop.Name+ODataFieldNavigationLink] = &GoDataResponseField{Value: id + "/" + prop.Name}
+			}
+		}
+		for _, prop := range entityType.Properties {
+			field, ok := fields[prop.Name]
+			if !ok || field == nil || field.Value == nil || !strings.HasPrefix(prop.Type, "Edm.") {
+				continue
+			}
+			switch prop.Type {
+			case GoDataString, GoDataBoolean, GoDataDouble, GoDataInt32:
+				// the type is implied by the JSON value
+			default:
+				fields[prop.Name+ODataFieldType] = &GoDataResponseField{Value: "#" + strings.TrimPrefix(prop.Type, "Edm.")}
+			}
+		}
+	}
+	return fields, nil
+}
+
+// Check if the name of a field is OData control information, e.g.
+// @odata.context or Orders@odata.navigationLink.
+func isControlInformation(name string) bool {
+	return strings.Contains(name, "@odata.")
+}
+
+// Convert a value of an Int64 or Decimal property to a string, as expected by
+// IEEE754Compatible clients.
+func formatIEEE754(edmType string, value interface{}) interface{} {
+	if edmType != GoDataInt64 && edmType != GoDataDecimal {
+		return value
+	}
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case *big.Rat:
+		if v == nil {
+			return value
+		}
+		return formatDecimal(v)
+	default:
+		return value
+	}
+}
+
+// The order of the properties of entities of a type in the response to a
+// request: the order given by the provider, if any, or else the structural
+// properties, then the navigation properties of the type, in declaration
+// order.
+func (service *GoDataService) propertyOrder(r *http.Request, request *GoDataRequest, entityType *GoDataEntityType) []string {
+	if provider, ok := service.providerImplementation().(GoDataPropertyOrderProvider); ok {
+		if order := provider.PropertyOrder(r.Context(), request, entityType); order != nil {
+			return order
+		}
+	}
+	order := make([]string, 0, len(entityType.Properties)+len(entityType.NavigationProperties))
+	for _, prop := range entityType.Properties {
+		order = append(order, prop.Name)
+	}
+	for _, prop := range entityType.NavigationProperties {
+		order = append(order, prop.Name)
+	}
+	return order
+}
+
+// Fix the order of the properties of the entities in a JSON response,
+// including expanded entities, and return the order of the response object
+// itself. Entities are replaced rather than modified, as a provider may share
+// them between responses.
+func (service *GoDataService) orderResponse(r *http.Request, request *GoDataRequest, response *GoDataResponse) ([]string, error) {
+	if request.LastSegment == nil {
+		return nil, nil
+	}
+	entitySet, ok := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	if !ok {
+		return nil, nil
+	}
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return nil, err
+	}
+	order := service.propertyOrder(r, request, entityType)
+
+	if value, ok := response.Fields[ODataFieldValue]; ok && value != nil && request.RequestKind == RequestKindCollection &&
+		(r.Method == "" || r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if entities, ok := value.Value.([]*GoDataResponseField); ok {
+			response.Fields[ODataFieldValue] = &GoDataResponseField{
+				Value: service.orderEntities(r, request, entities, entityType, order),
+			}
+		}
+		return nil, nil
+	}
+
+	response.Fields = service.orderExpanded(r, request, response.Fields, entityType)
+	return order, nil
+}
+
+// Order a list of entities of the given type, as orderResponse.
+func (service *GoDataService) orderEntities(
+	r *http.Request,
+	request *GoDataRequest,
+	entities []*GoDataResponseField,
+	entityType *GoDataEntityType,
+	order []string,
+) []*GoDataResponseField {
+	ordered := make([]*GoDataResponseField, len(entities))
+	for i, entity := range entities {
+		ordered[i] = entity
+		if entity == nil {
+			continue
+		}
+		if fields, ok := entity.Value.(map[string]*GoDataResponseField); ok {
+			fields = service.orderExpanded(r, request, fields, entityType)
+			ordered[i] = &GoDataResponseField{Value: &orderedJsonObject{fields, order}}
+		}
+	}
+	return ordered
+}
+
+// Order the expanded navigation properties of an entity, as orderResponse.
+// If the entity has any, they are replaced in a copy of its fields, which is
+// returned; otherwise the fields are returned as they are.
+func (service *GoDataService) orderExpanded(
+	r *http.Request,
+	request *GoDataRequest,
+	fields map[string]*GoDataResponseField,
+	entityType *GoDataEntityType,
+) map[string]*GoDataResponseField {
+	copied := false
+	replace := func(name string, field *GoDataResponseField) {
+		if !copied {
+			fields = copyFields(fields)
+			copied = true
+		}
+		fields[name] = field
+	}
+	for name, prop := range service.NavigationPropertyLookup[entityType] {
+		field, ok := fields[name]
+		if !ok || field == nil {
+			continue
+		}
+		target, err := service.LookupEntityType(prop.Type)
+		if err != nil {
+			continue
+		}
+		order := service.propertyOrder(r, request, target)
+		switch value := field.Value.(type) {
+		case map[string]*GoDataResponseField:
+			value = service.orderExpanded(r, request, value, target)
+			replace(name, &GoDataResponseField{Value: &orderedJsonObject{value, order}})
+		case []*GoDataResponseField:
+			replace(name, &GoDataResponseField{Value: service.orderEntities(r, request, value, target, order)})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,89 @@
+package godata
+
+import (
+	"context"
+	"mime"
+	"strings"
+)
+
+const (
+	// Only the control information needed to interpret the response, such
+	// as @odata.context, is included in JSON responses.
+	ODataMetadataMinimal string = "minimal"
+	// Control information that could be computed by the client is included
+	// as well, e.g. @odata.id, @odata.type and navigation links.
+	ODataMetadataFull string = "full"
+	// No control information is included, except for paging and counts.
+	ODataMetadataNone string = "none"
+)
+
+// The abbreviations of media types accepted by $format.
+var formatAbbreviations = map[string]string{
+	"json":   "application/json",
+	"xml":    "application/xml",
+	"atom":   "application/atom+xml",
+	"csv":    "text/csv",
+	"ndjson": "application/x-ndjson",
+}
+
+// ParseFormatString parses the value of the $format query option, which is
+// either an abbreviation such as json, or a media type with parameters, e.g.
+// application/json;odata.metadata=full.
+func ParseFormatString(ctx context.Context, format string) (*GoDataFormatQuery, error) {
+	if mediaType, ok := formatAbbreviations[strings.ToLower(format)]; ok {
+		return &GoDataFormatQuery{MediaType: mediaType, RawValue: format}, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(format)
+	if err != nil {
+		return nil, BadRequestError("Invalid $format query option").SetCause(err)
+	}
+	result, err := newFormatQuery(mediaType, params)
+	if err != nil {
+		return nil, err
+	}
+	result.RawValue = format
+	return result, nil
+}
+
+// Build a format from a media type and its parameters, as given in $format or
+// an Accept header. Parameter names are case-insensitive, and the odata prefix
+// may be omitted, as allowed by OData 4.01.
+func newFormatQuery(mediaType string, params map[string]string) (*GoDataFormatQuery, error) {
+	result := &GoDataFormatQuery{MediaType: strings.ToLower(mediaType)}
+	for name, value := range params {
+		name = strings.TrimPrefix(strings.ToLower(name), "odata.")
+		value = strings.ToLower(value)
+		switch name {
+		case "metadata":
+			if value != ODataMetadataMinimal && value != ODataMetadataFull && value != ODataMetadataNone {
+				return nil, NotAcceptableError("The odata.metadata value " + value + " is not supported")
+			}
+			result.Metadata = value
+		case "streaming":
+			result.Streaming = value == "true"
+		case "ieee754compatible":
+			result.IEEE754Compatible = value == "true"
+		}
+	}
+	return result, nil
+}
+
+// The value of the Content-Type header of a response in this format.
+func (f *GoDataFormatQuery) ContentType() string {
+	if f.MediaType != "application/json" {
+		return f.MediaType
+	}
+	metadata := f.Metadata
+	if metadata == "" {
+		metadata = ODataMetadataMinimal
+	}
+	contentType := "application/json;odata.metadata=" + metadata
+	if f.Streaming {
+		contentType += ";odata.streaming=true"
+	}
+	if f.IEEE754Compatible {
+		contentType += ";IEEE754Compatible=true"
+	}
+	return contentType
+}
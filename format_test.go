@@ -0,0 +1,294 @@
+package godata
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFormatString(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected GoDataFormatQuery
+	}{
+		{"json", GoDataFormatQuery{MediaType: "application/json"}},
+		{"JSON", GoDataFormatQuery{MediaType: "application/json"}},
+		{"xml", GoDataFormatQuery{MediaType: "application/xml"}},
+		{"application/json;odata.metadata=full", GoDataFormatQuery{MediaType: "application/json", Metadata: "full"}},
+		{"application/json;metadata=none;odata.streaming=true", GoDataFormatQuery{MediaType: "application/json", Metadata: "none", Streaming: true}},
+		{"application/json;IEEE754Compatible=true", GoDataFormatQuery{MediaType: "application/json", IEEE754Compatible: true}},
+	}
+	for _, testCase := range testCases {
+		format, err := ParseFormatString(context.Background(), testCase.format)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.format, err)
+			continue
+		}
+		testCase.expected.RawValue = testCase.format
+		if *format != testCase.expected {
+			t.Errorf("%s: expected %+v, got %+v", testCase.format, testCase.expected, *format)
+		}
+	}
+
+	if _, err := ParseFormatString(context.Background(), "application/json;odata.metadata=some"); err == nil {
+		t.Error("Expected an error for an unknown metadata level")
+	}
+	if _, err := ParseFormatString(context.Background(), "not a media type"); err == nil {
+		t.Error("Expected an error for an invalid media type")
+	}
+}
+
+// Request Bob with the given Accept header, and return the response.
+func getWithAccept(service *GoDataService, target string, accept string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	service.GoDataHTTPHandler(w, r)
+	return w
+}
+
+func TestContentNegotiation(t *testing.T) {
+	service := buildWritableService(t, &CustomerProvider{})
+
+	testCases := []struct {
+		target      string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"/odata/Customers('Bob')", "", 200, "application/json;odata.metadata=minimal"},
+		{"/odata/Customers('Bob')", "*/*", 200, "application/json;odata.metadata=minimal"},
+		{"/odata/Customers('Bob')", "application/*", 200, "application/json;odata.metadata=minimal"},
+		{"/odata/Customers('Bob')", "application/xml, application/json;q=0.5", 200, "application/json;odata.metadata=minimal"},
+		{"/odata/Customers('Bob')", "application/json;odata.metadata=full;q=0.5, application/json;odata.metadata=none", 200, "application/json;odata.metadata=none"},
+		{"/odata/Customers('Bob')", "application/json;odata.streaming=true;IEEE754Compatible=true", 200, "application/json;odata.metadata=minimal;odata.streaming=true;IEEE754Compatible=true"},
+		{"/odata/Customers('Bob')?$format=application/json%3Bodata.metadata=full", "application/xml", 200, "application/json;odata.metadata=full"},
+		{"/odata/Customers('Bob')", "application/xml", 406, "application/json"},
+		{"/odata/Customers('Bob')", "application/json;odata.metadata=some", 406, "application/json"},
+		{"/odata/Customers('Bob')", "application/json;q=0", 406, "application/json"},
+		{"/odata/$metadata", "application/xml", 200, "application/xml"},
+		{"/odata/$metadata", "text/html", 406, "application/json"},
+		{"/odata/Customers('Bob')/Age/$value", "application/xml", 200, "text/plain;charset=utf-8"},
+	}
+	for _, testCase := range testCases {
+		w := getWithAccept(service, testCase.target, testCase.accept)
+		if w.Code != testCase.status {
+			t.Errorf("%s: %s: expected status %d, got %d: %s", testCase.target, testCase.accept,
+				testCase.status, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != testCase.contentType {
+			t.Errorf("%s: %s: Content-Type is %q", testCase.target, testCase.accept, contentType)
+		}
+	}
+}
+
+func TestMetadataLevels(t *testing.T) {
+	service := buildWritableService(t, &CustomerProvider{})
+
+	var body map[string]interface{}
+	w := getWithAccept(service, "/odata/Customers('Bob')", "application/json;odata.metadata=none")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(body) != 2 || body["Name"] != "Bob" || body["Age"] != 42.0 {
+		t.Errorf("Unexpected entity without metadata: %s", w.Body.String())
+	}
+
+	body = nil
+	w = getWithAccept(service, "/odata/Customers('Bob')", "application/json;odata.metadata=full")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[string]interface{}{
+		"@odata.context":              "http://localhost/odata/$metadata#Customers/$entity",
+		"@odata.id":                   "http://localhost/odata/Customers('Bob')",
+		"@odata.type":                 "#Store.Customer",
+		"Orders@odata.navigationLink": "http://localhost/odata/Customers('Bob')/Orders",
+		"Name":                        "Bob",
+		"Age":                         42.0,
+	}
+	for name, value := range expected {
+		if body[name] != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, body[name])
+		}
+	}
+}
+
+func TestIEEE754Compatible(t *testing.T) {
+	service := buildWritableService(t, &CustomerProvider{})
+	customer, _ := service.LookupEntityType("Customer")
+	service.PropertyLookup[customer]["Age"].Type = GoDataInt64
+
+	var body map[string]interface{}
+	w := getWithAccept(service, "/odata/Customers('Bob')", "application/json;IEEE754Compatible=true;odata.metadata=full")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body["Age"] != "42" {
+		t.Errorf("Expected Age as a string, got %#v", body["Age"])
+	}
+	if body["Age@odata.type"] != "#Int64" {
+		t.Errorf("Expected Age to be annotated as Int64, got %#v", body["Age@odata.type"])
+	}
+
+	body = nil
+	w = getWithAccept(service, "/odata/Customers('Bob')/Age", "application/json;IEEE754Compatible=true")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body["value"] != "42" {
+		t.Errorf("Expected value as a string, got %#v", body["value"])
+	}
+}
+
+func TestFormatLeavesProviderResult(t *testing.T) {
+	provider := &SharedCustomerProvider{Shared: map[string]*GoDataResponseField{
+		"Name": {Value: "Bob"}, "Age": {Value: 42}, ODataFieldETag: {Value: `W/"1"`},
+	}}
+	service := buildWritableService(t, provider)
+	customer, _ := service.LookupEntityType("Customer")
+	service.PropertyLookup[customer]["Age"].Type = GoDataInt64
+
+	for _, target := range []string{"/odata/Customers('Bob')", "/odata/Customers"} {
+		for _, accept := range []string{
+			"application/json;odata.metadata=none",
+			"application/json;odata.metadata=full;IEEE754Compatible=true",
+		} {
+			w := getWithAccept(service, target, accept)
+			if w.Code != 200 {
+				t.Errorf("%s %s: expected status 200, got %d: %s", target, accept, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	if len(provider.Shared) != 3 || provider.Shared[ODataFieldETag] == nil || provider.Shared["Age"].Value != 42 {
+		t.Errorf("Expected the provider result to be left unchanged, got %v", provider.Shared)
+	}
+}
+
+func TestCsvFormat(t *testing.T) {
+	service := buildWritableService(t, &PagedCustomerProvider{})
+	service.MaxPageSize = 3
+
+	testCases := []struct {
+		target string
+		accept string
+		body   string
+	}{
+		{"/odata/Customers?$format=csv", "", "Name,Age\nA,20\nB,21\nC,22\n"},
+		{"/odata/Customers?$select=Age,Name", "text/csv", "Age,Name\n20,A\n21,B\n22,C\n"},
+	}
+	for _, testCase := range testCases {
+		w := getWithAccept(service, testCase.target, testCase.accept)
+		if w.Code != 200 {
+			t.Errorf("%s: expected status 200, got %d: %s", testCase.target, w.Code, w.Body.String())
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "text/csv" {
+			t.Errorf("%s: Content-Type is %q", testCase.target, contentType)
+		}
+		if body := w.Body.String(); body != testCase.body {
+			t.Errorf("%s: expected %q, got %q", testCase.target, testCase.body, body)
+		}
+	}
+
+	w := getWithAccept(service, "/odata/Customers?$format=csv", "")
+	if link := w.Header().Get("Link"); !strings.HasPrefix(link, "<http://localhost/odata/Customers?") ||
+		!strings.Contains(link, "$skiptoken=") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Errorf("Unexpected Link header %q", link)
+	}
+}
+
+func TestNdjsonFormat(t *testing.T) {
+	service := buildWritableService(t, &PagedCustomerProvider{})
+	service.MaxPageSize = 2
+
+	w := getWithAccept(service, "/odata/Customers", "application/x-ndjson")
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type is %q", contentType)
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Errorf("Expected 2 lines, got %q", w.Body.String())
+		return
+	}
+	for i, line := range lines {
+		var entity struct {
+			Name string
+			Age  int
+		}
+		if err := json.Unmarshal([]byte(line), &entity); err != nil {
+			t.Error(err)
+			return
+		}
+		if expected := string(rune('A' + i)); entity.Name != expected || entity.Age != 20+i {
+			t.Errorf("Line %d is %s", i, line)
+		}
+	}
+
+	// only collections can be written as rows
+	w = getWithAccept(service, "/odata/Customers('A')?$format=ndjson", "")
+	if w.Code != 406 {
+		t.Errorf("Expected status 406, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// A provider that orders the properties of customers by age first.
+type OrderedCustomerProvider struct {
+	PagedCustomerProvider
+}
+
+func (p *OrderedCustomerProvider) PropertyOrder(ctx context.Context, r *GoDataRequest, entityType *GoDataEntityType) []string {
+	if entityType.Name == "Customer" {
+		return []string{"Age", "Name"}
+	}
+	return nil
+}
+
+func TestPropertyOrder(t *testing.T) {
+	service := buildWritableService(t, &CustomerProvider{})
+
+	expected := `{"@odata.context":"http://localhost/odata/$metadata#Customers/$entity",` +
+		`"@odata.type":"#Store.Customer","@odata.id":"http://localhost/odata/Customers('Bob')",` +
+		`"Name":"Bob","Age":42,"Orders@odata.navigationLink":"http://localhost/odata/Customers('Bob')/Orders"}`
+	for i := 0; i < 10; i++ {
+		w := getWithAccept(service, "/odata/Customers('Bob')", "application/json;odata.metadata=full")
+		if body := w.Body.String(); body != expected {
+			t.Errorf("Unexpected entity %s", body)
+			return
+		}
+	}
+
+	service = buildWritableService(t, &OrderedCustomerProvider{})
+	service.MaxPageSize = 2
+	w := getWithAccept(service, "/odata/Customers", "")
+	if body := w.Body.String(); !strings.HasPrefix(body, `{"@odata.context":"http://localhost/odata/$metadata#Customers",`+
+		`"@odata.nextLink":"http://localhost/odata/Customers?$skiptoken=`) ||
+		!strings.HasSuffix(body, `","value":[{"Age":20,"Name":"A"},{"Age":21,"Name":"B"}]}`) {
+		t.Errorf("Unexpected collection %s", body)
+	}
+	w = getWithAccept(service, "/odata/Customers?$format=ndjson", "")
+	if body := w.Body.String(); body != "{\"Age\":20,\"Name\":\"A\"}\n{\"Age\":21,\"Name\":\"B\"}\n" {
+		t.Errorf("Unexpected rows %q", body)
+	}
+}
+
+func TestStreamedOrder(t *testing.T) {
+	buffered := getWithAccept(buildWritableService(t, &PagedCustomerProvider{}), "/odata/Customers", "")
+	streamed := getWithAccept(buildWritableService(t, &StreamingCustomerProvider{}), "/odata/Customers", "")
+	if buffered.Body.String() != streamed.Body.String() {
+		t.Errorf("Streamed collection %s differs from %s", streamed.Body.String(), buffered.Body.String())
+	}
+}
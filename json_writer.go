@@ -0,0 +1,509 @@
+package godata
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func writeJsonRaw(w io.Writer, s string) error {
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// Write a value of any supported type as JSON, as described for
+// GoDataResponseField.Json.
+func writeJsonValue(w io.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return writeJsonRaw(w, "null")
+	case *GoDataResponseField:
+		return v.WriteJson(w)
+	case string:
+		return writeJsonString(w, v)
+	case []byte:
+		return writeJsonString(w, base64.URLEncoding.EncodeToString(v))
+	case bool:
+		return writeJsonRaw(w, strconv.FormatBool(v))
+	case int:
+		return writeJsonRaw(w, strconv.Itoa(v))
+	case int64:
+		return writeJsonRaw(w, strconv.FormatInt(v, 10))
+	case float64:
+		return writeJsonFloat(w, v, 64)
+	case float32:
+		return writeJsonFloat(w, float64(v), 32)
+	case time.Time:
+		return writeJsonString(w, v.Format(time.RFC3339Nano))
+	case GoDataDateValue:
+		return writeJsonString(w, time.Time(v).Format("2006-01-02"))
+	case GoDataTimeOfDayValue:
+		return writeJsonString(w, formatTimeOfDay(time.Duration(v)))
+	case time.Duration:
+		return writeJsonString(w, formatDuration(v))
+	case [16]byte:
+		return writeJsonString(w, formatGuid(v))
+	case *big.Rat:
+		if v == nil {
+			return writeJsonRaw(w, "null")
+		}
+		return writeJsonRaw(w, formatDecimal(v))
+	case map[string]*GoDataResponseField:
+		return writeJsonDict(w, v)
+	case *orderedJsonObject:
+		return writeJsonObject(w, v.fields, v.order)
+	case []*GoDataResponseField:
+		return writeJsonList(w, v)
+	case json.Marshaler:
+		return writeJsonMarshaler(w, v)
+	case encoding.TextMarshaler:
+		text, err := v.MarshalText()
+		if err != nil {
+			return InternalServerError("Response field could not be serialized").SetCause(err)
+		}
+		return writeJsonString(w, string(text))
+	}
+	return writeJsonReflected(w, reflect.ValueOf(value))
+}
+
+// Write a value whose type is not known to writeJsonValue by its kind, e.g.
+// a named string type, a pointer or a slice of strings.
+func writeJsonReflected(w io.Writer, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return writeJsonRaw(w, "null")
+		}
+		return writeJsonValue(w, value.Elem().Interface())
+	case reflect.String:
+		return writeJsonString(w, value.String())
+	case reflect.Bool:
+		return writeJsonRaw(w, strconv.FormatBool(value.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeJsonRaw(w, strconv.FormatInt(value.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return writeJsonRaw(w, strconv.FormatUint(value.Uint(), 10))
+	case reflect.Float32:
+		return writeJsonFloat(w, value.Float(), 32)
+	case reflect.Float64:
+		return writeJsonFloat(w, value.Float(), 64)
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return writeJsonRaw(w, "null")
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			// a named byte slice or array is binary data as well
+			data := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(data), value)
+			if value.Kind() == reflect.Array && len(data) == 16 {
+				var guid [16]byte
+				copy(guid[:], data)
+				return writeJsonString(w, formatGuid(guid))
+			}
+			return writeJsonString(w, base64.URLEncoding.EncodeToString(data))
+		}
+		if err := writeJsonRaw(w, "["); err != nil {
+			return err
+		}
+		for i := 0; i < value.Len(); i++ {
+			if i > 0 {
+				if err := writeJsonRaw(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := writeJsonValue(w, value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return writeJsonRaw(w, "]")
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if value.IsNil() {
+			return writeJsonRaw(w, "null")
+		}
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		if err := writeJsonRaw(w, "{"); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if i > 0 {
+				if err := writeJsonRaw(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := writeJsonString(w, key.String()); err != nil {
+				return err
+			}
+			if err := writeJsonRaw(w, ":"); err != nil {
+				return err
+			}
+			if err := writeJsonValue(w, value.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+		}
+		return writeJsonRaw(w, "}")
+	}
+	return InternalServerError(fmt.Sprintf("Response field type %T not recognized.", value.Interface()))
+}
+
+// Write the output of a json.Marshaler, after checking it is valid JSON.
+func writeJsonMarshaler(w io.Writer, m json.Marshaler) error {
+	if value := reflect.ValueOf(m); value.Kind() == reflect.Ptr && value.IsNil() {
+		return writeJsonRaw(w, "null")
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return InternalServerError("Response field could not be serialized").SetCause(err)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return InternalServerError("Response field could not be serialized").SetCause(err)
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Write a float as a JSON number. JSON has no representation for NaN and
+// infinity, so these are written as the strings NaN, INF and -INF, as in OData.
+func writeJsonFloat(w io.Writer, f float64, bits int) error {
+	switch {
+	case math.IsNaN(f):
+		return writeJsonString(w, "NaN")
+	case math.IsInf(f, 1):
+		return writeJsonString(w, "INF")
+	case math.IsInf(f, -1):
+		return writeJsonString(w, "-INF")
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		// avoid writing hundreds of digits
+		format = 'e'
+	}
+	return writeJsonRaw(w, strconv.FormatFloat(f, format, -1, bits))
+}
+
+// Write a string as a JSON string, escaping quotes, backslashes and control
+// characters. Invalid UTF-8 is replaced by the Unicode replacement character.
+func writeJsonString(w io.Writer, s string) error {
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < 0x20:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = append(buf, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			// valid JSON, but not valid JavaScript
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xf])
+		default:
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	buf = append(buf, '"')
+	_, err := w.Write(buf)
+	return err
+}
+
+// The order of OData control information within an object, or within the
+// annotations of a property. Other annotations follow in alphabetical order.
+var controlInformationOrder = []string{
+	ODataFieldContext,
+	"@odata.metadataEtag",
+	ODataFieldType,
+	ODataFieldCount,
+	ODataFieldNextLink,
+	"@odata.deltaLink",
+	ODataFieldId,
+	ODataFieldETag,
+	"@odata.editLink",
+	"@odata.readLink",
+	ODataFieldNavigationLink,
+	"@odata.associationLink",
+	"@odata.mediaEditLink",
+	"@odata.mediaReadLink",
+	"@odata.mediaContentType",
+	"@odata.mediaEtag",
+}
+
+// The properties of an object along with the order they are written in, as
+// the value of a response field. The service orders entities this way just
+// before they are serialized.
+type orderedJsonObject struct {
+	fields map[string]*GoDataResponseField
+	order  []string
+}
+
+func writeJsonDict(w io.Writer, d map[string]*GoDataResponseField) error {
+	return writeJsonObject(w, d, nil)
+}
+
+// Write a map as a JSON object. Control information such as @odata.context
+// is written first, and the annotations of a property precede it. Properties
+// follow in the given order, and those missing from it in alphabetical order,
+// so the output is the same for the same data.
+func writeJsonObject(w io.Writer, d map[string]*GoDataResponseField, order []string) error {
+	if err := writeJsonRaw(w, "{"); err != nil {
+		return err
+	}
+	if err := writeJsonMembers(w, d, order, true); err != nil {
+		return err
+	}
+	return writeJsonRaw(w, "}")
+}
+
+// Write the members of a JSON object, without the enclosing braces. If first
+// is false, the members follow others already written to the same object.
+func writeJsonMembers(w io.Writer, d map[string]*GoDataResponseField, order []string, first bool) error {
+	for _, k := range orderedJsonNames(d, order) {
+		if !first {
+			if err := writeJsonRaw(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		if err := writeJsonString(w, k); err != nil {
+			return err
+		}
+		if err := writeJsonRaw(w, ":"); err != nil {
+			return err
+		}
+		if err := d[k].WriteJson(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sort the names of the members of an object: control information first,
+// then each property in the given order, preceded by its annotations, then
+// the remaining properties in alphabetical order.
+func orderedJsonNames(d map[string]*GoDataResponseField, order []string) []string {
+	positions := make(map[string]int, len(order))
+	for i, name := range order {
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		property1, annotation1 := splitAnnotation(names[i])
+		property2, annotation2 := splitAnnotation(names[j])
+		if property1 != property2 {
+			if property1 == "" || property2 == "" {
+				// control information of the object itself
+				return property1 == ""
+			}
+			position1, ok1 := positions[property1]
+			position2, ok2 := positions[property2]
+			if ok1 && ok2 {
+				return position1 < position2
+			} else if ok1 || ok2 {
+				return ok1
+			}
+			return property1 < property2
+		}
+		if annotation1 == "" || annotation2 == "" {
+			// the annotations of a property precede it
+			return annotation2 == ""
+		}
+		rank1, rank2 := annotationRank(annotation1), annotationRank(annotation2)
+		if rank1 != rank2 {
+			return rank1 < rank2
+		}
+		return annotation1 < annotation2
+	})
+	return names
+}
+
+// Split the name of a member into the property it belongs to and its
+// annotation, e.g. Orders@odata.navigationLink into Orders and
+// @odata.navigationLink. Control information has no property.
+func splitAnnotation(name string) (string, string) {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i], name[i:]
+	}
+	return name, ""
+}
+
+func annotationRank(annotation string) int {
+	for i, name := range controlInformationOrder {
+		if name == annotation {
+			return i
+		}
+	}
+	return len(controlInformationOrder)
+}
+
+func writeJsonList(w io.Writer, l []*GoDataResponseField) error {
+	if err := writeJsonRaw(w, "["); err != nil {
+		return err
+	}
+	for i, v := range l {
+		if i > 0 {
+			if err := writeJsonRaw(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := v.WriteJson(w); err != nil {
+			return err
+		}
+	}
+	return writeJsonRaw(w, "]")
+}
+
+// Format a time since midnight as an Edm.TimeOfDay, e.g. 15:04:05.5.
+func formatTimeOfDay(d time.Duration) string {
+	d = d % (24 * time.Hour)
+	if d < 0 {
+		d += 24 * time.Hour
+	}
+	clock := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Add(d)
+	return clock.Format("15:04:05.999999999")
+}
+
+// Format a duration as an ISO 8601 duration, e.g. P1DT2H3M4.5S, as used for
+// Edm.Duration.
+func formatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+
+	var clock bytes.Buffer
+	if hours > 0 {
+		clock.WriteString(strconv.FormatInt(int64(hours), 10) + "H")
+	}
+	if minutes > 0 {
+		clock.WriteString(strconv.FormatInt(int64(minutes), 10) + "M")
+	}
+	if d > 0 || (days == 0 && clock.Len() == 0) {
+		clock.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S")
+	}
+
+	result := sign + "P"
+	if days > 0 {
+		result += strconv.FormatInt(int64(days), 10) + "D"
+	}
+	if clock.Len() > 0 {
+		result += "T" + clock.String()
+	}
+	return result
+}
+
+// Format a rational number as an Edm.Decimal, e.g. 12.5. Numbers without a
+// finite decimal expansion, e.g. 1/3, are rounded to 34 decimal places.
+func formatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	// the number of places is the larger power of 2 or 5 in the denominator
+	twos, fives := 0, 0
+	d := new(big.Int).Set(r.Denom())
+	m := new(big.Int)
+	for two := big.NewInt(2); m.Mod(d, two).Sign() == 0; twos++ {
+		d.Quo(d, two)
+	}
+	for five := big.NewInt(5); m.Mod(d, five).Sign() == 0; fives++ {
+		d.Quo(d, five)
+	}
+	places := twos
+	if fives > places {
+		places = fives
+	}
+	if d.Cmp(big.NewInt(1)) != 0 {
+		places = 34
+	}
+	return r.FloatString(places)
+}
+
+// Format 16 bytes as an Edm.Guid, e.g. 01234567-89ab-cdef-0123-456789abcdef.
+func formatGuid(guid [16]byte) string {
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, 36)
+	for i, b := range guid {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			buf = append(buf, '-')
+		}
+		buf = append(buf, hex[b>>4], hex[b&0xf])
+	}
+	return string(buf)
+}
+
+// Format a primitive value of a property of the given type as its raw value,
+// as served for $value: the text of its JSON representation, without the
+// quotes of a string.
+func formatRawValue(edmType string, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case map[string]*GoDataResponseField, []*GoDataResponseField, *orderedJsonObject:
+		return nil, InternalServerError("Provider returned a structured value for a primitive property")
+	case time.Time:
+		if edmType == GoDataDate {
+			value = GoDataDateValue(v)
+		}
+	case time.Duration:
+		if edmType == GoDataTimeOfDay {
+			value = GoDataTimeOfDayValue(v)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeJsonValue(&buf, value); err != nil {
+		return nil, err
+	}
+	var text string
+	if err := json.Unmarshal(buf.Bytes(), &text); err == nil {
+		return []byte(text), nil
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+package godata
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testMarshaler struct{}
+
+func (testMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{ "marshaled": true }`), nil
+}
+
+type testStatus string
+
+type testGuid [16]byte
+
+func TestResponseFieldJson(t *testing.T) {
+	when := time.Date(2021, 3, 4, 5, 6, 7, 500000000, time.FixedZone("", -7*3600))
+	name := "Bob"
+	var missing *string
+	guid := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+	testCases := []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, `null`},
+		{true, `true`},
+		{false, `false`},
+		{"plain", `"plain"`},
+		{"quote \" backslash \\ newline \n tab \t bell \a", `"quote \" backslash \\ newline \n tab \t bell \u0007"`},
+		{"héllo \u2028", `"héllo \u2028"`},
+		{"bad \xff utf-8", `"bad \ufffd utf-8"`},
+		{42, `42`},
+		{int8(-8), `-8`},
+		{int32(32), `32`},
+		{int64(9007199254740993), `9007199254740993`},
+		{uint16(16), `16`},
+		{uint64(18446744073709551615), `18446744073709551615`},
+		{1.5, `1.5`},
+		{float32(0.1), `0.1`},
+		{1e300, `1e+300`},
+		{math.NaN(), `"NaN"`},
+		{math.Inf(1), `"INF"`},
+		{math.Inf(-1), `"-INF"`},
+		{big.NewRat(1250, 100), `12.5`},
+		{big.NewRat(-3, 40), `-0.075`},
+		{big.NewRat(12345678901234567, 100), `123456789012345.67`},
+		{big.NewRat(1, 3), `0.3333333333333333333333333333333333`},
+		{big.NewRat(7, 1), `7`},
+		{[]byte{0xfb, 0xff}, `"-_8="`},
+		{guid, `"01234567-89ab-cdef-0123-456789abcdef"`},
+		{testGuid(guid), `"01234567-89ab-cdef-0123-456789abcdef"`},
+		{when, `"2021-03-04T05:06:07.5-07:00"`},
+		{GoDataDateValue(when), `"2021-03-04"`},
+		{GoDataTimeOfDayValue(13*time.Hour + 2*time.Minute + 3*time.Second + 250*time.Millisecond), `"13:02:03.25"`},
+		{26*time.Hour + 3*time.Minute + 4500*time.Millisecond, `"P1DT2H3M4.5S"`},
+		{24 * time.Hour, `"P1D"`},
+		{-90 * time.Second, `"-PT1M30S"`},
+		{time.Duration(0), `"PT0S"`},
+		{testMarshaler{}, `{"marshaled":true}`},
+		{testStatus("active"), `"active"`},
+		{&name, `"Bob"`},
+		{missing, `null`},
+		{[]string{"a", "b"}, `["a","b"]`},
+		{map[string]interface{}{"b": 2, "a": []int{1}}, `{"a":[1],"b":2}`},
+		{&GoDataResponseField{Value: "nested"}, `"nested"`},
+		{[]*GoDataResponseField{{Value: 1}, nil}, `[1,null]`},
+		{map[string]*GoDataResponseField{"Active": {Value: true}}, `{"Active":true}`},
+	}
+	for _, testCase := range testCases {
+		field := &GoDataResponseField{Value: testCase.value}
+		result, err := field.Json()
+		if err != nil {
+			t.Errorf("%#v: %v", testCase.value, err)
+			continue
+		}
+		if string(result) != testCase.expected {
+			t.Errorf("%#v: expected %s, got %s", testCase.value, testCase.expected, result)
+		}
+		if !json.Valid(result) {
+			t.Errorf("%#v: invalid JSON %s", testCase.value, result)
+		}
+	}
+
+	for _, value := range []interface{}{struct{}{}, map[int]string{1: "a"}, make(chan int)} {
+		field := &GoDataResponseField{Value: value}
+		if _, err := field.Json(); err == nil {
+			t.Errorf("%#v: expected an error", value)
+		}
+	}
+}
+
+func TestResponseKeysEscaped(t *testing.T) {
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		"Odd \"Name\"": {Value: true},
+	}}
+	result, err := response.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(result) != `{"Odd \"Name\"":true}` {
+		t.Errorf("Unexpected response %s", result)
+	}
+}
+
+func TestOrderedJsonNames(t *testing.T) {
+	fields := map[string]*GoDataResponseField{}
+	for _, name := range []string{"Zeta", "Orders", "Age", "@test.note", "Orders@odata.navigationLink",
+		"@odata.count", "Name", "Age@odata.type", "@odata.context", "Age@test.note"} {
+		fields[name] = &GoDataResponseField{Value: true}
+	}
+	expected := "[@odata.context @odata.count @test.note Name Age@odata.type Age@test.note Age " +
+		"Orders@odata.navigationLink Orders Zeta]"
+	for i := 0; i < 10; i++ {
+		names := orderedJsonNames(fields, []string{"Name", "Age", "Orders"})
+		if fmt.Sprint(names) != expected {
+			t.Errorf("Unexpected order %v", names)
+			return
+		}
+	}
+
+	// without an order, properties are sorted by name
+	names := orderedJsonNames(fields, nil)
+	if fmt.Sprint(names) != "[@odata.context @odata.count @test.note Age@odata.type Age@test.note Age "+
+		"Name Orders@odata.navigationLink Orders Zeta]" {
+		t.Errorf("Unexpected order %v", names)
+	}
+}
+
+func TestFormatRawValue(t *testing.T) {
+	when := time.Date(2021, 3, 4, 5, 6, 7, 500000000, time.FixedZone("", -7*3600))
+	guid := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+	testCases := []struct {
+		edmType  string
+		value    interface{}
+		expected string
+	}{
+		{GoDataString, "Bob \"the\" builder", `Bob "the" builder`},
+		{GoDataInt32, 42, `42`},
+		{GoDataBoolean, true, `true`},
+		{GoDataDouble, 0.5, `0.5`},
+		{GoDataDouble, math.Inf(-1), `-INF`},
+		{GoDataDateTimeOffset, when, `2021-03-04T05:06:07.5-07:00`},
+		{GoDataDate, when, `2021-03-04`},
+		{GoDataDate, GoDataDateValue(when), `2021-03-04`},
+		{GoDataTimeOfDay, 13*time.Hour + 30*time.Minute, `13:30:00`},
+		{GoDataDuration, 26 * time.Hour, `P1DT2H`},
+		{GoDataGuid, guid, `01234567-89ab-cdef-0123-456789abcdef`},
+	}
+	for _, testCase := range testCases {
+		actual, err := formatRawValue(testCase.edmType, testCase.value)
+		if err != nil {
+			t.Errorf("%s %#v: %v", testCase.edmType, testCase.value, err)
+			continue
+		}
+		if string(actual) != testCase.expected {
+			t.Errorf("%s %#v: expected %s, got %s", testCase.edmType, testCase.value, testCase.expected, actual)
+		}
+	}
+
+	if _, err := formatRawValue(GoDataString, map[string]*GoDataResponseField{}); err == nil {
+		t.Error("Expected an error for a structured value")
+	}
+}
@@ -0,0 +1,420 @@
+package godata
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var keyNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// The kinds of literal a key value may be given as.
+var keyTokenTypes = map[TokenType]bool{
+	ExpressionTokenString:   true,
+	ExpressionTokenInteger:  true,
+	ExpressionTokenFloat:    true,
+	ExpressionTokenGuid:     true,
+	ExpressionTokenDate:     true,
+	ExpressionTokenDateTime: true,
+	ExpressionTokenTime:     true,
+	ExpressionTokenDuration: true,
+	ExpressionTokenBoolean:  true,
+}
+
+// The kinds of literal a key property of each primitive type accepts.
+var keyPropertyTokenTypes = map[string][]ExpressionTokenType{
+	GoDataString:         {ExpressionTokenString},
+	GoDataByte:           {ExpressionTokenInteger},
+	GoDataSByte:          {ExpressionTokenInteger},
+	GoDataInt16:          {ExpressionTokenInteger},
+	GoDataInt32:          {ExpressionTokenInteger},
+	GoDataInt64:          {ExpressionTokenInteger},
+	GoDataDecimal:        {ExpressionTokenInteger, ExpressionTokenFloat},
+	GoDataSingle:         {ExpressionTokenInteger, ExpressionTokenFloat},
+	GoDataDouble:         {ExpressionTokenInteger, ExpressionTokenFloat},
+	GoDataBoolean:        {ExpressionTokenBoolean},
+	GoDataGuid:           {ExpressionTokenGuid},
+	GoDataTimeOfDay:      {ExpressionTokenTime},
+	GoDataDate:           {ExpressionTokenDate},
+	GoDataDateTimeOffset: {ExpressionTokenDateTime},
+	GoDataDuration:       {ExpressionTokenDuration},
+}
+
+// Parse the key predicate of a path segment, without its parentheses, e.g.
+// 'ALFKI' or OrderId=1,Line=2. Each value is read with the expression
+// tokenizer, so commas and equal signs within string literals are part of the
+// value. A key given positionally is returned with an empty name.
+func ParseKeyPredicate(ctx context.Context, predicate string) ([]*GoDataKeyValue, error) {
+	parts := splitUnquoted(predicate, ',', -1)
+	result := make([]*GoDataKeyValue, 0, len(parts))
+	names := map[string]bool{}
+	for _, part := range parts {
+		value := &GoDataKeyValue{Literal: strings.TrimSpace(part)}
+		if assignment := splitUnquoted(part, '=', 2); len(assignment) == 2 {
+			value.Name = strings.TrimSpace(assignment[0])
+			value.Literal = strings.TrimSpace(assignment[1])
+			if !keyNameRe.MatchString(value.Name) {
+				return nil, BadRequestError("Invalid key property name '" + value.Name + "'")
+			}
+			if names[value.Name] {
+				return nil, BadRequestError("Key property " + value.Name + " is given more than once")
+			}
+			names[value.Name] = true
+		} else if len(parts) > 1 {
+			return nil, BadRequestError("Each value of a composite key must be named, e.g. Id=1")
+		}
+
+		if value.Literal == "" {
+			return nil, BadRequestError("Empty key value in (" + predicate + ")")
+		}
+		tokens, err := GlobalExpressionTokenizer.Tokenize(ctx, value.Literal)
+		if err != nil {
+			return nil, BadRequestError("Invalid key value " + value.Literal).SetCause(inputError(err))
+		}
+		switch {
+		case len(tokens) == 1 && keyTokenTypes[tokens[0].Type]:
+			value.Token = tokens[0]
+		case len(tokens) == 2 && tokens[0].Type == ExpressionTokenLiteral && tokens[1].Type == ExpressionTokenString:
+			// an enum member prefixed with its type, e.g. Shop.Status'Open'
+			value.Token = tokens[1]
+		default:
+			return nil, BadRequestError("Invalid key value " + value.Literal)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// Split s at each occurrence of sep outside of single-quoted string literals,
+// into at most n parts if n is positive.
+func splitUnquoted(s string, sep byte, n int) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(s) && (n <= 0 || len(parts) < n-1); i++ {
+		if s[i] == '\'' {
+			// an escaped quote, '', toggles twice
+			quoted = !quoted
+		} else if s[i] == sep && !quoted {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Read the segment following an entity set segment as its key, e.g. 42 in
+// Customers/42, and remove it from the path, unless it is a property, a
+// navigation property or a $-segment. Only single-part keys may be given as
+// a segment. Strings are not quoted in a key segment, so the value is quoted
+// for the key properties that expect a string literal.
+func foldKeySegment(segment *GoDataSegment, entity *GoDataEntityType, service *GoDataService) error {
+	next := segment.Next
+	keys := entityKeyNames(entity)
+	if next == nil || len(keys) != 1 || strings.HasPrefix(next.RawValue, "$") {
+		return nil
+	}
+	if _, ok := service.PropertyLookup[entity][next.Name]; ok {
+		return nil
+	}
+	if _, ok := service.NavigationPropertyLookup[entity][next.Name]; ok {
+		return nil
+	}
+
+	literal := next.RawValue
+	if prop, ok := service.PropertyLookup[entity][keys[0]]; ok &&
+		(prop.Type == GoDataString || service.lookupEnumType(prop.Type) != nil) {
+		literal = "'" + strings.ReplaceAll(literal, "'", "''") + "'"
+	}
+	key, err := ParseKeyPredicate(context.Background(), literal)
+	if err != nil {
+		return BadRequestError("Invalid key segment " + next.RawValue).SetCause(err)
+	}
+	segment.Key = key
+	segment.Identifier = keyIdentifier(key)
+	segment.Next = next.Next
+	if next.Next != nil {
+		next.Next.Prev = segment
+	}
+	return nil
+}
+
+// Check the key predicate of a segment against the key properties of the
+// entity type it addresses, name the values given positionally, convert each
+// value to the type of its key property, and list them in the order the key
+// properties are declared. Entity types without a key accept any key
+// predicate, and their values are left unconverted.
+func semanticizeKeyPredicate(segment *GoDataSegment, entity *GoDataEntityType, service *GoDataService) error {
+	keys := entityKeyNames(entity)
+	if len(keys) == 0 || segment.Key == nil {
+		return nil
+	}
+
+	if len(segment.Key) == 1 && segment.Key[0].Name == "" {
+		if len(keys) > 1 {
+			return BadRequestError("The key of " + segment.Name + " has more than one property, so each of " +
+				strings.Join(keys, ", ") + " must be named")
+		}
+		segment.Key[0].Name = keys[0]
+	}
+	if len(segment.Key) != len(keys) {
+		return BadRequestError("The key of " + segment.Name + " consists of " + strings.Join(keys, ", "))
+	}
+
+	var err error
+	isKey := map[string]bool{}
+	for _, key := range keys {
+		isKey[key] = true
+	}
+	for _, value := range segment.Key {
+		prop, ok := service.PropertyLookup[entity][value.Name]
+		if !ok || !isKey[value.Name] {
+			return BadRequestError(value.Name + " is not a key property of " + segment.Name)
+		}
+		if value.Value, err = keyLiteralValue(value, prop, service); err != nil {
+			return err
+		}
+		value.Token.SemanticType = SemanticTypeProperty
+		value.Token.SemanticReference = prop
+	}
+
+	// list the values in the order the key properties are declared
+	values := make(map[string]*GoDataKeyValue, len(segment.Key))
+	for _, value := range segment.Key {
+		values[value.Name] = value
+	}
+	for i, key := range keys {
+		segment.Key[i] = values[key]
+	}
+	return nil
+}
+
+// Convert a key value to the Go representation of the type of its key
+// property, checking that it is a literal of that type. Values of types the
+// service cannot resolve, e.g. type definitions, are converted by the kind of
+// literal they are given as.
+func keyLiteralValue(value *GoDataKeyValue, prop *GoDataProperty, service *GoDataService) (interface{}, error) {
+	quoted := strings.HasPrefix(value.Literal, "'")
+	if prop.Type == GoDataString && quoted && value.Token.Type == ExpressionTokenDuration {
+		// the tokenizer reads strings such as 'P1D' as durations
+		value.Token = &Token{Value: value.Literal, Type: ExpressionTokenString}
+	}
+	mismatch := BadRequestError("The key value " + value.Literal + " is not a valid " + prop.Type +
+		" for key property " + value.Name)
+
+	if enum := service.lookupEnumType(prop.Type); enum != nil {
+		if value.Token.Type != ExpressionTokenString {
+			return nil, mismatch
+		}
+		if !quoted {
+			prefix := value.Literal[:strings.Index(value.Literal, "'")]
+			if prefix != prop.Type && !strings.HasSuffix(prefix, "."+enum.Name) {
+				return nil, mismatch
+			}
+		}
+		member := strings.Trim(value.Token.Value, "'")
+		for _, m := range enum.Members {
+			if m.Name == member {
+				return member, nil
+			}
+		}
+		return nil, mismatch
+	}
+
+	edmType := prop.Type
+	types, ok := keyPropertyTokenTypes[edmType]
+	if !ok {
+		if edmType, ok = keyTokenEdmTypes[value.Token.Type]; !ok {
+			return nil, mismatch
+		}
+		types = keyPropertyTokenTypes[edmType]
+	}
+	for _, t := range types {
+		if value.Token.Type == t && (t != ExpressionTokenString || quoted) {
+			result, err := parseKeyLiteral(edmType, value)
+			if err != nil {
+				return nil, mismatch.SetCause(err)
+			}
+			return result, nil
+		}
+	}
+	return nil, mismatch
+}
+
+// The type of the values of key properties whose type is not known, by the
+// kind of literal they are given as.
+var keyTokenEdmTypes = map[TokenType]string{
+	ExpressionTokenString:   GoDataString,
+	ExpressionTokenInteger:  GoDataInt64,
+	ExpressionTokenFloat:    GoDataDouble,
+	ExpressionTokenGuid:     GoDataGuid,
+	ExpressionTokenDate:     GoDataDate,
+	ExpressionTokenDateTime: GoDataDateTimeOffset,
+	ExpressionTokenTime:     GoDataTimeOfDay,
+	ExpressionTokenDuration: GoDataDuration,
+	ExpressionTokenBoolean:  GoDataBoolean,
+}
+
+var keyDurationRe = regexp.MustCompile(`^(-)?P(?:([0-9]+)D)?(?:T(?:([0-9]+)H)?(?:([0-9]+)M)?(?:([0-9]+(?:\.[0-9]+)?)S)?)?$`)
+
+// Convert a key literal of the given primitive type to its Go representation:
+// integers become an int64, Edm.Decimal a *big.Rat, Edm.Double and Edm.Single
+// a float64, Edm.Guid a [16]byte, Edm.Date and Edm.DateTimeOffset a
+// time.Time, Edm.TimeOfDay a GoDataTimeOfDayValue and Edm.Duration a
+// time.Duration. Strings are unquoted and unescaped.
+func parseKeyLiteral(edmType string, value *GoDataKeyValue) (interface{}, error) {
+	literal := value.Token.Value
+	if bounds, ok := edmIntegerRanges[edmType]; ok {
+		i, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if i < bounds[0] || i > bounds[1] {
+			return nil, fmt.Errorf("%d is out of range", i)
+		}
+		return i, nil
+	}
+
+	switch edmType {
+	case GoDataString:
+		return strings.ReplaceAll(value.Literal[1:len(value.Literal)-1], "''", "'"), nil
+	case GoDataDecimal:
+		r, ok := new(big.Rat).SetString(literal)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a decimal", literal)
+		}
+		return r, nil
+	case GoDataDouble:
+		return strconv.ParseFloat(literal, 64)
+	case GoDataSingle:
+		return strconv.ParseFloat(literal, 32)
+	case GoDataBoolean:
+		return literal == "true", nil
+	case GoDataGuid:
+		var guid [16]byte
+		_, err := hex.Decode(guid[:], []byte(strings.ReplaceAll(literal, "-", "")))
+		return guid, err
+	case GoDataDate:
+		return time.Parse("2006-01-02", literal)
+	case GoDataDateTimeOffset:
+		t, err := time.Parse(time.RFC3339Nano, literal)
+		if err != nil {
+			// the seconds may be omitted
+			t, err = time.Parse("2006-01-02T15:04Z07:00", literal)
+		}
+		return t, err
+	case GoDataTimeOfDay:
+		t, err := time.Parse("15:04:05.999999999", literal)
+		if err != nil {
+			t, err = time.Parse("15:04", literal)
+		}
+		if err != nil {
+			return nil, err
+		}
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return GoDataTimeOfDayValue(t.Sub(midnight)), nil
+	case GoDataDuration:
+		return parseKeyDuration(literal)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", edmType)
+}
+
+// Parse an ISO 8601 duration with days, hours, minutes and seconds, e.g.
+// P1DT2H3M4.5S. Years and months have no fixed length, so they are rejected.
+func parseKeyDuration(literal string) (time.Duration, error) {
+	match := keyDurationRe.FindStringSubmatch(literal)
+	if match == nil {
+		return 0, fmt.Errorf("%s is not a duration of days, hours, minutes and seconds", literal)
+	}
+	var d time.Duration
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(match[i+2], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(f * float64(unit))
+	}
+	if match[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// Check if a value of a key property, as parsed from the body of a request,
+// equals a key value of the URL. Values are compared as the Go representation
+// of the type of the key property, so e.g. a Guid matches regardless of case.
+// Key values of entity types without a key are not converted, so their
+// literals are compared instead.
+func keyValueMatches(value *GoDataKeyValue, field interface{}) bool {
+	if value.Value == nil {
+		return formatKeyLiteral(field) == value.Literal
+	}
+	edmType := ""
+	if prop, ok := value.Token.SemanticReference.(*GoDataProperty); ok {
+		edmType = prop.Type
+	}
+	if _, ok := keyPropertyTokenTypes[edmType]; !ok {
+		// an enum member or a type definition
+		edmType = keyTokenEdmTypes[value.Token.Type]
+	}
+	if s, ok := field.(string); ok && edmType != GoDataString {
+		// a Guid, date, time or duration, which JSON has no type for
+		parsed, err := parseKeyLiteral(edmType, &GoDataKeyValue{Literal: s, Token: &Token{Value: s}})
+		if err != nil {
+			return false
+		}
+		field = parsed
+	}
+
+	switch expected := value.Value.(type) {
+	case int64:
+		switch f := field.(type) {
+		case int:
+			return int64(f) == expected
+		case int64:
+			return f == expected
+		}
+		return false
+	case *big.Rat:
+		f, ok := field.(*big.Rat)
+		return ok && f.Cmp(expected) == 0
+	case float64:
+		f, ok := field.(float64)
+		if edmType == GoDataSingle {
+			return ok && float32(f) == float32(expected)
+		}
+		return ok && f == expected
+	case time.Time:
+		f, ok := field.(time.Time)
+		return ok && f.Equal(expected)
+	}
+	return field == value.Value
+}
+
+// Find an enum type by its qualified name, or nil if the name does not refer
+// to an enum type of the service.
+func (service *GoDataService) lookupEnumType(name string) *GoDataEnumType {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return nil
+	}
+	schema, ok := service.SchemaLookup[name[:i]]
+	if !ok {
+		return nil
+	}
+	for _, enum := range schema.EnumTypes {
+		if enum.Name == name[i+1:] {
+			return enum
+		}
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package godata
+
+import (
+	"context"
+	"math/big"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyPredicate(t *testing.T) {
+	testCases := []struct {
+		predicate string
+		names     []string
+		literals  []string
+		types     []ExpressionTokenType
+	}{
+		{"1", []string{""}, []string{"1"}, []ExpressionTokenType{ExpressionTokenInteger}},
+		{"'Smith, John'", []string{""}, []string{"'Smith, John'"}, []ExpressionTokenType{ExpressionTokenString}},
+		{"'a=b'", []string{""}, []string{"'a=b'"}, []ExpressionTokenType{ExpressionTokenString}},
+		{"'O''Neil'", []string{""}, []string{"'O''Neil'"}, []ExpressionTokenType{ExpressionTokenString}},
+		{"OrderId=1,Line=2", []string{"OrderId", "Line"}, []string{"1", "2"},
+			[]ExpressionTokenType{ExpressionTokenInteger, ExpressionTokenInteger}},
+		{"Name='x,y=z', Day=2020-01-31", []string{"Name", "Day"}, []string{"'x,y=z'", "2020-01-31"},
+			[]ExpressionTokenType{ExpressionTokenString, ExpressionTokenDate}},
+		{"Id=01234567-89ab-cdef-0123-456789abcdef", []string{"Id"}, []string{"01234567-89ab-cdef-0123-456789abcdef"},
+			[]ExpressionTokenType{ExpressionTokenGuid}},
+		{"Shop.Status'Open'", []string{""}, []string{"Shop.Status'Open'"}, []ExpressionTokenType{ExpressionTokenString}},
+	}
+	for _, testCase := range testCases {
+		key, err := ParseKeyPredicate(context.Background(), testCase.predicate)
+		if err != nil {
+			t.Errorf("(%s): %v", testCase.predicate, err)
+			continue
+		}
+		if len(key) != len(testCase.names) {
+			t.Errorf("(%s): expected %d values, got %d", testCase.predicate, len(testCase.names), len(key))
+			continue
+		}
+		for i, value := range key {
+			if value.Name != testCase.names[i] || value.Literal != testCase.literals[i] ||
+				value.Token.Type != testCase.types[i] {
+				t.Errorf("(%s): unexpected value %s=%s of type %v", testCase.predicate, value.Name, value.Literal,
+					value.Token.Type)
+			}
+		}
+	}
+
+	invalid := []string{"", "1,2", "Id=1,Id=2", "Id=", "'unterminated", "Id=1,2", "1 2", "$it", "Na me=1", "x"}
+	for _, predicate := range invalid {
+		if _, err := ParseKeyPredicate(context.Background(), predicate); err == nil {
+			t.Errorf("(%s): expected an error", predicate)
+		}
+	}
+}
+
+// A provider with entity types keyed by properties of several types.
+func keyTestService(t *testing.T) *GoDataService {
+	notNull := "false"
+	metadata := &GoDataMetadata{
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{
+				{
+					Namespace: "Shop",
+					EntityTypes: []*GoDataEntityType{
+						{
+							Name: "Customer",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Name"}}},
+							Properties: []*GoDataProperty{
+								{Name: "Name", Type: GoDataString, Nullable: notNull},
+							},
+						},
+						{
+							Name: "OrderLine",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "OrderId"}, {Name: "Line"}}},
+							Properties: []*GoDataProperty{
+								{Name: "OrderId", Type: GoDataGuid, Nullable: notNull},
+								{Name: "Line", Type: GoDataInt32, Nullable: notNull},
+								{Name: "Quantity", Type: GoDataInt32},
+							},
+						},
+						{
+							Name: "Reading",
+							Key: &GoDataKey{PropertyRefs: []*GoDataPropertyRef{
+								{Name: "Amount"}, {Name: "At"}, {Name: "Time"}, {Name: "Span"}, {Name: "Flag"},
+								{Name: "Ratio"},
+							}},
+							Properties: []*GoDataProperty{
+								{Name: "Amount", Type: GoDataDecimal, Nullable: notNull},
+								{Name: "At", Type: GoDataDateTimeOffset, Nullable: notNull},
+								{Name: "Time", Type: GoDataTimeOfDay, Nullable: notNull},
+								{Name: "Span", Type: GoDataDuration, Nullable: notNull},
+								{Name: "Flag", Type: GoDataBoolean, Nullable: notNull},
+								{Name: "Ratio", Type: GoDataDouble, Nullable: notNull},
+							},
+						},
+						{
+							Name: "Shift",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Day"}, {Name: "Status"}}},
+							Properties: []*GoDataProperty{
+								{Name: "Day", Type: GoDataDate, Nullable: notNull},
+								{Name: "Status", Type: "Shop.Status", Nullable: notNull},
+							},
+						},
+					},
+					EnumTypes: []*GoDataEnumType{
+						{Name: "Status", Members: []*GoDataMember{{Name: "Open"}, {Name: "Closed"}}},
+					},
+					EntityContainers: []*GoDataEntityContainer{
+						{
+							Name: "Container",
+							EntitySets: []*GoDataEntitySet{
+								{Name: "Customers", EntityType: "Shop.Customer"},
+								{Name: "OrderLines", EntityType: "Shop.OrderLine"},
+								{Name: "Readings", EntityType: "Shop.Reading"},
+								{Name: "Shifts", EntityType: "Shop.Shift"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	service, err := BuildService(&ModelProvider{metadata: metadata}, "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestSemanticizeKeyPredicate(t *testing.T) {
+	service := keyTestService(t)
+	ctx := context.Background()
+
+	guid := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	valid := []struct {
+		path   string
+		names  []string
+		values []interface{}
+	}{
+		{"Customers('Smith, John')", []string{"Name"}, []interface{}{"Smith, John"}},
+		{"Customers('O''Neil')", []string{"Name"}, []interface{}{"O'Neil"}},
+		{"Customers(Name='P1D')", []string{"Name"}, []interface{}{"P1D"}},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2)", []string{"OrderId", "Line"},
+			[]interface{}{guid, int64(2)}},
+		{"OrderLines(Line=2,OrderId=01234567-89AB-CDEF-0123-456789ABCDEF)/Quantity", []string{"OrderId", "Line"},
+			[]interface{}{guid, int64(2)}},
+		{"Shifts(Day=2024-02-29,Status='Open')", []string{"Day", "Status"},
+			[]interface{}{time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), "Open"}},
+		{"Shifts(Status=Shop.Status'Closed',Day=2024-02-29)", []string{"Day", "Status"},
+			[]interface{}{time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), "Closed"}},
+		{"Readings(Ratio=0.5,Flag=true,Span=duration'P1DT2H',Time=13:30,At=2024-02-29T13:30:00Z,Amount=12.50)",
+			[]string{"Amount", "At", "Time", "Span", "Flag", "Ratio"},
+			[]interface{}{big.NewRat(25, 2), time.Date(2024, 2, 29, 13, 30, 0, 0, time.UTC),
+				GoDataTimeOfDayValue(13*time.Hour + 30*time.Minute), 26 * time.Hour, true, 0.5}},
+	}
+	for _, testCase := range valid {
+		req, err := ParseRequest(ctx, testCase.path, url.Values{})
+		if err != nil {
+			t.Errorf("%s: %v", testCase.path, err)
+			continue
+		}
+		if err := req.SemanticizeRequest(service); err != nil {
+			t.Errorf("%s: %v", testCase.path, err)
+			continue
+		}
+		names := []string{}
+		for i, value := range req.FirstSegment.Key {
+			names = append(names, value.Name)
+			if prop, ok := value.Token.SemanticReference.(*GoDataProperty); !ok || prop.Name != value.Name {
+				t.Errorf("%s: expected %s to refer to its key property", testCase.path, value.Name)
+			}
+			expected := testCase.values[i]
+			if r, ok := expected.(*big.Rat); ok {
+				if actual, ok := value.Value.(*big.Rat); !ok || actual.Cmp(r) != 0 {
+					t.Errorf("%s: expected %s to be %v, got %#v", testCase.path, value.Name, r, value.Value)
+				}
+			} else if !reflect.DeepEqual(value.Value, expected) {
+				t.Errorf("%s: expected %s to be %#v, got %#v", testCase.path, value.Name, expected, value.Value)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(testCase.names, ",") {
+			t.Errorf("%s: unexpected key values %v", testCase.path, names)
+		}
+		if v, ok := req.FirstSegment.GetKeyValue(testCase.names[0]); !ok || v != req.FirstSegment.Key[0].Value {
+			t.Errorf("%s: unexpected value %v of %s", testCase.path, v, testCase.names[0])
+		}
+	}
+
+	invalid := []struct {
+		path    string
+		message string
+	}{
+		{"Customers(1)", "not a valid Edm.String"},
+		{"Customers(Id='x')", "not a key property"},
+		{"OrderLines(2)", "must be named"},
+		{"OrderLines(Line=2)", "consists of OrderId, Line"},
+		{"OrderLines(OrderId='x',Line=2)", "not a valid Edm.Guid"},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Quantity=2)", "not a key property"},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2.5)", "not a valid Edm.Int32"},
+		{"Shifts(Day='2024-02-29',Status='Open')", "not a valid Edm.Date"},
+		{"Shifts(Day=2024-02-29,Status='Pending')", "not a valid Shop.Status"},
+		{"Shifts(Day=2024-02-29,Status=Shop.Color'Open')", "not a valid Shop.Status"},
+		{"Shifts(Day=2024-02-30,Status='Open')", "not a valid Edm.Date"},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2147483648)", "not a valid Edm.Int32"},
+		{"Readings(Amount=1,At=2024-02-29T13:30:00Z,Time=13:30,Span=duration'P1Y',Flag=true,Ratio=1)",
+			"not a valid Edm.Duration"},
+	}
+	for _, testCase := range invalid {
+		req, err := ParseRequest(ctx, testCase.path, url.Values{})
+		if err == nil {
+			err = req.SemanticizeRequest(service)
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", testCase.path, testCase.message, err)
+		}
+	}
+}
+
+func TestValidateKeyProperties(t *testing.T) {
+	service := keyTestService(t)
+	ctx := context.Background()
+
+	testCases := []struct {
+		path  string
+		body  string
+		valid bool
+	}{
+		{"Customers('O''Neil')", `{"Name":"O'Neil"}`, true},
+		{"Customers('O''Neil')", `{"Name":"ONeil"}`, false},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2)",
+			`{"OrderId":"01234567-89AB-CDEF-0123-456789ABCDEF","Line":2,"Quantity":5}`, true},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2)",
+			`{"OrderId":"01234567-89ab-cdef-0123-456789abcdee"}`, false},
+		{"OrderLines(OrderId=01234567-89ab-cdef-0123-456789abcdef,Line=2)", `{"Line":3}`, false},
+		{"Shifts(Day=2024-02-29,Status=Shop.Status'Open')", `{"Day":"2024-02-29","Status":"Open"}`, true},
+		{"Shifts(Day=2024-02-29,Status='Open')", `{"Status":"Closed"}`, false},
+		{"Readings(Amount=12.50,At=2024-02-29T13:30:00Z,Time=13:30,Span=duration'P1DT2H',Flag=true,Ratio=0.5)",
+			`{"Amount":12.5,"At":"2024-02-29T14:30:00+01:00","Time":"13:30:00","Span":"PT26H","Flag":true,"Ratio":5e-1}`,
+			true},
+		{"Readings(Amount=12.50,At=2024-02-29T13:30:00Z,Time=13:30,Span=duration'P1DT2H',Flag=true,Ratio=0.5)",
+			`{"Amount":"12.51"}`, false},
+		{"Readings(Amount=12.50,At=2024-02-29T13:30:00Z,Time=13:30,Span=duration'P1DT2H',Flag=true,Ratio=0.5)",
+			`{"At":"2024-02-29T13:30:01Z"}`, false},
+	}
+	for _, testCase := range testCases {
+		req, err := ParseRequest(ctx, testCase.path, url.Values{})
+		if err == nil {
+			err = req.SemanticizeRequest(service)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testCase.path, err)
+			continue
+		}
+		entitySet := req.FirstSegment.SemanticReference.(*GoDataEntitySet)
+		entityType, err := service.LookupEntityType(entitySet.EntityType)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fields, err := ParseEntity(strings.NewReader(testCase.body), service, entityType)
+		if err != nil {
+			t.Errorf("%s %s: %v", testCase.path, testCase.body, err)
+			continue
+		}
+		err = validateKeyProperties(req.FirstSegment.Key, fields)
+		if testCase.valid && err != nil {
+			t.Errorf("%s %s: %v", testCase.path, testCase.body, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("%s %s: expected the key change to be rejected", testCase.path, testCase.body)
+		}
+	}
+}
+
+func TestParseUrlPathQuotedKey(t *testing.T) {
+	req, err := ParseRequest(context.Background(), "Files('a/b(c)')/Name", url.Values{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if req.FirstSegment.Name != "Files" || req.FirstSegment.Identifier.Get() != "'a/b(c)'" {
+		t.Errorf("Unexpected first segment %+v", *req.FirstSegment)
+	}
+	if req.LastSegment.Name != "Name" || req.LastSegment.Prev != req.FirstSegment {
+		t.Errorf("Unexpected last segment %+v", *req.LastSegment)
+	}
+}
+
+func TestParseEscapedUrlPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		segments []string
+	}{
+		{"Files('a%2Fb')/Name", []string{"Files('a/b')", "Name"}},
+		{"Files%28%27a/b%27%29/Name", []string{"Files('a/b')", "Name"}},
+		{"Files/a%2Fb/Name", []string{"Files", "a/b", "Name"}},
+		{"Files/a%20b", []string{"Files", "a b"}},
+	}
+	for _, testCase := range testCases {
+		req, err := parseEscapedRequest(context.Background(), testCase.path, url.Values{})
+		if err != nil {
+			t.Errorf("%s: %v", testCase.path, err)
+			continue
+		}
+		segments := []string{}
+		for segment := req.FirstSegment; segment != nil; segment = segment.Next {
+			segments = append(segments, segment.RawValue)
+		}
+		if !reflect.DeepEqual(segments, testCase.segments) {
+			t.Errorf("%s: expected segments %v, got %v", testCase.path, testCase.segments, segments)
+		}
+	}
+
+	if _, err := parseEscapedRequest(context.Background(), "Files/a%zz", url.Values{}); err == nil {
+		t.Error("Expected an invalid escape sequence to be rejected")
+	}
+}
@@ -0,0 +1,625 @@
+package godata
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	edmxNamespace = "http://docs.oasis-open.org/odata/ns/edmx"
+	odataVersion  = "4.0"
+)
+
+// Builds the metadata of a service from Go types, so that the metadata cannot
+// drift apart from the values the provider returns. Entity sets, entity types,
+// complex types and enum types are exposed by passing a value of their Go
+// type, e.g.
+//
+//	metadata, err := NewModelBuilder("Store").
+//		ExposeEntitySet("Customers", Customer{}).
+//		ExposeEntitySet("Orders", Order{}).
+//		ExposeEnumType(Status(0), &GoDataMember{Name: "Open", Value: "0"}).
+//		BuildMetadata()
+//
+// The properties of a struct type are found as for NewResponseField, and the
+// odata tag of a field may give these options as well:
+//
+//	ID     int64   `odata:",key"`                            // part of the key
+//	Name   string  `odata:",maxlength=100"`                  // MaxLength facet
+//	Price  float64 `odata:",type=Edm.Decimal,precision=10,scale=2"`
+//	Email  *string `odata:",required"`                       // not nullable
+//	Rank   int     `odata:",nullable"`                       // nullable
+//	Orders []Order `odata:",navigation,partner=Customer"`    // navigation
+//
+// The Edm type of a property follows from its Go type: strings, booleans,
+// numbers, time.Time (Edm.DateTimeOffset), time.Duration (Edm.Duration),
+// GoDataDateValue (Edm.Date), GoDataTimeOfDayValue (Edm.TimeOfDay), []byte
+// (Edm.Binary) and [16]byte (Edm.Guid). Slices are collections, exposed enum
+// types are used by name, and other structs are exposed as complex types.
+// Pointers are nullable, other values are not.
+//
+// Structs that are the targets of navigation properties are exposed as entity
+// types. Navigation properties are partnered with the single navigation
+// property of the target type that refers back, if there is exactly one, and
+// bound to the entity set of their target type, if there is exactly one.
+type GoDataModelBuilder struct {
+	// The namespace of the schema that contains the types.
+	Namespace string
+	// The name of the entity container.
+	ContainerName string
+
+	entitySets []*modelEntitySet
+	types      []*modelType
+	err        error
+}
+
+type modelEntitySet struct {
+	name   string
+	goType reflect.Type
+}
+
+type modelTypeKind int
+
+const (
+	modelEntityType modelTypeKind = iota
+	modelComplexType
+	modelEnumType
+)
+
+func (kind modelTypeKind) String() string {
+	switch kind {
+	case modelEntityType:
+		return "an entity type"
+	case modelComplexType:
+		return "a complex type"
+	default:
+		return "an enum type"
+	}
+}
+
+// A Go type exposed in the model.
+type modelType struct {
+	goType  reflect.Type
+	kind    modelTypeKind
+	members []*GoDataMember
+}
+
+// Create a model builder for a schema with the given namespace, and an entity
+// container named Container.
+func NewModelBuilder(namespace string) *GoDataModelBuilder {
+	return &GoDataModelBuilder{Namespace: namespace, ContainerName: "Container"}
+}
+
+// Expose an entity set of the entity type of the given value.
+func (builder *GoDataModelBuilder) ExposeEntitySet(name string, entity interface{}) *GoDataModelBuilder {
+	t := builder.expose(entity, modelEntityType, nil)
+	if t != nil {
+		builder.entitySets = append(builder.entitySets, &modelEntitySet{name, t})
+	}
+	return builder
+}
+
+// Expose the entity type of the given value, without an entity set.
+func (builder *GoDataModelBuilder) ExposeEntityType(entity interface{}) *GoDataModelBuilder {
+	builder.expose(entity, modelEntityType, nil)
+	return builder
+}
+
+// Expose the complex type of the given value. Complex types used by exposed
+// types are exposed anyway; this is only needed for complex types that are not
+// used by any other type.
+func (builder *GoDataModelBuilder) ExposeComplexType(value interface{}) *GoDataModelBuilder {
+	builder.expose(value, modelComplexType, nil)
+	return builder
+}
+
+// Expose the type of the given value, which must have an integer or string
+// kind, as an enum type with the given members. Properties of the type have
+// the enum type rather than a primitive type.
+func (builder *GoDataModelBuilder) ExposeEnumType(value interface{}, members ...*GoDataMember) *GoDataModelBuilder {
+	builder.expose(value, modelEnumType, members)
+	return builder
+}
+
+func (builder *GoDataModelBuilder) expose(value interface{}, kind modelTypeKind, members []*GoDataMember) reflect.Type {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		builder.fail(errors.New("Cannot expose the type of a nil value"))
+		return nil
+	}
+	if kind != modelEnumType {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	builder.types = append(builder.types, &modelType{goType: t, kind: kind, members: members})
+	return t
+}
+
+// Remember the first error, which is returned by BuildMetadata.
+func (builder *GoDataModelBuilder) fail(err error) {
+	if builder.err == nil {
+		builder.err = err
+	}
+}
+
+// Build the metadata of the exposed types and entity sets, which can be
+// returned by the GetMetadata method of a provider.
+func (builder *GoDataModelBuilder) BuildMetadata() (*GoDataMetadata, error) {
+	if builder.err != nil {
+		return nil, builder.err
+	}
+
+	build := &modelBuild{
+		builder:  builder,
+		schema:   &GoDataSchema{Namespace: builder.Namespace},
+		types:    map[reflect.Type]*modelType{},
+		names:    map[string]reflect.Type{},
+		entities: map[string]*GoDataEntityType{},
+	}
+	for _, t := range builder.types {
+		if _, err := build.expose(t.goType, t.kind, t.members); err != nil {
+			return nil, err
+		}
+	}
+	// building a type may expose more types, e.g. the types of its complex
+	// properties, so the queue grows as it is worked through
+	for i := 0; i < len(build.queue); i++ {
+		if err := build.buildType(build.queue[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := build.partnerNavigationProperties(); err != nil {
+		return nil, err
+	}
+	container, err := build.buildContainer()
+	if err != nil {
+		return nil, err
+	}
+	build.schema.EntityContainers = []*GoDataEntityContainer{container}
+
+	return &GoDataMetadata{
+		XMLNamespace: edmxNamespace,
+		Version:      odataVersion,
+		DataServices: &GoDataServices{Schemas: []*GoDataSchema{build.schema}},
+	}, nil
+}
+
+// The state of a call to BuildMetadata.
+type modelBuild struct {
+	builder *GoDataModelBuilder
+	schema  *GoDataSchema
+	// The exposed types, by Go type, and in the order they were exposed.
+	types map[reflect.Type]*modelType
+	queue []*modelType
+	// The Go types of the exposed types, by name.
+	names map[string]reflect.Type
+	// The entity types, by qualified name.
+	entities map[string]*GoDataEntityType
+	// The navigation properties of entity types, with the qualified names
+	// of the types they belong to.
+	navigation []*modelNavigation
+}
+
+type modelNavigation struct {
+	owner string
+	nav   *GoDataNavigationProperty
+}
+
+func (build *modelBuild) qualify(name string) string {
+	return build.builder.Namespace + "." + name
+}
+
+// Expose a type, unless it is already exposed, and get its qualified name.
+func (build *modelBuild) expose(t reflect.Type, kind modelTypeKind, members []*GoDataMember) (string, error) {
+	if existing, ok := build.types[t]; ok {
+		if existing.kind != kind {
+			return "", errors.New("Type " + t.String() + " cannot be both " + existing.kind.String() +
+				" and " + kind.String())
+		}
+		return build.qualify(t.Name()), nil
+	}
+	if t.Name() == "" {
+		return "", errors.New("Cannot expose unnamed type " + t.String())
+	}
+	if kind == modelEnumType {
+		if len(members) == 0 {
+			return "", errors.New("Enum type " + t.String() + " has no members")
+		}
+	} else if t.Kind() != reflect.Struct {
+		return "", errors.New("Cannot expose " + t.String() + " as " + kind.String() + "; it is not a struct")
+	}
+	if other, ok := build.names[t.Name()]; ok {
+		return "", errors.New("Types " + other.String() + " and " + t.String() + " have the same name")
+	}
+
+	exposed := &modelType{goType: t, kind: kind, members: members}
+	build.types[t] = exposed
+	build.names[t.Name()] = t
+	build.queue = append(build.queue, exposed)
+	return build.qualify(t.Name()), nil
+}
+
+func (build *modelBuild) buildType(t *modelType) error {
+	name := t.goType.Name()
+	switch t.kind {
+	case modelEnumType:
+		underlying, err := enumUnderlyingType(t.goType)
+		if err != nil {
+			return err
+		}
+		build.schema.EnumTypes = append(build.schema.EnumTypes, &GoDataEnumType{
+			Name:           name,
+			UnderlyingType: underlying,
+			Members:        t.members,
+		})
+	case modelComplexType:
+		props, navProps, keys, err := build.buildProperties(t.goType)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return errors.New("Complex type " + name + " cannot have a key")
+		}
+		build.schema.ComplexTypes = append(build.schema.ComplexTypes, &GoDataComplexType{
+			Name:                 name,
+			Properties:           props,
+			NavigationProperties: navProps,
+		})
+	case modelEntityType:
+		props, navProps, keys, err := build.buildProperties(t.goType)
+		if err != nil {
+			return err
+		}
+		key, err := modelKey(name, keys)
+		if err != nil {
+			return err
+		}
+		entity := &GoDataEntityType{
+			Name:                 name,
+			Key:                  key,
+			Properties:           props,
+			NavigationProperties: navProps,
+		}
+		build.schema.EntityTypes = append(build.schema.EntityTypes, entity)
+		build.entities[build.qualify(name)] = entity
+		for _, nav := range navProps {
+			build.navigation = append(build.navigation, &modelNavigation{build.qualify(name), nav})
+		}
+	}
+	return nil
+}
+
+// Get the key of an entity type from the names of its key properties.
+func modelKey(entity string, names []string) (*GoDataKey, error) {
+	if len(names) == 0 {
+		return nil, errors.New("Entity type " + entity + " has no key; tag its key fields with the key option")
+	}
+	key := &GoDataKey{}
+	for _, name := range names {
+		key.PropertyRefs = append(key.PropertyRefs, &GoDataPropertyRef{Name: name})
+	}
+	return key, nil
+}
+
+// Build the structural and navigation properties of a struct type, and get
+// the names of its key properties.
+func (build *modelBuild) buildProperties(t reflect.Type) (
+	[]*GoDataProperty, []*GoDataNavigationProperty, []string, error) {
+
+	props := []*GoDataProperty{}
+	navProps := []*GoDataNavigationProperty{}
+	keys := []string{}
+	for _, field := range structProperties(t) {
+		if strings.Contains(field.name, "@") {
+			// control information and annotations are not properties
+			continue
+		}
+		fieldType := t.FieldByIndex(field.index).Type
+
+		if field.navigation {
+			nav, err := build.buildNavigationProperty(t, field, fieldType)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			navProps = append(navProps, nav)
+			continue
+		}
+
+		prop, err := build.buildProperty(t, field, fieldType)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if hasTagOption(field.options, "key") {
+			prop.Nullable = "false"
+			keys = append(keys, prop.Name)
+		}
+		props = append(props, prop)
+	}
+	return props, navProps, keys, nil
+}
+
+func (build *modelBuild) buildProperty(owner reflect.Type, field *structProperty, t reflect.Type) (
+	*GoDataProperty, error) {
+
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	typeName := field.options["type"]
+	if typeName == "" {
+		var err error
+		typeName, err = build.propertyType(t)
+		if err != nil {
+			return nil, errors.New("Property " + field.name + " of " + owner.String() + ": " + err.Error())
+		}
+	}
+
+	prop := &GoDataProperty{Name: field.name, Type: typeName, Nullable: modelNullable(nullable, field.options)}
+	facets := []struct {
+		option string
+		value  *int
+	}{
+		{"maxlength", &prop.MaxLength},
+		{"precision", &prop.Precision},
+		{"scale", &prop.Scale},
+	}
+	for _, facet := range facets {
+		value, ok := field.options[facet.option]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("Property " + field.name + " of " + owner.String() + " has an invalid " +
+				facet.option + " option: " + value)
+		}
+		*facet.value = n
+	}
+	return prop, nil
+}
+
+var (
+	timeOfDayValueType = reflect.TypeOf(GoDataTimeOfDayValue(0))
+	durationType       = reflect.TypeOf(time.Duration(0))
+)
+
+// Get the Edm type of a property from its Go type, exposing complex types as
+// needed.
+func (build *modelBuild) propertyType(t reflect.Type) (string, error) {
+	if exposed, ok := build.types[t]; ok && exposed.kind == modelEnumType {
+		return build.qualify(t.Name()), nil
+	}
+	switch t {
+	case timeType:
+		return GoDataDateTimeOffset, nil
+	case dateValueType:
+		return GoDataDate, nil
+	case timeOfDayValueType:
+		return GoDataTimeOfDay, nil
+	case durationType:
+		return GoDataDuration, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if t.Kind() == reflect.Array && t.Len() == 16 {
+				return GoDataGuid, nil
+			}
+			return GoDataBinary, nil
+		}
+		elem := t.Elem()
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		itemType, err := build.propertyType(elem)
+		if err != nil {
+			return "", err
+		}
+		return "Collection(" + itemType + ")", nil
+	}
+
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return GoDataString, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return GoDataString, nil
+	case reflect.Bool:
+		return GoDataBoolean, nil
+	case reflect.Int8:
+		return GoDataSByte, nil
+	case reflect.Uint8:
+		return GoDataByte, nil
+	case reflect.Int16:
+		return GoDataInt16, nil
+	case reflect.Uint16, reflect.Int32:
+		return GoDataInt32, nil
+	case reflect.Uint32, reflect.Int, reflect.Int64:
+		return GoDataInt64, nil
+	case reflect.Uint, reflect.Uint64:
+		return GoDataDecimal, nil
+	case reflect.Float32:
+		return GoDataSingle, nil
+	case reflect.Float64:
+		return GoDataDouble, nil
+	case reflect.Struct:
+		if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+			break
+		}
+		return build.expose(t, modelComplexType, nil)
+	}
+	return "", errors.New("the Edm type of " + t.String() + " is not known; give it with the type option")
+}
+
+func (build *modelBuild) buildNavigationProperty(owner reflect.Type, field *structProperty, t reflect.Type) (
+	*GoDataNavigationProperty, error) {
+
+	nullable := false
+	collection := false
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+		collection = true
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("Navigation property " + field.name + " of " + owner.String() +
+			" does not refer to a struct")
+	}
+
+	typeName, err := build.expose(t, modelEntityType, nil)
+	if err != nil {
+		return nil, err
+	}
+	nav := &GoDataNavigationProperty{Name: field.name, Type: typeName, Partner: field.options["partner"]}
+	if collection {
+		// collections are never null
+		nav.Type = "Collection(" + typeName + ")"
+	} else {
+		nav.Nullable = modelNullable(nullable, field.options)
+	}
+	return nav, nil
+}
+
+// Get the Nullable attribute of a property, which is nullable if it has a
+// pointer type, unless the odata tag of its field says otherwise.
+func modelNullable(nullable bool, options map[string]string) string {
+	if hasTagOption(options, "required") {
+		nullable = false
+	} else if hasTagOption(options, "nullable") {
+		nullable = true
+	}
+	if nullable {
+		// the default
+		return ""
+	}
+	return "false"
+}
+
+func enumUnderlyingType(t reflect.Type) (string, error) {
+	switch t.Kind() {
+	case reflect.Int8:
+		return GoDataSByte, nil
+	case reflect.Uint8:
+		return GoDataByte, nil
+	case reflect.Int16:
+		return GoDataInt16, nil
+	case reflect.Uint16, reflect.Int32, reflect.String:
+		// Edm.Int32 is the default
+		return "", nil
+	case reflect.Uint32, reflect.Int, reflect.Int64:
+		return GoDataInt64, nil
+	}
+	return "", errors.New("Cannot expose " + t.String() + " as an enum type; it is not an integer or string type")
+}
+
+// Get the qualified name of the type of the items of a collection type, or
+// the type itself if it is not a collection.
+func modelItemType(typeName string) string {
+	if strings.HasPrefix(typeName, "Collection(") && strings.HasSuffix(typeName, ")") {
+		return typeName[len("Collection(") : len(typeName)-1]
+	}
+	return typeName
+}
+
+// Check the partners given in odata tags, and partner the remaining
+// navigation properties that refer to each other without ambiguity.
+func (build *modelBuild) partnerNavigationProperties() error {
+	for _, a := range build.navigation {
+		if a.nav.Partner == "" {
+			continue
+		}
+		target := build.entities[modelItemType(a.nav.Type)]
+		var partner *GoDataNavigationProperty
+		for _, nav := range target.NavigationProperties {
+			if nav.Name == a.nav.Partner {
+				partner = nav
+			}
+		}
+		if partner == nil {
+			return errors.New("Partner " + a.nav.Partner + " of navigation property " + a.nav.Name +
+				" is not a navigation property of " + target.Name)
+		}
+		if modelItemType(partner.Type) != a.owner || (partner.Partner != "" && partner.Partner != a.nav.Name) {
+			return errors.New("Partner " + a.nav.Partner + " of navigation property " + a.nav.Name +
+				" does not refer back to it")
+		}
+	}
+
+	for _, a := range build.navigation {
+		if a.nav.Partner != "" {
+			continue
+		}
+		candidates := build.partnerCandidates(a)
+		if len(candidates) != 1 {
+			continue
+		}
+		b := candidates[0]
+		if back := build.partnerCandidates(b); len(back) != 1 || back[0] != a {
+			// b could be the partner of another navigation property
+			continue
+		}
+		a.nav.Partner = b.nav.Name
+		b.nav.Partner = a.nav.Name
+	}
+	return nil
+}
+
+// Get the navigation properties that could be the partner of a navigation
+// property. One that names it as its partner is the only candidate.
+func (build *modelBuild) partnerCandidates(a *modelNavigation) []*modelNavigation {
+	candidates := []*modelNavigation{}
+	for _, b := range build.navigation {
+		if b == a || b.owner != modelItemType(a.nav.Type) || modelItemType(b.nav.Type) != a.owner {
+			continue
+		}
+		if b.nav.Partner == a.nav.Name {
+			return []*modelNavigation{b}
+		}
+		if b.nav.Partner == "" && (a.nav.Partner == "" || a.nav.Partner == b.nav.Name) {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates
+}
+
+// Build the entity container, binding the navigation properties of each
+// entity set to the entity set of their target type, if there is exactly one.
+func (build *modelBuild) buildContainer() (*GoDataEntityContainer, error) {
+	container := &GoDataEntityContainer{Name: build.builder.ContainerName}
+	setsByType := map[string][]string{}
+	names := map[string]bool{}
+	for _, set := range build.builder.entitySets {
+		if names[set.name] {
+			return nil, errors.New("Entity set " + set.name + " is exposed more than once")
+		}
+		names[set.name] = true
+		typeName := build.qualify(set.goType.Name())
+		setsByType[typeName] = append(setsByType[typeName], set.name)
+		container.EntitySets = append(container.EntitySets, &GoDataEntitySet{Name: set.name, EntityType: typeName})
+	}
+
+	for _, set := range container.EntitySets {
+		for _, nav := range build.entities[set.EntityType].NavigationProperties {
+			targets := setsByType[modelItemType(nav.Type)]
+			if len(targets) == 1 {
+				set.NavigationPropertyBindings = append(set.NavigationPropertyBindings,
+					&GoDataNavigationPropertyBinding{Path: nav.Name, Target: targets[0]})
+			}
+		}
+	}
+	return container, nil
+}
@@ -0,0 +1,299 @@
+package godata
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type modelStatus int
+
+type modelAddress struct {
+	Street string `odata:",maxlength=100"`
+	City   *string
+}
+
+type modelCustomer struct {
+	Name    string `odata:",key,maxlength=50"`
+	Age     int32
+	Email   *string `odata:",required"`
+	Address modelAddress
+	Joined  time.Time
+	Tags    []string
+	Orders  []*modelOrder `odata:",navigation"`
+	ETag    string        `odata:"@odata.etag"`
+	Secret  string        `odata:"-"`
+}
+
+type modelOrder struct {
+	Id       [16]byte `odata:",key"`
+	Total    float64  `odata:",type=Edm.Decimal,precision=10,scale=2"`
+	Status   modelStatus
+	Lines    []modelLine    `odata:",navigation"`
+	Customer *modelCustomer `odata:",navigation"`
+}
+
+// An entity type that is only reached through a navigation property, with a
+// navigation property that has no partner.
+type modelLine struct {
+	Number  int64         `odata:",key"`
+	Product *modelProduct `odata:",navigation"`
+}
+
+type modelProduct struct {
+	Code string `odata:",key"`
+}
+
+type ModelProvider struct {
+	DummyProvider
+	metadata *GoDataMetadata
+}
+
+func (p *ModelProvider) GetMetadata() *GoDataMetadata {
+	return p.metadata
+}
+
+func buildTestModel() (*GoDataMetadata, error) {
+	return NewModelBuilder("Shop").
+		ExposeEntitySet("Customers", modelCustomer{}).
+		ExposeEntitySet("Orders", &modelOrder{}).
+		ExposeEntitySet("Products", modelProduct{}).
+		ExposeEnumType(modelStatus(0),
+			&GoDataMember{Name: "Open", Value: "0"},
+			&GoDataMember{Name: "Shipped", Value: "1"}).
+		BuildMetadata()
+}
+
+func TestModelBuilder(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	schema := metadata.DataServices.Schemas[0]
+	if schema.Namespace != "Shop" || metadata.Version != "4.0" {
+		t.Errorf("Unexpected namespace %s or version %s", schema.Namespace, metadata.Version)
+	}
+
+	entities := map[string]*GoDataEntityType{}
+	names := []string{}
+	for _, entity := range schema.EntityTypes {
+		entities[entity.Name] = entity
+		names = append(names, entity.Name)
+	}
+	expectedNames := []string{"modelCustomer", "modelOrder", "modelProduct", "modelLine"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Expected entity types %v, got %v", expectedNames, names)
+		return
+	}
+
+	customer := entities["modelCustomer"]
+	if len(customer.Key.PropertyRefs) != 1 || customer.Key.PropertyRefs[0].Name != "Name" {
+		t.Errorf("Unexpected key %v", entityKeyNames(customer))
+	}
+	expectedProps := []GoDataProperty{
+		{Name: "Name", Type: "Edm.String", Nullable: "false", MaxLength: 50},
+		{Name: "Age", Type: "Edm.Int32", Nullable: "false"},
+		{Name: "Email", Type: "Edm.String", Nullable: "false"},
+		{Name: "Address", Type: "Shop.modelAddress", Nullable: "false"},
+		{Name: "Joined", Type: "Edm.DateTimeOffset", Nullable: "false"},
+		{Name: "Tags", Type: "Collection(Edm.String)", Nullable: "false"},
+	}
+	if len(customer.Properties) != len(expectedProps) {
+		t.Errorf("Expected %d properties, got %d", len(expectedProps), len(customer.Properties))
+		return
+	}
+	for i, prop := range customer.Properties {
+		if *prop != expectedProps[i] {
+			t.Errorf("Expected property %+v, got %+v", expectedProps[i], *prop)
+		}
+	}
+
+	order := entities["modelOrder"]
+	if order.Properties[0].Type != "Edm.Guid" || order.Properties[2].Type != "Shop.modelStatus" {
+		t.Errorf("Unexpected order properties %+v, %+v", *order.Properties[0], *order.Properties[2])
+	}
+	total := order.Properties[1]
+	if total.Type != "Edm.Decimal" || total.Precision != 10 || total.Scale != 2 {
+		t.Errorf("Unexpected total property %+v", *total)
+	}
+
+	address := schema.ComplexTypes[0]
+	if address.Name != "modelAddress" || address.Properties[0].MaxLength != 100 ||
+		address.Properties[1].Nullable != "" {
+		t.Errorf("Unexpected complex type %+v", *address)
+	}
+	status := schema.EnumTypes[0]
+	if status.Name != "modelStatus" || status.UnderlyingType != "Edm.Int64" || len(status.Members) != 2 {
+		t.Errorf("Unexpected enum type %+v", *status)
+	}
+
+	// partners are found in both directions, but not for Lines and Product,
+	// which do not refer back
+	navTests := []struct {
+		nav     *GoDataNavigationProperty
+		typ     string
+		partner string
+	}{
+		{customer.NavigationProperties[0], "Collection(Shop.modelOrder)", "Customer"},
+		{order.NavigationProperties[0], "Collection(Shop.modelLine)", ""},
+		{order.NavigationProperties[1], "Shop.modelCustomer", "Orders"},
+		{entities["modelLine"].NavigationProperties[0], "Shop.modelProduct", ""},
+	}
+	for _, test := range navTests {
+		if test.nav.Type != test.typ || test.nav.Partner != test.partner {
+			t.Errorf("Expected %s to have type %s and partner %q, got %s and %q",
+				test.nav.Name, test.typ, test.partner, test.nav.Type, test.nav.Partner)
+		}
+	}
+
+	container := schema.EntityContainers[0]
+	if container.Name != "Container" || len(container.EntitySets) != 3 {
+		t.Errorf("Unexpected container %+v", *container)
+		return
+	}
+	bindings := container.EntitySets[1].NavigationPropertyBindings
+	if len(bindings) != 1 || bindings[0].Path != "Customer" || bindings[0].Target != "Customers" {
+		t.Errorf("Expected Orders to bind Customer only, got %d bindings", len(bindings))
+	}
+}
+
+func TestModelBuilderService(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service, err := BuildService(&ModelProvider{metadata: metadata}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the request passes semantic checks, and reaches the provider
+	status, _ := serveError(t, service, "/Orders?$filter=Total%20gt%2010&$expand=Customer($select=Name)")
+	if status != 501 {
+		t.Errorf("Expected status 501, got %d", status)
+	}
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/$metadata", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `<Property Name="Name" Type="Edm.String" Nullable="false" MaxLength="50"></Property>`) {
+		t.Errorf("Unexpected metadata response %d %s", w.Code, w.Body.String())
+	}
+}
+
+type modelAmbiguousUser struct {
+	Id   string               `odata:",key"`
+	Sent []modelAmbiguousMail `odata:",navigation"`
+}
+
+type modelAmbiguousMail struct {
+	Id        string              `odata:",key"`
+	Sender    *modelAmbiguousUser `odata:",navigation"`
+	Recipient *modelAmbiguousUser `odata:",navigation"`
+}
+
+type modelExplicitUser struct {
+	Id   string              `odata:",key"`
+	Sent []modelExplicitMail `odata:",navigation"`
+}
+
+type modelExplicitMail struct {
+	Id        string             `odata:",key"`
+	Sender    *modelExplicitUser `odata:",navigation,partner=Sent"`
+	Recipient *modelExplicitUser `odata:",navigation"`
+}
+
+func TestModelBuilderPartners(t *testing.T) {
+	metadata, err := NewModelBuilder("Mail").ExposeEntityType(modelAmbiguousMail{}).BuildMetadata()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, entity := range metadata.DataServices.Schemas[0].EntityTypes {
+		for _, nav := range entity.NavigationProperties {
+			if nav.Partner != "" {
+				t.Errorf("Expected ambiguous %s to have no partner, got %s", nav.Name, nav.Partner)
+			}
+		}
+	}
+
+	// Sent is partnered with Sender, the only one that names it
+	metadata, err = NewModelBuilder("Mail").ExposeEntityType(modelExplicitMail{}).BuildMetadata()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	user := metadata.DataServices.Schemas[0].EntityTypes[1]
+	if user.NavigationProperties[0].Partner != "Sender" {
+		t.Errorf("Expected Sent to be partnered with Sender, got %q", user.NavigationProperties[0].Partner)
+	}
+}
+
+type modelNoKey struct {
+	Name string
+}
+
+type modelBadPartner struct {
+	Id    string       `odata:",key"`
+	Other *modelNoKey2 `odata:",navigation,partner=Missing"`
+}
+
+type modelNoKey2 struct {
+	Id string `odata:",key"`
+}
+
+type modelMap struct {
+	Id    string `odata:",key"`
+	Extra map[string]string
+}
+
+type modelLineKey struct {
+	Order string `odata:",key"`
+	Line  int    `odata:",key"`
+}
+
+type modelMisused struct {
+	Id      string `odata:",key"`
+	Product modelProduct
+}
+
+func TestModelBuilderCompositeKey(t *testing.T) {
+	metadata, err := NewModelBuilder("A").ExposeEntitySet("Lines", modelLineKey{}).BuildMetadata()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	entity := metadata.DataServices.Schemas[0].EntityTypes[0]
+	if keys := entityKeyNames(entity); strings.Join(keys, ",") != "Order,Line" {
+		t.Errorf("Unexpected key %v", keys)
+	}
+}
+
+func TestModelBuilderErrors(t *testing.T) {
+	testCases := []struct {
+		builder *GoDataModelBuilder
+		message string
+	}{
+		{NewModelBuilder("A").ExposeEntityType(modelNoKey{}), "has no key"},
+		{NewModelBuilder("A").ExposeEntityType(modelBadPartner{}), "is not a navigation property"},
+		{NewModelBuilder("A").ExposeEntityType(modelMap{}), "type option"},
+		{NewModelBuilder("A").ExposeEntityType(modelProduct{}).ExposeEntityType(modelMisused{}),
+			"cannot be both"},
+		{NewModelBuilder("A").ExposeEntityType(nil), "nil value"},
+		{NewModelBuilder("A").ExposeEntityType("text"), "not a struct"},
+		{NewModelBuilder("A").ExposeEnumType(modelStatus(0)), "no members"},
+		{NewModelBuilder("A").ExposeEnumType(1.5, &GoDataMember{Name: "X"}), "not an integer"},
+		{NewModelBuilder("A").ExposeEntitySet("Xs", modelProduct{}).ExposeEntitySet("Xs", modelProduct{}),
+			"more than once"},
+	}
+	for _, testCase := range testCases {
+		_, err := testCase.builder.BuildMetadata()
+		if err == nil || !strings.Contains(err.Error(), testCase.message) {
+			t.Errorf("Expected an error containing %q, got %v", testCase.message, err)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Get the metadata as a CSDL JSON document, as defined by OData 4.01. Facets
+// whose defaults differ between CSDL XML and CSDL JSON, such as Nullable, are
+// written so that both documents describe the same model. The annotations of
+// the model have no values, which CSDL JSON only allows for Boolean terms, so
+// only annotations with a Boolean term are written, and the others are left
+// out. A term is known to be Boolean if it is a tag of the Core vocabulary,
+// or if it is defined by the model or a loaded reference.
+func (t *GoDataMetadata) JSON() ([]byte, error) {
+	version := t.Version
+	if version == "" {
+		version = odataVersion
+	}
+	doc := newCsdlObject()
+	doc.set("$Version", version)
+	tags := csdlBooleanTerms(t)
+
+	if t.DataServices != nil {
+		for _, schema := range t.DataServices.Schemas {
+			if len(schema.EntityContainers) > 0 {
+				doc.set("$EntityContainer", schema.Namespace+"."+schema.EntityContainers[0].Name)
+				break
+			}
+		}
+	}
+
+	if len(t.References) > 0 {
+		references := newCsdlObject()
+		for _, reference := range t.References {
+			references.set(reference.Uri, csdlReference(reference))
+		}
+		doc.set("$Reference", references)
+	}
+
+	if t.DataServices != nil {
+		for _, schema := range t.DataServices.Schemas {
+			value, err := csdlSchema(schema, tags)
+			if err != nil {
+				return nil, err
+			}
+			doc.set(schema.Namespace, value)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeJsonValue(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Create an empty JSON object whose members are written in the order they are
+// set.
+func newCsdlObject() *orderedJsonObject {
+	return &orderedJsonObject{fields: map[string]*GoDataResponseField{}}
+}
+
+func (o *orderedJsonObject) set(name string, value interface{}) {
+	if _, ok := o.fields[name]; !ok {
+		o.order = append(o.order, name)
+	}
+	o.fields[name] = &GoDataResponseField{Value: value}
+}
+
+// Set a boolean member if a CSDL XML attribute is true, as false is the
+// default of every boolean member it is used for.
+func (o *orderedJsonObject) setTrue(name string, attribute string) {
+	if attribute == "true" {
+		o.set(name, true)
+	}
+}
+
+func (o *orderedJsonObject) setString(name string, value string) {
+	if value != "" {
+		o.set(name, value)
+	}
+}
+
+// Set the annotations whose terms are in the given set of Boolean terms. An
+// annotation without a value applies a Boolean term, i.e. it is true.
+func (o *orderedJsonObject) setAnnotations(annotations []*GoDataAnnotation, qualifier string, tags map[string]bool) {
+	for _, annotation := range annotations {
+		if !tags[annotation.Term] {
+			// the value of any other term cannot be left out
+			continue
+		}
+		name := "@" + annotation.Term
+		if annotation.Qualifier != "" {
+			name += "#" + annotation.Qualifier
+		} else if qualifier != "" {
+			name += "#" + qualifier
+		}
+		o.set(name, true)
+	}
+}
+
+// The terms of the Core vocabulary whose type is Core.Tag, a Boolean that is
+// true unless given otherwise.
+var coreTagTerms = []string{
+	"AutoExpand",
+	"AutoExpandReferences",
+	"Computed",
+	"ComputedDefaultValue",
+	"ConventionalIDs",
+	"DereferenceableIDs",
+	"Immutable",
+	"IsLanguageDependent",
+	"IsMediaType",
+	"IsURL",
+	"Ordered",
+	"PositionalInsert",
+	"RequiresExplicitBinding",
+}
+
+const coreNamespace = "Org.OData.Core.V1"
+
+// Collect the qualified names of the Boolean terms of a model, by namespace
+// and by alias: the tags of the Core vocabulary, and the Boolean terms defined
+// by the model and any loaded references.
+func csdlBooleanTerms(metadata *GoDataMetadata) map[string]bool {
+	tags := map[string]bool{}
+	addSchemas := func(schemas []*GoDataSchema, aliases map[string]string) {
+		for _, schema := range schemas {
+			prefixes := []string{schema.Namespace}
+			if schema.Alias != "" {
+				prefixes = append(prefixes, schema.Alias)
+			}
+			if alias := aliases[schema.Namespace]; alias != "" {
+				prefixes = append(prefixes, alias)
+			}
+			for _, term := range schema.Terms {
+				if term.Type != GoDataBoolean && term.Type != "Core.Tag" && term.Type != coreNamespace+".Tag" {
+					continue
+				}
+				for _, prefix := range prefixes {
+					tags[prefix+"."+term.Name] = true
+				}
+			}
+		}
+	}
+
+	corePrefixes := []string{coreNamespace, "Core"}
+	for _, reference := range metadata.References {
+		aliases := map[string]string{}
+		for _, include := range reference.Includes {
+			aliases[include.Namespace] = include.Alias
+			if include.Namespace == coreNamespace && include.Alias != "" {
+				corePrefixes = append(corePrefixes, include.Alias)
+			}
+		}
+		if reference.Document != nil && reference.Document.DataServices != nil {
+			addSchemas(reference.Document.DataServices.Schemas, aliases)
+		}
+	}
+	for _, prefix := range corePrefixes {
+		for _, term := range coreTagTerms {
+			tags[prefix+"."+term] = true
+		}
+	}
+	if metadata.DataServices != nil {
+		addSchemas(metadata.DataServices.Schemas, nil)
+	}
+	return tags
+}
+
+// Set the $Type and $Collection members for a type name such as
+// Collection(Edm.String). Edm.String is the default type.
+func (o *orderedJsonObject) setType(typeName string) {
+	if itemType := modelItemType(typeName); itemType != typeName {
+		o.set("$Collection", true)
+		typeName = itemType
+	}
+	if typeName != GoDataString {
+		o.set("$Type", typeName)
+	}
+}
+
+// Set the $Nullable member. Values are nullable unless CSDL XML says
+// otherwise, while CSDL JSON assumes they are not.
+func (o *orderedJsonObject) setNullable(nullable string) {
+	if nullable != "false" {
+		o.set("$Nullable", true)
+	}
+}
+
+func (o *orderedJsonObject) setFacets(maxLength, precision, scale int, srid string) {
+	if maxLength > 0 {
+		o.set("$MaxLength", maxLength)
+	}
+	if precision > 0 {
+		o.set("$Precision", precision)
+	}
+	if scale > 0 {
+		o.set("$Scale", scale)
+	}
+	if srid != "" {
+		if n, err := strconv.Atoi(srid); err == nil {
+			o.set("$SRID", n)
+		} else {
+			// e.g. variable
+			o.set("$SRID", srid)
+		}
+	}
+}
+
+func csdlReference(reference *GoDataReference) *orderedJsonObject {
+	value := newCsdlObject()
+	if len(reference.Includes) > 0 {
+		includes := []*GoDataResponseField{}
+		for _, include := range reference.Includes {
+			item := newCsdlObject()
+			item.set("$Namespace", include.Namespace)
+			item.setString("$Alias", include.Alias)
+			includes = append(includes, &GoDataResponseField{Value: item})
+		}
+		value.set("$Include", includes)
+	}
+	if len(reference.IncludeAnnotations) > 0 {
+		includes := []*GoDataResponseField{}
+		for _, include := range reference.IncludeAnnotations {
+			item := newCsdlObject()
+			item.set("$TermNamespace", include.TermNamespace)
+			item.setString("$Qualifier", include.Qualifier)
+			item.setString("$TargetNamespace", include.TargetNamespace)
+			includes = append(includes, &GoDataResponseField{Value: item})
+		}
+		value.set("$IncludeAnnotations", includes)
+	}
+	return value
+}
+
+func csdlSchema(schema *GoDataSchema, tags map[string]bool) (*orderedJsonObject, error) {
+	value := newCsdlObject()
+	value.setString("$Alias", schema.Alias)
+	value.setAnnotations(schema.Annotation, "", tags)
+
+	for _, entity := range schema.EntityTypes {
+		item := newCsdlObject()
+		item.set("$Kind", "EntityType")
+		item.setString("$BaseType", entity.BaseType)
+		item.setTrue("$Abstract", entity.Abstract)
+		item.setTrue("$OpenType", entity.OpenType)
+		item.setTrue("$HasStream", entity.HasStream)
+		if keys := entityKeyNames(entity); len(keys) > 0 {
+			refs := make([]*GoDataResponseField, len(keys))
+			for i, key := range keys {
+				refs[i] = &GoDataResponseField{Value: key}
+			}
+			item.set("$Key", refs)
+		}
+		item.setProperties(entity.Properties, entity.NavigationProperties)
+		value.set(entity.Name, item)
+	}
+	for _, complex := range schema.ComplexTypes {
+		item := newCsdlObject()
+		item.set("$Kind", "ComplexType")
+		item.setString("$BaseType", complex.BaseType)
+		item.setTrue("$Abstract", complex.Abstract)
+		item.setTrue("$OpenType", complex.OpenType)
+		item.setProperties(complex.Properties, complex.NavigationProperties)
+		value.set(complex.Name, item)
+	}
+	for _, enum := range schema.EnumTypes {
+		item, err := csdlEnumType(enum)
+		if err != nil {
+			return nil, err
+		}
+		value.set(enum.Name, item)
+	}
+	for _, definition := range schema.TypeDefinitions {
+		item := newCsdlObject()
+		item.set("$Kind", "TypeDefinition")
+		item.set("$UnderlyingType", definition.UnderlyingType)
+		item.setAnnotations(definition.Annotations, "", tags)
+		value.set(definition.Name, item)
+	}
+	for _, term := range schema.Terms {
+		item := newCsdlObject()
+		item.set("$Kind", "Term")
+		item.setType(term.Type)
+		item.setNullable("")
+		item.setString("$BaseTerm", term.BaseTerm)
+		if term.DefaultValue != "" {
+			item.set("$DefaultValue", csdlDefaultValue(term.Type, term.DefaultValue))
+		}
+		if term.AppliesTo != "" {
+			appliesTo := []*GoDataResponseField{}
+			for _, target := range strings.Fields(term.AppliesTo) {
+				appliesTo = append(appliesTo, &GoDataResponseField{Value: target})
+			}
+			item.set("$AppliesTo", appliesTo)
+		}
+		value.set(term.Name, item)
+	}
+
+	// actions and functions are arrays of overloads
+	overloads := map[string][]*GoDataResponseField{}
+	addOverload := func(name string, item *orderedJsonObject) {
+		overloads[name] = append(overloads[name], &GoDataResponseField{Value: item})
+		value.set(name, overloads[name])
+	}
+	for _, action := range schema.Actions {
+		item := csdlOperation("Action", action.IsBound, action.EntitySetPath, action.Parameters, action.ReturnType)
+		addOverload(action.Name, item)
+	}
+	for _, function := range schema.Functions {
+		item := csdlOperation("Function", function.IsBound, function.EntitySetPath, function.Parameters,
+			function.ReturnType)
+		item.setTrue("$IsComposable", function.IsComposable)
+		addOverload(function.Name, item)
+	}
+
+	for _, container := range schema.EntityContainers {
+		value.set(container.Name, csdlEntityContainer(container))
+	}
+
+	if len(schema.Annotations) > 0 {
+		targets := newCsdlObject()
+		for _, annotations := range schema.Annotations {
+			// several groups of annotations may share a target
+			if _, ok := targets.fields[annotations.Target]; !ok {
+				targets.set(annotations.Target, newCsdlObject())
+			}
+			target := targets.fields[annotations.Target].Value.(*orderedJsonObject)
+			target.setAnnotations(annotations.Annotations, annotations.Qualifier, tags)
+		}
+		// leave out targets whose annotations were all left out
+		written := newCsdlObject()
+		for _, name := range targets.order {
+			if target := targets.fields[name].Value.(*orderedJsonObject); len(target.order) > 0 {
+				written.set(name, target)
+			}
+		}
+		if len(written.order) > 0 {
+			value.set("$Annotations", written)
+		}
+	}
+	return value, nil
+}
+
+// Set the structural and navigation properties of an entity or complex type.
+func (o *orderedJsonObject) setProperties(properties []*GoDataProperty,
+	navProperties []*GoDataNavigationProperty) {
+
+	for _, prop := range properties {
+		item := newCsdlObject()
+		item.setType(prop.Type)
+		item.setNullable(prop.Nullable)
+		item.setFacets(prop.MaxLength, prop.Precision, prop.Scale, prop.SRID)
+		if prop.Unicode == "false" {
+			item.set("$Unicode", false)
+		}
+		if prop.DefaultValue != "" {
+			item.set("$DefaultValue", csdlDefaultValue(prop.Type, prop.DefaultValue))
+		}
+		o.set(prop.Name, item)
+	}
+
+	for _, nav := range navProperties {
+		item := newCsdlObject()
+		item.set("$Kind", "NavigationProperty")
+		item.setType(nav.Type)
+		if modelItemType(nav.Type) == nav.Type {
+			// collections of entities never contain nulls
+			item.setNullable(nav.Nullable)
+		}
+		item.setString("$Partner", nav.Partner)
+		item.setTrue("$ContainsTarget", nav.ContainsTarget)
+		if len(nav.ReferentialConstraints) > 0 {
+			constraints := newCsdlObject()
+			for _, constraint := range nav.ReferentialConstraints {
+				constraints.set(constraint.Property, constraint.ReferencedProperty)
+				if constraint.OnDelete != nil {
+					item.set("$OnDelete", constraint.OnDelete.Action)
+				}
+			}
+			item.set("$ReferentialConstraint", constraints)
+		}
+		o.set(nav.Name, item)
+	}
+}
+
+func csdlEnumType(enum *GoDataEnumType) (*orderedJsonObject, error) {
+	value := newCsdlObject()
+	value.set("$Kind", "EnumType")
+	value.setString("$UnderlyingType", enum.UnderlyingType)
+	value.setTrue("$IsFlags", enum.IsFlags)
+	for i, member := range enum.Members {
+		if member.Value == "" {
+			// members without values are numbered in order, as in CSDL XML
+			value.set(member.Name, i)
+			continue
+		}
+		n, err := strconv.ParseInt(member.Value, 10, 64)
+		if err != nil {
+			return nil, InternalServerError("Member " + member.Name + " of enum type " + enum.Name +
+				" has an invalid value: " + member.Value)
+		}
+		value.set(member.Name, n)
+	}
+	return value, nil
+}
+
+func csdlOperation(kind, isBound, entitySetPath string, parameters []*GoDataParameter,
+	returnType *GoDataReturnType) *orderedJsonObject {
+
+	value := newCsdlObject()
+	value.set("$Kind", kind)
+	value.setTrue("$IsBound", isBound)
+	value.setString("$EntitySetPath", entitySetPath)
+	if len(parameters) > 0 {
+		items := []*GoDataResponseField{}
+		for _, parameter := range parameters {
+			item := newCsdlObject()
+			item.set("$Name", parameter.Name)
+			item.setType(parameter.Type)
+			item.setNullable(parameter.Nullable)
+			item.setFacets(parameter.MaxLength, parameter.Precision, parameter.Scale, parameter.SRID)
+			items = append(items, &GoDataResponseField{Value: item})
+		}
+		value.set("$Parameter", items)
+	}
+	if returnType != nil {
+		item := newCsdlObject()
+		item.setType(returnType.Type)
+		item.setNullable(returnType.Nullable)
+		item.setFacets(returnType.MaxLength, returnType.Precision, returnType.Scale, returnType.SRID)
+		value.set("$ReturnType", item)
+	}
+	return value
+}
+
+func csdlEntityContainer(container *GoDataEntityContainer) *orderedJsonObject {
+	value := newCsdlObject()
+	value.set("$Kind", "EntityContainer")
+	value.setString("$Extends", container.Extends)
+
+	bindings := func(bindings []*GoDataNavigationPropertyBinding) *orderedJsonObject {
+		value := newCsdlObject()
+		for _, binding := range bindings {
+			value.set(binding.Path, binding.Target)
+		}
+		return value
+	}
+	for _, set := range container.EntitySets {
+		item := newCsdlObject()
+		item.set("$Collection", true)
+		item.set("$Type", set.EntityType)
+		if set.IncludeInServiceDocument == "false" {
+			item.set("$IncludeInServiceDocument", false)
+		}
+		if len(set.NavigationPropertyBindings) > 0 {
+			item.set("$NavigationPropertyBinding", bindings(set.NavigationPropertyBindings))
+		}
+		value.set(set.Name, item)
+	}
+	for _, singleton := range container.Singletons {
+		item := newCsdlObject()
+		item.set("$Type", singleton.Type)
+		if len(singleton.NavigationPropertyBindings) > 0 {
+			item.set("$NavigationPropertyBinding", bindings(singleton.NavigationPropertyBindings))
+		}
+		value.set(singleton.Name, item)
+	}
+	for _, actionImport := range container.ActionImports {
+		item := newCsdlObject()
+		item.set("$Action", actionImport.Action)
+		item.setString("$EntitySet", actionImport.EntitySet)
+		value.set(actionImport.Name, item)
+	}
+	for _, functionImport := range container.FunctionImports {
+		item := newCsdlObject()
+		item.set("$Function", functionImport.Function)
+		item.setString("$EntitySet", functionImport.EntitySet)
+		item.setTrue("$IncludeInServiceDocument", functionImport.IncludeInServiceDocument)
+		value.set(functionImport.Name, item)
+	}
+	return value
+}
+
+// Convert a default value from CSDL XML, where it is always a string, to the
+// JSON value of its type.
+func csdlDefaultValue(typeName string, value string) interface{} {
+	switch typeName {
+	case GoDataBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case GoDataByte, GoDataSByte, GoDataInt16, GoDataInt32, GoDataInt64, GoDataDecimal, GoDataSingle,
+		GoDataDouble:
+		if _, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,320 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetadataJson(t *testing.T) {
+	metadata := &GoDataMetadata{
+		Version: "4.0",
+		References: []*GoDataReference{
+			{
+				Uri:      "https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml",
+				Includes: []*GoDataInclude{{Namespace: "Org.OData.Core.V1", Alias: "Core"}},
+			},
+		},
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{
+				{
+					Namespace: "Shop",
+					EntityTypes: []*GoDataEntityType{
+						{
+							Name: "Customer",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Id"}}},
+							Properties: []*GoDataProperty{
+								{Name: "Id", Type: GoDataInt32, Nullable: "false"},
+								{Name: "Name", Type: GoDataString, MaxLength: 50},
+								{Name: "Tags", Type: "Collection(Edm.String)", Nullable: "false"},
+								{Name: "Active", Type: GoDataBoolean, Nullable: "false", DefaultValue: "true"},
+								{Name: "Address", Type: "Shop.Address"},
+							},
+							NavigationProperties: []*GoDataNavigationProperty{
+								{Name: "Orders", Type: "Collection(Shop.Order)", Partner: "Customer"},
+							},
+						},
+						{
+							Name:     "Order",
+							Key:      &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Id"}}},
+							OpenType: "true",
+							Properties: []*GoDataProperty{
+								{Name: "Id", Type: GoDataGuid, Nullable: "false"},
+								{Name: "CustomerId", Type: GoDataInt32, Nullable: "false"},
+								{Name: "Total", Type: GoDataDecimal, Precision: 10, Scale: 2, DefaultValue: "0"},
+								{Name: "Status", Type: "Shop.Status", Nullable: "false"},
+							},
+							NavigationProperties: []*GoDataNavigationProperty{
+								{
+									Name: "Customer", Type: "Shop.Customer", Nullable: "false", Partner: "Orders",
+									ReferentialConstraints: []*GoDataReferentialConstraint{
+										{Property: "CustomerId", ReferencedProperty: "Id",
+											OnDelete: &GoDataOnDelete{Action: "Cascade"}},
+									},
+								},
+							},
+						},
+					},
+					ComplexTypes: []*GoDataComplexType{
+						{
+							Name:       "Address",
+							Properties: []*GoDataProperty{{Name: "City", Type: GoDataString}},
+						},
+					},
+					EnumTypes: []*GoDataEnumType{
+						{
+							Name:           "Status",
+							UnderlyingType: GoDataByte,
+							Members:        []*GoDataMember{{Name: "Open"}, {Name: "Shipped", Value: "4"}},
+						},
+					},
+					TypeDefinitions: []*GoDataTypeDefinition{
+						{
+							Name:           "Code",
+							UnderlyingType: GoDataString,
+							Annotations:    []*GoDataAnnotation{{Term: "Core.IsLanguageDependent"}},
+						},
+					},
+					Terms: []*GoDataTerm{
+						{Name: "Audited", Type: GoDataBoolean, DefaultValue: "true", AppliesTo: "EntityType Property"},
+					},
+					Actions: []*GoDataAction{
+						{
+							Name:    "Ship",
+							IsBound: "true",
+							Parameters: []*GoDataParameter{
+								{Name: "order", Type: "Shop.Order", Nullable: "false"},
+							},
+						},
+						{
+							Name:    "Ship",
+							IsBound: "true",
+							Parameters: []*GoDataParameter{
+								{Name: "orders", Type: "Collection(Shop.Order)", Nullable: "false"},
+							},
+						},
+					},
+					Functions: []*GoDataFunction{
+						{
+							Name:       "TopCustomers",
+							ReturnType: &GoDataReturnType{Type: "Collection(Shop.Customer)", Nullable: "false"},
+						},
+					},
+					EntityContainers: []*GoDataEntityContainer{
+						{
+							Name: "Container",
+							EntitySets: []*GoDataEntitySet{
+								{
+									Name:       "Customers",
+									EntityType: "Shop.Customer",
+									NavigationPropertyBindings: []*GoDataNavigationPropertyBinding{
+										{Path: "Orders", Target: "Orders"},
+									},
+								},
+								{Name: "Orders", EntityType: "Shop.Order", IncludeInServiceDocument: "false"},
+							},
+							Singletons:    []*GoDataSingleton{{Name: "Owner", Type: "Shop.Customer"}},
+							ActionImports: []*GoDataActionImport{{Name: "ShipAll", Action: "Shop.Ship"}},
+							FunctionImports: []*GoDataFunctionImport{
+								{Name: "TopCustomers", Function: "Shop.TopCustomers", EntitySet: "Customers",
+									IncludeInServiceDocument: "true"},
+							},
+						},
+					},
+					Annotations: []*GoDataAnnotations{
+						{
+							Target:      "Shop.Customer/Name",
+							Annotations: []*GoDataAnnotation{{Term: "Core.Immutable"}},
+						},
+						{
+							Target:      "Shop.Customer/Name",
+							Qualifier:   "Tablet",
+							Annotations: []*GoDataAnnotation{{Term: "Core.Computed"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expected := `{
+		"$Version": "4.0",
+		"$EntityContainer": "Shop.Container",
+		"$Reference": {
+			"https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml": {
+				"$Include": [{"$Namespace": "Org.OData.Core.V1", "$Alias": "Core"}]
+			}
+		},
+		"Shop": {
+			"Customer": {
+				"$Kind": "EntityType",
+				"$Key": ["Id"],
+				"Id": {"$Type": "Edm.Int32"},
+				"Name": {"$Nullable": true, "$MaxLength": 50},
+				"Tags": {"$Collection": true},
+				"Active": {"$Type": "Edm.Boolean", "$DefaultValue": true},
+				"Address": {"$Type": "Shop.Address", "$Nullable": true},
+				"Orders": {"$Kind": "NavigationProperty", "$Collection": true, "$Type": "Shop.Order",
+					"$Partner": "Customer"}
+			},
+			"Order": {
+				"$Kind": "EntityType",
+				"$OpenType": true,
+				"$Key": ["Id"],
+				"Id": {"$Type": "Edm.Guid"},
+				"CustomerId": {"$Type": "Edm.Int32"},
+				"Total": {"$Type": "Edm.Decimal", "$Nullable": true, "$Precision": 10, "$Scale": 2,
+					"$DefaultValue": 0},
+				"Status": {"$Type": "Shop.Status"},
+				"Customer": {"$Kind": "NavigationProperty", "$Type": "Shop.Customer", "$Partner": "Orders",
+					"$OnDelete": "Cascade", "$ReferentialConstraint": {"CustomerId": "Id"}}
+			},
+			"Address": {"$Kind": "ComplexType", "City": {"$Nullable": true}},
+			"Status": {"$Kind": "EnumType", "$UnderlyingType": "Edm.Byte", "Open": 0, "Shipped": 4},
+			"Code": {"@Core.IsLanguageDependent": true, "$Kind": "TypeDefinition",
+				"$UnderlyingType": "Edm.String"},
+			"Audited": {"$Kind": "Term", "$Type": "Edm.Boolean", "$Nullable": true, "$DefaultValue": true,
+				"$AppliesTo": ["EntityType", "Property"]},
+			"Ship": [
+				{"$Kind": "Action", "$IsBound": true,
+					"$Parameter": [{"$Name": "order", "$Type": "Shop.Order"}]},
+				{"$Kind": "Action", "$IsBound": true,
+					"$Parameter": [{"$Name": "orders", "$Collection": true, "$Type": "Shop.Order"}]}
+			],
+			"TopCustomers": [
+				{"$Kind": "Function", "$ReturnType": {"$Collection": true, "$Type": "Shop.Customer"}}
+			],
+			"Container": {
+				"$Kind": "EntityContainer",
+				"Customers": {"$Collection": true, "$Type": "Shop.Customer",
+					"$NavigationPropertyBinding": {"Orders": "Orders"}},
+				"Orders": {"$Collection": true, "$Type": "Shop.Order", "$IncludeInServiceDocument": false},
+				"Owner": {"$Type": "Shop.Customer"},
+				"ShipAll": {"$Action": "Shop.Ship"},
+				"TopCustomers": {"$Function": "Shop.TopCustomers", "$EntitySet": "Customers",
+					"$IncludeInServiceDocument": true}
+			},
+			"$Annotations": {
+				"Shop.Customer/Name": {"@Core.Computed#Tablet": true, "@Core.Immutable": true}
+			}
+		}
+	}`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(expected)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	actual, err := metadata.JSON()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(actual) != compact.String() {
+		t.Errorf("Expected:\n%s\n\nGot:\n%s", compact.String(), string(actual))
+	}
+}
+
+func TestMetadataJsonAnnotations(t *testing.T) {
+	metadata := &GoDataMetadata{
+		References: []*GoDataReference{
+			{
+				Uri:      "https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml",
+				Includes: []*GoDataInclude{{Namespace: "Org.OData.Core.V1", Alias: "C"}},
+			},
+		},
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{
+				{
+					Namespace: "Shop",
+					Terms: []*GoDataTerm{
+						{Name: "Flag", Type: GoDataBoolean},
+						{Name: "Note", Type: GoDataString},
+					},
+					Annotation: []*GoDataAnnotation{
+						{Term: "C.Computed"},
+						{Term: "Core.Description"},
+						{Term: "Shop.Flag"},
+						{Term: "Shop.Note"},
+					},
+					Annotations: []*GoDataAnnotations{
+						{Target: "Shop.Customer", Annotations: []*GoDataAnnotation{{Term: "C.Description"}}},
+					},
+				},
+			},
+		},
+	}
+
+	data, err := metadata.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	// the version is required
+	if doc["$Version"] != "4.0" {
+		t.Errorf("Unexpected $Version %v", doc["$Version"])
+	}
+	// only Boolean terms may be written without a value
+	schema := doc["Shop"].(map[string]interface{})
+	for _, term := range []string{"@C.Computed", "@Shop.Flag"} {
+		if schema[term] != true {
+			t.Errorf("Expected annotation %s in %s", term, data)
+		}
+	}
+	for _, term := range []string{"@Core.Description", "@Shop.Note", "$Annotations"} {
+		if _, ok := schema[term]; ok {
+			t.Errorf("Unexpected member %s in %s", term, data)
+		}
+	}
+
+	xml, err := metadata.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(xml, []byte(`Version="4.0"`)) || metadata.Version != "" {
+		t.Errorf("Expected the default version in %s", xml)
+	}
+}
+
+func TestMetadataNegotiation(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		url         string
+		accept      string
+		contentType string
+	}{
+		{"/$metadata", "", "application/xml"},
+		{"/$metadata", "application/json", "application/json"},
+		{"/$metadata", "application/xml;q=0.5, application/json", "application/json"},
+		{"/$metadata?$format=json", "", "application/json"},
+		{"/$metadata?$format=xml", "application/json", "application/xml"},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("GET", testCase.url, nil)
+		if testCase.accept != "" {
+			r.Header.Set("Accept", testCase.accept)
+		}
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, r)
+
+		if w.Code != 200 || w.Header().Get("Content-Type") != testCase.contentType {
+			t.Errorf("%s with Accept %q: expected %s, got %d %s", testCase.url, testCase.accept,
+				testCase.contentType, w.Code, w.Header().Get("Content-Type"))
+			continue
+		}
+		isJson := strings.HasPrefix(w.Body.String(), "{")
+		if isJson != (testCase.contentType == "application/json") {
+			t.Errorf("%s with Accept %q: unexpected body %s", testCase.url, testCase.accept, w.Body.String())
+		}
+	}
+}
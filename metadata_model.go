@@ -6,26 +6,39 @@ import (
 
 const (
 	GoDataString         = "Edm.String"
+	GoDataByte           = "Edm.Byte"
+	GoDataSByte          = "Edm.SByte"
 	GoDataInt16          = "Edm.Int16"
 	GoDataInt32          = "Edm.Int32"
 	GoDataInt64          = "Edm.Int64"
 	GoDataDecimal        = "Edm.Decimal"
+	GoDataSingle         = "Edm.Single"
+	GoDataDouble         = "Edm.Double"
 	GoDataBinary         = "Edm.Binary"
 	GoDataBoolean        = "Edm.Boolean"
+	GoDataGuid           = "Edm.Guid"
 	GoDataTimeOfDay      = "Edm.TimeOfDay"
 	GoDataDate           = "Edm.Date"
 	GoDataDateTimeOffset = "Edm.DateTimeOffset"
+	GoDataDuration       = "Edm.Duration"
 )
 
 type GoDataMetadata struct {
 	XMLName      xml.Name `xml:"edmx:Edmx"`
 	XMLNamespace string   `xml:"xmlns:edmx,attr"`
 	Version      string   `xml:"Version,attr"`
-	DataServices *GoDataServices
+	// CSDL XML requires the references to precede the data services.
 	References   []*GoDataReference
+	DataServices *GoDataServices
 }
 
 func (t *GoDataMetadata) Bytes() ([]byte, error) {
+	if t.Version == "" {
+		// the version is required
+		versioned := *t
+		versioned.Version = odataVersion
+		t = &versioned
+	}
 	output, err := xml.MarshalIndent(t, "", "    ")
 	if err != nil {
 		return nil, err
@@ -43,6 +56,9 @@ type GoDataReference struct {
 	Uri                string   `xml:"Uri,attr"`
 	Includes           []*GoDataInclude
 	IncludeAnnotations []*GoDataIncludeAnnotations
+	// The referenced document, once loaded by LoadReferences. The schemas
+	// it includes are used by the service along with its own.
+	Document *GoDataMetadata `xml:"-"`
 }
 
 type GoDataInclude struct {
@@ -59,40 +75,40 @@ type GoDataIncludeAnnotations struct {
 }
 
 type GoDataServices struct {
-	XMLName xml.Name `xml:"edmx:DataServices"`
-	Schemas []*GoDataSchema
+	XMLName xml.Name        `xml:"edmx:DataServices"`
+	Schemas []*GoDataSchema `xml:"Schema"`
 }
 
 type GoDataSchema struct {
-	XMLName          xml.Name `xml:"Schema"`
-	Namespace        string   `xml:"Namespace,attr"`
-	Alias            string   `xml:"Alias,attr,omitempty"`
-	Actions          []*GoDataAction
-	Annotations      []*GoDataAnnotations
-	Annotation       []*GoDataAnnotation
-	ComplexTypes     []*GoDataComplexType
-	EntityContainers []*GoDataEntityContainer
-	EntityTypes      []*GoDataEntityType
-	EnumTypes        []*GoDataEnumType
-	Functions        []*GoDataFunction
-	Terms            []*GoDataTerm
-	TypeDefinitions  []*GoDataTypeDefinition
+	XMLName          xml.Name                 `xml:"Schema"`
+	Namespace        string                   `xml:"Namespace,attr"`
+	Alias            string                   `xml:"Alias,attr,omitempty"`
+	Actions          []*GoDataAction          `xml:"Action"`
+	Annotations      []*GoDataAnnotations     `xml:"Annotations"`
+	Annotation       []*GoDataAnnotation      `xml:"Annotation"`
+	ComplexTypes     []*GoDataComplexType     `xml:"ComplexType"`
+	EntityContainers []*GoDataEntityContainer `xml:"EntityContainer"`
+	EntityTypes      []*GoDataEntityType      `xml:"EntityType"`
+	EnumTypes        []*GoDataEnumType        `xml:"EnumType"`
+	Functions        []*GoDataFunction        `xml:"Function"`
+	Terms            []*GoDataTerm            `xml:"Term"`
+	TypeDefinitions  []*GoDataTypeDefinition  `xml:"TypeDefinition"`
 }
 
 type GoDataAction struct {
-	XMLName       xml.Name `xml:"Action"`
-	Name          string   `xml:"Name,attr"`
-	IsBound       string   `xml:"IsBound,attr,omitempty"`
-	EntitySetPath string   `xml:"EntitySetPath,attr,omitempty"`
-	Parameters    []*GoDataParameter
+	XMLName       xml.Name           `xml:"Action"`
+	Name          string             `xml:"Name,attr"`
+	IsBound       string             `xml:"IsBound,attr,omitempty"`
+	EntitySetPath string             `xml:"EntitySetPath,attr,omitempty"`
+	Parameters    []*GoDataParameter `xml:"Parameter"`
 	ReturnType    *GoDataReturnType
 }
 
 type GoDataAnnotations struct {
-	XMLName     xml.Name `xml:"Annotations"`
-	Target      string   `xml:"Target,attr"`
-	Qualifier   string   `xml:"Qualifier,attr,omitempty"`
-	Annotations []*GoDataAnnotation
+	XMLName     xml.Name            `xml:"Annotations"`
+	Target      string              `xml:"Target,attr"`
+	Qualifier   string              `xml:"Qualifier,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataAnnotation struct {
@@ -102,23 +118,23 @@ type GoDataAnnotation struct {
 }
 
 type GoDataComplexType struct {
-	XMLName              xml.Name `xml:"ComplexType"`
-	Name                 string   `xml:"Name,attr"`
-	BaseType             string   `xml:"BaseType,attr,omitempty"`
-	Abstract             string   `xml:"Abstract,attr,omitempty"`
-	OpenType             string   `xml:"OpenType,attr,omitempty"`
-	Properties           []*GoDataProperty
-	NavigationProperties []*GoDataNavigationProperty
+	XMLName              xml.Name                    `xml:"ComplexType"`
+	Name                 string                      `xml:"Name,attr"`
+	BaseType             string                      `xml:"BaseType,attr,omitempty"`
+	Abstract             string                      `xml:"Abstract,attr,omitempty"`
+	OpenType             string                      `xml:"OpenType,attr,omitempty"`
+	Properties           []*GoDataProperty           `xml:"Property"`
+	NavigationProperties []*GoDataNavigationProperty `xml:"NavigationProperty"`
 }
 
 type GoDataEntityContainer struct {
-	XMLName         xml.Name `xml:"EntityContainer"`
-	Name            string   `xml:"Name,attr"`
-	Extends         string   `xml:"Extends,attr,omitempty"`
-	EntitySets      []*GoDataEntitySet
-	Singletons      []*GoDataSingleton
-	ActionImports   []*GoDataActionImport
-	FunctionImports []*GoDataFunctionImport
+	XMLName         xml.Name                `xml:"EntityContainer"`
+	Name            string                  `xml:"Name,attr"`
+	Extends         string                  `xml:"Extends,attr,omitempty"`
+	EntitySets      []*GoDataEntitySet      `xml:"EntitySet"`
+	Singletons      []*GoDataSingleton      `xml:"Singleton"`
+	ActionImports   []*GoDataActionImport   `xml:"ActionImport"`
+	FunctionImports []*GoDataFunctionImport `xml:"FunctionImport"`
 }
 
 type GoDataEntityType struct {
@@ -129,33 +145,33 @@ type GoDataEntityType struct {
 	OpenType             string   `xml:"OpenType,attr,omitempty"`
 	HasStream            string   `xml:"HasStream,attr,omitempty"`
 	Key                  *GoDataKey
-	Properties           []*GoDataProperty
-	NavigationProperties []*GoDataNavigationProperty
+	Properties           []*GoDataProperty           `xml:"Property"`
+	NavigationProperties []*GoDataNavigationProperty `xml:"NavigationProperty"`
 }
 
 type GoDataEnumType struct {
-	XMLName        xml.Name `xml:"EnumType"`
-	Name           string   `xml:"Name,attr"`
-	UnderlyingType string   `xml:"UnderlyingType,attr,omitempty"`
-	IsFlags        string   `xml:"IsFlags,attr,omitempty"`
-	Members        []*GoDataMember
+	XMLName        xml.Name        `xml:"EnumType"`
+	Name           string          `xml:"Name,attr"`
+	UnderlyingType string          `xml:"UnderlyingType,attr,omitempty"`
+	IsFlags        string          `xml:"IsFlags,attr,omitempty"`
+	Members        []*GoDataMember `xml:"Member"`
 }
 
 type GoDataFunction struct {
-	XMLName       xml.Name `xml:"Function"`
-	Name          string   `xml:"Name,attr"`
-	IsBound       string   `xml:"IsBound,attr,omitempty"`
-	IsComposable  string   `xml:"IsComposable,attr,omitempty"`
-	EntitySetPath string   `xml:"EntitySetPath,attr,omitempty"`
-	Parameters    []*GoDataParameter
+	XMLName       xml.Name           `xml:"Function"`
+	Name          string             `xml:"Name,attr"`
+	IsBound       string             `xml:"IsBound,attr,omitempty"`
+	IsComposable  string             `xml:"IsComposable,attr,omitempty"`
+	EntitySetPath string             `xml:"EntitySetPath,attr,omitempty"`
+	Parameters    []*GoDataParameter `xml:"Parameter"`
 	ReturnType    *GoDataReturnType
 }
 
 type GoDataTypeDefinition struct {
-	XMLName        xml.Name `xml:"TypeDefinition"`
-	Name           string   `xml:"Name,attr"`
-	UnderlyingType string   `xml:"UnderlyingTypeattr,omitempty"`
-	Annotations    []*GoDataAnnotation
+	XMLName        xml.Name            `xml:"TypeDefinition"`
+	Name           string              `xml:"Name,attr"`
+	UnderlyingType string              `xml:"UnderlyingType,attr,omitempty"`
+	Annotations    []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataProperty struct {
@@ -172,13 +188,13 @@ type GoDataProperty struct {
 }
 
 type GoDataNavigationProperty struct {
-	XMLName                xml.Name `xml:"NavigationProperty"`
-	Name                   string   `xml:"Name,attr"`
-	Type                   string   `xml:"Type,attr"`
-	Nullable               string   `xml:"Nullable,attr,omitempty"`
-	Partner                string   `xml:"Partner,attr,omitempty"`
-	ContainsTarget         string   `xml:"ContainsTarget,attr,omitempty"`
-	ReferentialConstraints []*GoDataReferentialConstraint
+	XMLName                xml.Name                       `xml:"NavigationProperty"`
+	Name                   string                         `xml:"Name,attr"`
+	Type                   string                         `xml:"Type,attr"`
+	Nullable               string                         `xml:"Nullable,attr,omitempty"`
+	Partner                string                         `xml:"Partner,attr,omitempty"`
+	ContainsTarget         string                         `xml:"ContainsTarget,attr,omitempty"`
+	ReferentialConstraints []*GoDataReferentialConstraint `xml:"ReferentialConstraint"`
 }
 
 type GoDataReferentialConstraint struct {
@@ -194,18 +210,18 @@ type GoDataOnDelete struct {
 }
 
 type GoDataEntitySet struct {
-	XMLName                    xml.Name `xml:"EntitySet"`
-	Name                       string   `xml:"Name,attr"`
-	EntityType                 string   `xml:"EntityType,attr"`
-	IncludeInServiceDocument   string   `xml:"IncludeInServiceDocument,attr,omitempty"`
-	NavigationPropertyBindings []*GoDataNavigationPropertyBinding
+	XMLName                    xml.Name                           `xml:"EntitySet"`
+	Name                       string                             `xml:"Name,attr"`
+	EntityType                 string                             `xml:"EntityType,attr"`
+	IncludeInServiceDocument   string                             `xml:"IncludeInServiceDocument,attr,omitempty"`
+	NavigationPropertyBindings []*GoDataNavigationPropertyBinding `xml:"NavigationPropertyBinding"`
 }
 
 type GoDataSingleton struct {
-	XMLName                    xml.Name `xml:"Singleton"`
-	Name                       string   `xml:"Name,attr"`
-	Type                       string   `xml:"Type,attr"`
-	NavigationPropertyBindings []*GoDataNavigationPropertyBinding
+	XMLName                    xml.Name                           `xml:"Singleton"`
+	Name                       string                             `xml:"Name,attr"`
+	Type                       string                             `xml:"Type,attr"`
+	NavigationPropertyBindings []*GoDataNavigationPropertyBinding `xml:"NavigationPropertyBinding"`
 }
 
 type GoDataNavigationPropertyBinding struct {
@@ -230,8 +246,8 @@ type GoDataFunctionImport struct {
 }
 
 type GoDataKey struct {
-	XMLName     xml.Name `xml:"Key"`
-	PropertyRef *GoDataPropertyRef
+	XMLName      xml.Name             `xml:"Key"`
+	PropertyRefs []*GoDataPropertyRef `xml:"PropertyRef"`
 }
 
 type GoDataPropertyRef struct {
@@ -8,7 +8,7 @@ func TestSimpleMetadata(t *testing.T) {
 
 	entity1 := GoDataEntityType{
 		Name: "TestEntity1",
-		Key:  &GoDataKey{PropertyRef: &GoDataPropertyRef{Name: "Id"}},
+		Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Id"}}},
 		Properties: []*GoDataProperty{
 			{Name: "Id", Type: "Edm.Int32"},
 			{Name: "FirstName", Type: "Edm.String"},
@@ -0,0 +1,174 @@
+package godata
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+)
+
+// Parse a CSDL XML document, such as one written by GoDataMetadata.Bytes or
+// the $metadata document of another OData service. Elements and attributes
+// the model has no place for, e.g. the values of annotations, are skipped.
+// The documents named by edmx:Reference elements are not read; see
+// LoadReferences.
+func UnmarshalMetadata(r io.Reader) (*GoDataMetadata, error) {
+	metadata := &GoDataMetadata{}
+	if err := xml.NewDecoder(r).Decode(metadata); err != nil {
+		return nil, BadRequestError("Invalid CSDL XML document").SetCause(err)
+	}
+	return metadata, nil
+}
+
+// The elements of the edmx namespace, as they are unmarshalled. The decoder
+// matches elements by their local names, while the model names them with the
+// edmx prefix for the encoder, so they need names of their own.
+type edmxDocument struct {
+	Version      string           `xml:"Version,attr"`
+	References   []*edmxReference `xml:"Reference"`
+	DataServices *struct {
+		Schemas []*GoDataSchema `xml:"Schema"`
+	} `xml:"DataServices"`
+}
+
+type edmxReference struct {
+	Uri      string `xml:"Uri,attr"`
+	Includes []*struct {
+		Namespace string `xml:"Namespace,attr"`
+		Alias     string `xml:"Alias,attr"`
+	} `xml:"Include"`
+	IncludeAnnotations []*struct {
+		TermNamespace   string `xml:"TermNamespace,attr"`
+		Qualifier       string `xml:"Qualifier,attr"`
+		TargetNamespace string `xml:"TargetNamespace,attr"`
+	} `xml:"IncludeAnnotations"`
+}
+
+// Decode an edmx:Edmx element, as UnmarshalMetadata does.
+func (t *GoDataMetadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if start.Name.Local != "Edmx" {
+		return BadRequestError("Expected an edmx:Edmx element, not " + start.Name.Local)
+	}
+	var doc edmxDocument
+	if err := d.DecodeElement(&doc, &start); err != nil {
+		return err
+	}
+
+	t.XMLNamespace = start.Name.Space
+	t.Version = doc.Version
+	t.References = nil
+	for _, ref := range doc.References {
+		reference := &GoDataReference{Uri: ref.Uri}
+		for _, include := range ref.Includes {
+			reference.Includes = append(reference.Includes,
+				&GoDataInclude{Namespace: include.Namespace, Alias: include.Alias})
+		}
+		for _, include := range ref.IncludeAnnotations {
+			reference.IncludeAnnotations = append(reference.IncludeAnnotations, &GoDataIncludeAnnotations{
+				TermNamespace:   include.TermNamespace,
+				Qualifier:       include.Qualifier,
+				TargetNamespace: include.TargetNamespace,
+			})
+		}
+		t.References = append(t.References, reference)
+	}
+	t.DataServices = nil
+	if doc.DataServices != nil {
+		t.DataServices = &GoDataServices{Schemas: doc.DataServices.Schemas}
+	}
+	return nil
+}
+
+// Load the documents named by the references of the metadata, and those they
+// reference in turn, into the Document of each reference. The metadata was
+// read from the given URI, which may be empty if it has none. The open
+// function reads the document at a URI; relative reference URIs are resolved
+// against the URI of the document that contains them. A document referenced
+// more than once is only loaded once.
+func (t *GoDataMetadata) LoadReferences(uri string, open func(uri string) (io.ReadCloser, error)) error {
+	loaded := map[string]*GoDataMetadata{}
+	var base *url.URL
+	if uri != "" {
+		var err error
+		if base, err = url.Parse(uri); err != nil {
+			return BadRequestError("Invalid metadata URI " + uri).SetCause(err)
+		}
+		loaded[base.String()] = t
+	}
+	return t.loadReferences(base, open, loaded)
+}
+
+func (t *GoDataMetadata) loadReferences(base *url.URL, open func(uri string) (io.ReadCloser, error),
+	loaded map[string]*GoDataMetadata) error {
+
+	for _, reference := range t.References {
+		if reference.Document != nil {
+			continue
+		}
+		uri, err := url.Parse(reference.Uri)
+		if err != nil {
+			return BadRequestError("Invalid reference URI " + reference.Uri).SetCause(err)
+		}
+		if base != nil {
+			uri = base.ResolveReference(uri)
+		}
+		if document, ok := loaded[uri.String()]; ok {
+			reference.Document = document
+			continue
+		}
+
+		r, err := open(uri.String())
+		if err != nil {
+			return err
+		}
+		document, err := UnmarshalMetadata(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		reference.Document = document
+		loaded[uri.String()] = document
+		if err := document.loadReferences(uri, open, loaded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the schemas of the metadata, followed by the schemas included from the
+// documents loaded by LoadReferences, and those included by them in turn.
+func (t *GoDataMetadata) schemas() []*GoDataSchema {
+	schemas := []*GoDataSchema{}
+	added := map[*GoDataSchema]bool{}
+	// the documents being collected, as references may form a cycle
+	collecting := map[*GoDataMetadata]bool{}
+
+	var collect func(metadata *GoDataMetadata, include map[string]bool)
+	collect = func(metadata *GoDataMetadata, include map[string]bool) {
+		if collecting[metadata] {
+			return
+		}
+		collecting[metadata] = true
+		defer delete(collecting, metadata)
+
+		if metadata.DataServices != nil {
+			for _, schema := range metadata.DataServices.Schemas {
+				if !added[schema] && (include == nil || include[schema.Namespace]) {
+					added[schema] = true
+					schemas = append(schemas, schema)
+				}
+			}
+		}
+		for _, reference := range metadata.References {
+			if reference.Document == nil {
+				continue
+			}
+			namespaces := map[string]bool{}
+			for _, include := range reference.Includes {
+				namespaces[include.Namespace] = true
+			}
+			collect(reference.Document, namespaces)
+		}
+	}
+	collect(t, nil)
+	return schemas
+}
@@ -0,0 +1,215 @@
+package godata
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const testCsdlDocument = `<?xml version="1.0" encoding="utf-8"?>
+<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:Reference Uri="https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml">
+    <edmx:Include Namespace="Org.OData.Core.V1" Alias="Core"/>
+  </edmx:Reference>
+  <edmx:Reference Uri="types.xml">
+    <edmx:Include Namespace="Shop.Types"/>
+    <edmx:IncludeAnnotations TermNamespace="Org.OData.Core.V1" Qualifier="Tablet"/>
+  </edmx:Reference>
+  <edmx:DataServices>
+    <Schema Namespace="Shop" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <EntityType Name="Customer">
+        <Key>
+          <PropertyRef Name="Id"/>
+        </Key>
+        <Property Name="Id" Type="Edm.Int32" Nullable="false"/>
+        <Property Name="Name" Type="Edm.String" MaxLength="50">
+          <Annotation Term="Core.Description" String="The name of the customer"/>
+        </Property>
+        <Property Name="Address" Type="Shop.Types.Address"/>
+        <NavigationProperty Name="Orders" Type="Collection(Shop.Order)" Partner="Customer"/>
+      </EntityType>
+      <EntityType Name="Order">
+        <Key>
+          <PropertyRef Name="Id"/>
+        </Key>
+        <Property Name="Id" Type="Edm.String" Nullable="false"/>
+        <Property Name="CustomerId" Type="Edm.Int32"/>
+        <NavigationProperty Name="Customer" Type="Shop.Customer" Partner="Orders">
+          <ReferentialConstraint Property="CustomerId" ReferencedProperty="Id">
+            <OnDelete Action="Cascade"/>
+          </ReferentialConstraint>
+        </NavigationProperty>
+      </EntityType>
+      <EnumType Name="Status" UnderlyingType="Edm.Byte">
+        <Member Name="Open" Value="0"/>
+        <Member Name="Shipped" Value="1"/>
+      </EnumType>
+      <TypeDefinition Name="Code" UnderlyingType="Edm.String"/>
+      <Function Name="TopCustomers">
+        <Parameter Name="count" Type="Edm.Int32" Nullable="false"/>
+        <ReturnType Type="Collection(Shop.Customer)"/>
+      </Function>
+      <EntityContainer Name="Container">
+        <EntitySet Name="Customers" EntityType="Shop.Customer">
+          <NavigationPropertyBinding Path="Orders" Target="Orders"/>
+        </EntitySet>
+        <EntitySet Name="Orders" EntityType="Shop.Order">
+          <NavigationPropertyBinding Path="Customer" Target="Customers"/>
+        </EntitySet>
+        <FunctionImport Name="TopCustomers" Function="Shop.TopCustomers" EntitySet="Customers"/>
+      </EntityContainer>
+      <Annotations Target="Shop.Customer/Name">
+        <Annotation Term="Core.Immutable"/>
+      </Annotations>
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+const testCsdlTypes = `<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:Reference Uri="https://example.com/metadata/shop.xml">
+    <edmx:Include Namespace="Shop"/>
+  </edmx:Reference>
+  <edmx:DataServices>
+    <Schema Namespace="Shop.Types" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <ComplexType Name="Address">
+        <Property Name="City" Type="Edm.String"/>
+      </ComplexType>
+    </Schema>
+    <Schema Namespace="Shop.Other" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <ComplexType Name="Unused"/>
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+func TestUnmarshalMetadata(t *testing.T) {
+	metadata, err := UnmarshalMetadata(strings.NewReader(testCsdlDocument))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if metadata.Version != "4.0" || metadata.XMLNamespace != "http://docs.oasis-open.org/odata/ns/edmx" {
+		t.Errorf("Unexpected version %s or namespace %s", metadata.Version, metadata.XMLNamespace)
+	}
+	if len(metadata.References) != 2 || metadata.References[0].Includes[0].Alias != "Core" ||
+		metadata.References[1].IncludeAnnotations[0].Qualifier != "Tablet" {
+		t.Errorf("Unexpected references %+v", metadata.References)
+	}
+
+	schema := metadata.DataServices.Schemas[0]
+	customer := schema.EntityTypes[0]
+	if customer.Key.PropertyRefs[0].Name != "Id" || len(customer.Properties) != 3 ||
+		customer.Properties[1].MaxLength != 50 || customer.NavigationProperties[0].Partner != "Customer" {
+		t.Errorf("Unexpected entity type %+v", *customer)
+	}
+	constraint := schema.EntityTypes[1].NavigationProperties[0].ReferentialConstraints[0]
+	if constraint.ReferencedProperty != "Id" || constraint.OnDelete.Action != "Cascade" {
+		t.Errorf("Unexpected referential constraint %+v", *constraint)
+	}
+	if len(schema.EnumTypes[0].Members) != 2 || schema.TypeDefinitions[0].UnderlyingType != GoDataString {
+		t.Errorf("Unexpected enum type or type definition")
+	}
+	function := schema.Functions[0]
+	if function.Parameters[0].Name != "count" || function.ReturnType.Type != "Collection(Shop.Customer)" {
+		t.Errorf("Unexpected function %+v", *function)
+	}
+	container := schema.EntityContainers[0]
+	if len(container.EntitySets) != 2 || container.EntitySets[1].NavigationPropertyBindings[0].Target != "Customers" ||
+		container.FunctionImports[0].EntitySet != "Customers" {
+		t.Errorf("Unexpected entity container %+v", *container)
+	}
+	if schema.Annotations[0].Annotations[0].Term != "Core.Immutable" {
+		t.Errorf("Unexpected annotations %+v", *schema.Annotations[0])
+	}
+
+	// the document written for the model is read back as the same model
+	written, err := metadata.Bytes()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reread, err := UnmarshalMetadata(bytes.NewReader(written))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rewritten, err := reread.Bytes()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(written) != string(rewritten) {
+		t.Errorf("Expected:\n%s\n\nGot:\n%s", written, rewritten)
+	}
+	if !strings.Contains(string(written), `<TypeDefinition Name="Code" UnderlyingType="Edm.String">`) {
+		t.Errorf("Unexpected type definition in %s", written)
+	}
+
+	if _, err := UnmarshalMetadata(strings.NewReader(`<Schema Namespace="Shop"/>`)); err == nil {
+		t.Error("Expected an error for a document without an edmx:Edmx element")
+	}
+}
+
+func TestLoadReferences(t *testing.T) {
+	metadata, err := UnmarshalMetadata(strings.NewReader(testCsdlDocument))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the types refer back to the main document, which must not be loaded
+	// again
+	documents := map[string]string{
+		"https://example.com/metadata/types.xml": testCsdlTypes,
+		"https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml": `
+			<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx"/>`,
+	}
+	opened := map[string]int{}
+	open := func(uri string) (io.ReadCloser, error) {
+		opened[uri]++
+		document, ok := documents[uri]
+		if !ok {
+			return nil, errors.New("no document at " + uri)
+		}
+		return io.NopCloser(strings.NewReader(document)), nil
+	}
+	if err := metadata.LoadReferences("https://example.com/metadata/shop.xml", open); err != nil {
+		t.Error(err)
+		return
+	}
+	for uri := range documents {
+		if opened[uri] != 1 {
+			t.Errorf("Expected %s to be opened once, got %d", uri, opened[uri])
+		}
+	}
+
+	// only the included namespace is used by the service
+	namespaces := []string{}
+	for _, schema := range metadata.schemas() {
+		namespaces = append(namespaces, schema.Namespace)
+	}
+	if strings.Join(namespaces, ",") != "Shop,Shop.Types" {
+		t.Errorf("Unexpected schemas %v", namespaces)
+	}
+
+	provider := &ModelProvider{metadata: metadata}
+	service, err := BuildService(provider, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := service.LookupEntityType("Shop.Types.Address"); err == nil {
+		t.Error("Expected a complex type not to be found as an entity type")
+	}
+	if service.SchemaLookup["Shop.Types"] == nil || service.SchemaLookup["Shop.Other"] != nil {
+		t.Error("Expected only the included schema to be looked up")
+	}
+
+	metadata.References[1].Uri = "missing.xml"
+	metadata.References[1].Document = nil
+	if err := metadata.LoadReferences("", open); err == nil {
+		t.Error("Expected an error for a missing document")
+	}
+}
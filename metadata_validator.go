@@ -0,0 +1,490 @@
+package godata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The problems found in metadata by GoDataMetadata.Validate.
+type GoDataMetadataError struct {
+	Problems []string
+}
+
+func (e *GoDataMetadataError) Error() string {
+	return "Invalid metadata: " + strings.Join(e.Problems, "; ")
+}
+
+// The primitive and abstract types of the Edm namespace.
+var edmTypes = map[string]bool{
+	GoDataString: true, GoDataByte: true, GoDataSByte: true, GoDataInt16: true, GoDataInt32: true,
+	GoDataInt64: true, GoDataDecimal: true, GoDataSingle: true, GoDataDouble: true, GoDataBinary: true,
+	GoDataBoolean: true, GoDataGuid: true, GoDataTimeOfDay: true, GoDataDate: true,
+	GoDataDateTimeOffset: true, GoDataDuration: true,
+	"Edm.Stream": true, "Edm.Untyped": true, "Edm.PrimitiveType": true, "Edm.ComplexType": true,
+	"Edm.EntityType": true, "Edm.AnnotationPath": true, "Edm.PropertyPath": true,
+	"Edm.NavigationPropertyPath": true, "Edm.AnyPropertyPath": true, "Edm.ModelElementPath": true,
+	"Edm.Geography": true, "Edm.GeographyPoint": true, "Edm.GeographyLineString": true,
+	"Edm.GeographyPolygon": true, "Edm.GeographyMultiPoint": true, "Edm.GeographyMultiLineString": true,
+	"Edm.GeographyMultiPolygon": true, "Edm.GeographyCollection": true, "Edm.Geometry": true,
+	"Edm.GeometryPoint": true, "Edm.GeometryLineString": true, "Edm.GeometryPolygon": true,
+	"Edm.GeometryMultiPoint": true, "Edm.GeometryMultiLineString": true, "Edm.GeometryMultiPolygon": true,
+	"Edm.GeometryCollection": true,
+}
+
+// The underlying types an enum type may have.
+var enumUnderlyingTypes = map[string]bool{
+	"": true, GoDataByte: true, GoDataSByte: true, GoDataInt16: true, GoDataInt32: true, GoDataInt64: true,
+}
+
+// Check the metadata for problems that would otherwise only show up when a
+// request is served: names that refer to types, properties, entity sets or
+// operations that do not exist, keys and partners that do not match, and
+// duplicate names. The schemas included from documents loaded by
+// LoadReferences are checked as well. All problems are returned at once, in a
+// *GoDataMetadataError, or nil if there are none.
+func (t *GoDataMetadata) Validate() error {
+	v := &metadataValidator{
+		namespaces:    map[string]string{},
+		unresolved:    map[string]bool{},
+		entityTypes:   map[string]*GoDataEntityType{},
+		complexTypes:  map[string]*GoDataComplexType{},
+		otherTypes:    map[string]bool{},
+		actions:       map[string]bool{},
+		functions:     map[string]bool{},
+		entityTypeOwn: map[*GoDataEntityType]string{},
+	}
+	if t.DataServices == nil {
+		v.problem("the metadata has no data services")
+		return v.err()
+	}
+
+	schemas := t.schemas()
+	v.collect(t, schemas)
+	for _, schema := range schemas {
+		v.validateSchema(schema)
+	}
+	return v.err()
+}
+
+type metadataValidator struct {
+	problems []string
+	// The namespaces of schemas, by namespace and by alias.
+	namespaces map[string]string
+	// The namespaces of references that have not been loaded, whose types
+	// cannot be checked.
+	unresolved map[string]bool
+	// The declared types and operations, by qualified name.
+	entityTypes  map[string]*GoDataEntityType
+	complexTypes map[string]*GoDataComplexType
+	otherTypes   map[string]bool
+	actions      map[string]bool
+	functions    map[string]bool
+	// The qualified names of entity types.
+	entityTypeOwn map[*GoDataEntityType]string
+}
+
+func (v *metadataValidator) problem(problem string) {
+	v.problems = append(v.problems, problem)
+}
+
+func (v *metadataValidator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &GoDataMetadataError{Problems: v.problems}
+}
+
+// Collect the names declared by the schemas, reporting duplicates.
+func (v *metadataValidator) collect(t *GoDataMetadata, schemas []*GoDataSchema) {
+	var collectReferences func(metadata *GoDataMetadata, visited map[*GoDataMetadata]bool)
+	collectReferences = func(metadata *GoDataMetadata, visited map[*GoDataMetadata]bool) {
+		if visited[metadata] {
+			return
+		}
+		visited[metadata] = true
+		for _, reference := range metadata.References {
+			for _, include := range reference.Includes {
+				if include.Alias != "" {
+					v.namespaces[include.Alias] = include.Namespace
+				}
+				if reference.Document == nil {
+					v.unresolved[include.Namespace] = true
+				}
+			}
+			if reference.Document != nil {
+				collectReferences(reference.Document, visited)
+			}
+		}
+	}
+	collectReferences(t, map[*GoDataMetadata]bool{})
+
+	declared := map[string]bool{}
+	for _, schema := range schemas {
+		if declared[schema.Namespace] {
+			v.problem("namespace " + schema.Namespace + " is declared more than once")
+		}
+		declared[schema.Namespace] = true
+		v.namespaces[schema.Namespace] = schema.Namespace
+		if schema.Alias != "" {
+			v.namespaces[schema.Alias] = schema.Namespace
+		}
+
+		names := map[string]string{}
+		declare := func(name, kind string) string {
+			qualified := schema.Namespace + "." + name
+			if previous, ok := names[name]; ok && !(previous == kind && (kind == "action" || kind == "function")) {
+				// only operations of the same kind may be overloaded
+				v.problem(kind + " " + qualified + " has the same name as another " + previous)
+			}
+			names[name] = kind
+			return qualified
+		}
+		for _, entity := range schema.EntityTypes {
+			qualified := declare(entity.Name, "entity type")
+			v.entityTypes[qualified] = entity
+			v.entityTypeOwn[entity] = qualified
+		}
+		for _, complex := range schema.ComplexTypes {
+			v.complexTypes[declare(complex.Name, "complex type")] = complex
+		}
+		for _, enum := range schema.EnumTypes {
+			v.otherTypes[declare(enum.Name, "enum type")] = true
+		}
+		for _, definition := range schema.TypeDefinitions {
+			v.otherTypes[declare(definition.Name, "type definition")] = true
+		}
+		for _, term := range schema.Terms {
+			declare(term.Name, "term")
+		}
+		for _, action := range schema.Actions {
+			v.actions[declare(action.Name, "action")] = true
+		}
+		for _, function := range schema.Functions {
+			v.functions[declare(function.Name, "function")] = true
+		}
+		for _, container := range schema.EntityContainers {
+			declare(container.Name, "entity container")
+		}
+	}
+}
+
+// Get the qualified name of a type or operation, replacing an alias by its
+// namespace, and report if it is in a namespace that cannot be checked.
+func (v *metadataValidator) qualify(name string) (string, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, true
+	}
+	namespace, ok := v.namespaces[name[:i]]
+	if !ok {
+		namespace = name[:i]
+	}
+	if v.unresolved[namespace] {
+		return namespace + name[i:], false
+	}
+	return namespace + name[i:], true
+}
+
+func (v *metadataValidator) qualifyName(name string) string {
+	qualified, _ := v.qualify(name)
+	return qualified
+}
+
+// Check that a type name is a primitive type or a declared type. Entity types
+// are only allowed where allowEntity is true.
+func (v *metadataValidator) checkType(context, typeName string, allowEntity bool) {
+	itemType := modelItemType(typeName)
+	if edmTypes[itemType] {
+		return
+	}
+	qualified, checkable := v.qualify(itemType)
+	if !checkable {
+		return
+	}
+	if v.complexTypes[qualified] != nil || v.otherTypes[qualified] {
+		return
+	}
+	if v.entityTypes[qualified] != nil {
+		if !allowEntity {
+			v.problem(context + " has entity type " + typeName + "; use a navigation property")
+		}
+		return
+	}
+	if typeName == "" {
+		v.problem(context + " has no type")
+		return
+	}
+	v.problem(context + " has unknown type " + typeName)
+}
+
+// Look up the entity type a type name refers to, reporting it if there is
+// none. Types in namespaces that cannot be checked are not reported.
+func (v *metadataValidator) lookupEntityType(context, typeName string) *GoDataEntityType {
+	qualified, checkable := v.qualify(modelItemType(typeName))
+	entity := v.entityTypes[qualified]
+	if entity == nil && checkable {
+		v.problem(context + " refers to unknown entity type " + typeName)
+	}
+	return entity
+}
+
+// Get the structural and navigation properties of an entity type, including
+// those of its base types.
+func (v *metadataValidator) entityProperties(entity *GoDataEntityType) (
+	map[string]*GoDataProperty, map[string]*GoDataNavigationProperty) {
+
+	props := map[string]*GoDataProperty{}
+	navProps := map[string]*GoDataNavigationProperty{}
+	visited := map[*GoDataEntityType]bool{}
+	for entity != nil && !visited[entity] {
+		visited[entity] = true
+		for _, prop := range entity.Properties {
+			if _, ok := props[prop.Name]; !ok {
+				props[prop.Name] = prop
+			}
+		}
+		for _, nav := range entity.NavigationProperties {
+			if _, ok := navProps[nav.Name]; !ok {
+				navProps[nav.Name] = nav
+			}
+		}
+		if entity.BaseType == "" {
+			break
+		}
+		entity = v.entityTypes[v.qualifyName(entity.BaseType)]
+	}
+	return props, navProps
+}
+
+// Check if an entity type is a given type or derives from it.
+func (v *metadataValidator) derivesFrom(entity *GoDataEntityType, base *GoDataEntityType) bool {
+	visited := map[*GoDataEntityType]bool{}
+	for entity != nil && !visited[entity] {
+		if entity == base {
+			return true
+		}
+		visited[entity] = true
+		entity = v.entityTypes[v.qualifyName(entity.BaseType)]
+	}
+	return false
+}
+
+func (v *metadataValidator) validateSchema(schema *GoDataSchema) {
+	for _, entity := range schema.EntityTypes {
+		v.validateEntityType(schema.Namespace+"."+entity.Name, entity)
+	}
+	for _, complex := range schema.ComplexTypes {
+		name := "complex type " + schema.Namespace + "." + complex.Name
+		if complex.BaseType != "" {
+			if qualified, checkable := v.qualify(complex.BaseType); checkable && v.complexTypes[qualified] == nil {
+				v.problem(name + " has unknown base type " + complex.BaseType)
+			}
+		}
+		v.validateProperties(name, complex.Properties, complex.NavigationProperties)
+	}
+	for _, enum := range schema.EnumTypes {
+		name := "enum type " + schema.Namespace + "." + enum.Name
+		if !enumUnderlyingTypes[enum.UnderlyingType] {
+			v.problem(name + " has invalid underlying type " + enum.UnderlyingType)
+		}
+		members := map[string]bool{}
+		for _, member := range enum.Members {
+			if members[member.Name] {
+				v.problem(name + " has more than one member named " + member.Name)
+			}
+			members[member.Name] = true
+			if member.Value != "" {
+				if _, err := strconv.ParseInt(member.Value, 10, 64); err != nil {
+					v.problem(name + " has member " + member.Name + " with invalid value " + member.Value)
+				}
+			}
+		}
+	}
+	for _, definition := range schema.TypeDefinitions {
+		if !edmTypes[definition.UnderlyingType] {
+			v.problem("type definition " + schema.Namespace + "." + definition.Name +
+				" has invalid underlying type " + definition.UnderlyingType)
+		}
+	}
+	for _, term := range schema.Terms {
+		v.checkType("term "+schema.Namespace+"."+term.Name, term.Type, true)
+	}
+	for _, action := range schema.Actions {
+		v.validateOperation("action "+schema.Namespace+"."+action.Name, action.Parameters, action.ReturnType)
+	}
+	for _, function := range schema.Functions {
+		name := "function " + schema.Namespace + "." + function.Name
+		if function.ReturnType == nil {
+			v.problem(name + " has no return type")
+		}
+		v.validateOperation(name, function.Parameters, function.ReturnType)
+	}
+	for _, container := range schema.EntityContainers {
+		v.validateContainer(schema.Namespace+"."+container.Name, container)
+	}
+}
+
+func (v *metadataValidator) validateEntityType(qualified string, entity *GoDataEntityType) {
+	name := "entity type " + qualified
+	if entity.BaseType != "" {
+		if base, checkable := v.qualify(entity.BaseType); checkable && v.entityTypes[base] == nil {
+			v.problem(name + " has unknown base type " + entity.BaseType)
+		} else if v.derivesFrom(v.entityTypes[base], entity) {
+			v.problem(name + " derives from itself")
+		}
+	}
+	v.validateProperties(name, entity.Properties, entity.NavigationProperties)
+
+	props, _ := v.entityProperties(entity)
+	seen := map[string]bool{}
+	for _, key := range entityKeyNames(entity) {
+		if seen[key] {
+			v.problem(name + " has key " + key + " more than once")
+			continue
+		}
+		seen[key] = true
+		if prop, ok := props[key]; !ok {
+			v.problem(name + " has key " + key + ", which is not one of its properties")
+		} else if strings.HasPrefix(prop.Type, "Collection(") {
+			v.problem(name + " has key " + key + ", which is a collection")
+		}
+	}
+
+	for _, nav := range entity.NavigationProperties {
+		navName := "navigation property " + nav.Name + " of " + name
+		target := v.lookupEntityType(navName, nav.Type)
+		if target == nil {
+			continue
+		}
+		targetProps, targetNavProps := v.entityProperties(target)
+
+		if nav.Partner != "" {
+			partner, ok := targetNavProps[nav.Partner]
+			if !ok {
+				v.problem(navName + " has partner " + nav.Partner + ", which is not a navigation property of " +
+					v.entityTypeOwn[target])
+			} else if partnerTarget, checkable := v.qualify(modelItemType(partner.Type)); checkable &&
+				!v.derivesFrom(entity, v.entityTypes[partnerTarget]) {
+				v.problem(navName + " has partner " + nav.Partner + ", which does not refer back to " + qualified)
+			} else if partner.Partner != "" && partner.Partner != nav.Name {
+				v.problem(navName + " has partner " + nav.Partner + ", whose partner is " + partner.Partner)
+			}
+		}
+
+		for _, constraint := range nav.ReferentialConstraints {
+			if _, ok := props[constraint.Property]; !ok {
+				v.problem(navName + " has a referential constraint on " + constraint.Property +
+					", which is not a property of " + qualified)
+			}
+			if _, ok := targetProps[constraint.ReferencedProperty]; !ok {
+				v.problem(navName + " has a referential constraint referring to " + constraint.ReferencedProperty +
+					", which is not a property of " + v.entityTypeOwn[target])
+			}
+		}
+	}
+}
+
+// Check the property names and types of an entity or complex type.
+func (v *metadataValidator) validateProperties(name string, props []*GoDataProperty,
+	navProps []*GoDataNavigationProperty) {
+
+	names := map[string]bool{}
+	for _, prop := range props {
+		if names[prop.Name] {
+			v.problem(name + " has more than one property named " + prop.Name)
+		}
+		names[prop.Name] = true
+		v.checkType("property "+prop.Name+" of "+name, prop.Type, false)
+	}
+	for _, nav := range navProps {
+		if names[nav.Name] {
+			v.problem(name + " has more than one property named " + nav.Name)
+		}
+		names[nav.Name] = true
+	}
+}
+
+func (v *metadataValidator) validateOperation(name string, parameters []*GoDataParameter,
+	returnType *GoDataReturnType) {
+
+	names := map[string]bool{}
+	for _, parameter := range parameters {
+		if names[parameter.Name] {
+			v.problem(name + " has more than one parameter named " + parameter.Name)
+		}
+		names[parameter.Name] = true
+		v.checkType("parameter "+parameter.Name+" of "+name, parameter.Type, true)
+	}
+	if returnType != nil {
+		v.checkType("the return type of "+name, returnType.Type, true)
+	}
+}
+
+func (v *metadataValidator) validateContainer(qualified string, container *GoDataEntityContainer) {
+	name := "entity container " + qualified
+	children := map[string]bool{}
+	sets := map[string]bool{}
+	declare := func(child string) {
+		if children[child] {
+			v.problem(name + " has more than one child named " + child)
+		}
+		children[child] = true
+	}
+	for _, set := range container.EntitySets {
+		declare(set.Name)
+		sets[set.Name] = true
+	}
+	for _, singleton := range container.Singletons {
+		declare(singleton.Name)
+		sets[singleton.Name] = true
+	}
+
+	checkBindings := func(source string, entity *GoDataEntityType, bindings []*GoDataNavigationPropertyBinding) {
+		for _, binding := range bindings {
+			if entity != nil && !strings.Contains(binding.Path, "/") {
+				// paths through complex properties or type casts are not
+				// checked
+				if _, navProps := v.entityProperties(entity); navProps[binding.Path] == nil {
+					v.problem(source + " binds " + binding.Path + ", which is not a navigation property of " +
+						v.entityTypeOwn[entity])
+				}
+			}
+			if !strings.Contains(binding.Target, "/") && !sets[binding.Target] {
+				// targets in other containers are not checked
+				v.problem(source + " binds " + binding.Path + " to " + binding.Target +
+					", which is not an entity set or singleton of " + qualified)
+			}
+		}
+	}
+	for _, set := range container.EntitySets {
+		source := "entity set " + set.Name + " of " + name
+		entity := v.lookupEntityType(source, set.EntityType)
+		checkBindings(source, entity, set.NavigationPropertyBindings)
+	}
+	for _, singleton := range container.Singletons {
+		source := "singleton " + singleton.Name + " of " + name
+		entity := v.lookupEntityType(source, singleton.Type)
+		checkBindings(source, entity, singleton.NavigationPropertyBindings)
+	}
+
+	for _, actionImport := range container.ActionImports {
+		declare(actionImport.Name)
+		source := "action import " + actionImport.Name + " of " + name
+		if action, checkable := v.qualify(actionImport.Action); checkable && !v.actions[action] {
+			v.problem(source + " refers to unknown action " + actionImport.Action)
+		}
+		if actionImport.EntitySet != "" && !sets[actionImport.EntitySet] {
+			v.problem(source + " refers to unknown entity set " + actionImport.EntitySet)
+		}
+	}
+	for _, functionImport := range container.FunctionImports {
+		declare(functionImport.Name)
+		source := "function import " + functionImport.Name + " of " + name
+		if function, checkable := v.qualify(functionImport.Function); checkable && !v.functions[function] {
+			v.problem(source + " refers to unknown function " + functionImport.Function)
+		}
+		if functionImport.EntitySet != "" && !sets[functionImport.EntitySet] {
+			v.problem(source + " refers to unknown entity set " + functionImport.EntitySet)
+		}
+	}
+}
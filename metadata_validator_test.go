@@ -0,0 +1,138 @@
+package godata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := metadata.Validate(); err != nil {
+		t.Errorf("Expected built metadata to be valid, got %v", err)
+	}
+	if err := (&DummyProvider{}).GetMetadata().Validate(); err != nil {
+		t.Errorf("Expected dummy metadata to be valid, got %v", err)
+	}
+
+	// types in a referenced namespace are not checked until it is loaded
+	metadata, err = UnmarshalMetadata(strings.NewReader(testCsdlDocument))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := metadata.Validate(); err != nil {
+		t.Errorf("Expected parsed metadata to be valid, got %v", err)
+	}
+}
+
+func TestValidateMetadataProblems(t *testing.T) {
+	metadata := &GoDataMetadata{
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{
+				{
+					Namespace: "Shop",
+					Alias:     "S",
+					EntityTypes: []*GoDataEntityType{
+						{
+							Name: "Customer",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Id"}}},
+							Properties: []*GoDataProperty{
+								{Name: "Name", Type: GoDataString},
+								{Name: "Name", Type: "Edm.Text"},
+								{Name: "Best", Type: "S.Order"},
+							},
+							NavigationProperties: []*GoDataNavigationProperty{
+								{Name: "Orders", Type: "Collection(S.Order)", Partner: "Buyer"},
+								{Name: "Invoices", Type: "Collection(Shop.Invoice)"},
+							},
+						},
+						{
+							Name: "Order",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Id"}, {Name: "Id"}}},
+							Properties: []*GoDataProperty{
+								{Name: "Id", Type: GoDataInt32},
+								{Name: "Status", Type: "Shop.Status"},
+							},
+							NavigationProperties: []*GoDataNavigationProperty{
+								{
+									Name: "Customer", Type: "Shop.Customer", Partner: "Invoices",
+									ReferentialConstraints: []*GoDataReferentialConstraint{
+										{Property: "CustomerId", ReferencedProperty: "Name"},
+									},
+								},
+							},
+						},
+					},
+					EnumTypes: []*GoDataEnumType{
+						{Name: "Status", UnderlyingType: GoDataString, Members: []*GoDataMember{{Name: "Open"}}},
+					},
+					EntityContainers: []*GoDataEntityContainer{
+						{
+							Name: "Container",
+							EntitySets: []*GoDataEntitySet{
+								{
+									Name:       "Customers",
+									EntityType: "Shop.Customer",
+									NavigationPropertyBindings: []*GoDataNavigationPropertyBinding{
+										{Path: "Orders", Target: "Orders"},
+										{Path: "Addresses", Target: "Customers"},
+									},
+								},
+								{Name: "Customers", EntityType: "Shop.Client"},
+							},
+							FunctionImports: []*GoDataFunctionImport{
+								{Name: "Top", Function: "Shop.Top"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{
+		"entity type Shop.Customer has key Id, which is not one of its properties",
+		"entity type Shop.Customer has more than one property named Name",
+		"entity type Shop.Order has key Id more than once",
+		"property Name of entity type Shop.Customer has unknown type Edm.Text",
+		"property Best of entity type Shop.Customer has entity type S.Order",
+		"navigation property Orders of entity type Shop.Customer has partner Buyer",
+		"navigation property Invoices of entity type Shop.Customer refers to unknown entity type",
+		"navigation property Customer of entity type Shop.Order has partner Invoices",
+		"referential constraint on CustomerId",
+		"enum type Shop.Status has invalid underlying type Edm.String",
+		"entity container Shop.Container has more than one child named Customers",
+		"binds Orders to Orders, which is not an entity set",
+		"binds Addresses, which is not a navigation property",
+		"entity set Customers of entity container Shop.Container refers to unknown entity type Shop.Client",
+		"function import Top of entity container Shop.Container refers to unknown function Shop.Top",
+	}
+
+	err := metadata.Validate()
+	metadataError, ok := err.(*GoDataMetadataError)
+	if !ok {
+		t.Errorf("Expected a metadata error, got %v", err)
+		return
+	}
+	for _, problem := range expected {
+		found := false
+		for _, actual := range metadataError.Problems {
+			if strings.Contains(actual, problem) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a problem containing %q in %v", problem, strings.Join(metadataError.Problems, "\n"))
+		}
+	}
+
+	// the service is not built from invalid metadata
+	_, err = BuildService(&ModelProvider{metadata: metadata}, "http://localhost")
+	if _, ok := err.(*GoDataMetadataError); !ok {
+		t.Errorf("Expected BuildService to fail with a metadata error, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package godata
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// A call to a provider method, as passed to the provider hook of a
+// middleware. Calling it continues the call to the provider.
+type GoDataProviderCall func() (*GoDataResponseField, error)
+
+// A middleware hooks into the lifecycle of every request handled by a
+// GoDataService, e.g. for caching, authorization or telemetry. Each hook is
+// optional, and is called at a distinct phase of the request. If a hook
+// returns an error, handling of the request stops and the error is written to
+// the client as an OData error response.
+type GoDataMiddleware struct {
+	// Wraps the HTTP handler of the service, with access to the raw HTTP
+	// request and response before anything is parsed.
+	HTTP func(next http.Handler) http.Handler
+	// Called after the URL of a request has been parsed, but before it has
+	// been semanticized. The request may be modified, e.g. to rewrite its
+	// query options.
+	Parsed func(r *http.Request, request *GoDataRequest) error
+	// Called after the request has been semanticized, so each segment of the
+	// request refers to the entity set, property, etc. it addresses.
+	Semanticized func(r *http.Request, request *GoDataRequest) error
+	// Wraps every call to the provider. The operation is the name of the
+	// provider method being called, e.g. "GetEntityCollection". The hook must
+	// call next to continue the call, and may change its result.
+	Provider func(r *http.Request, request *GoDataRequest, operation string, next GoDataProviderCall) (*GoDataResponseField, error)
+	// Called with every JSON response before it is serialized. The response
+	// may be modified. A collection requested as CSV or NDJSON is passed to
+	// this hook as the JSON response it would otherwise be, before it is
+	// written as rows. Count, raw value and metadata responses are not JSON
+	// objects, and are not passed to this hook.
+	Response func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error
+}
+
+// Attach a middleware to the service. Middleware is run in the order it was
+// attached, so the first attached middleware is the outermost, e.g. its HTTP
+// handler receives requests first.
+func (service *GoDataService) AttachMiddleware(middleware *GoDataMiddleware) {
+	service.Middleware = append(service.Middleware, middleware)
+}
+
+// Wrap a handler with the HTTP hooks of the attached middleware.
+func (service *GoDataService) wrapHTTPHandler(handler http.Handler) http.Handler {
+	for i := len(service.Middleware) - 1; i >= 0; i-- {
+		if hook := service.Middleware[i].HTTP; hook != nil {
+			handler = hook(handler)
+		}
+	}
+	return handler
+}
+
+// Run the hooks of the attached middleware that are called after a request
+// has been parsed.
+func (service *GoDataService) runParsedHooks(r *http.Request, request *GoDataRequest) error {
+	for _, middleware := range service.Middleware {
+		if middleware.Parsed != nil {
+			if err := middleware.Parsed(r, request); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run the hooks of the attached middleware that are called after a request
+// has been semanticized.
+func (service *GoDataService) runSemanticizedHooks(r *http.Request, request *GoDataRequest) error {
+	for _, middleware := range service.Middleware {
+		if middleware.Semanticized != nil {
+			if err := middleware.Semanticized(r, request); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check if any attached middleware has a response hook.
+func (service *GoDataService) hasResponseHooks() bool {
+	for _, middleware := range service.Middleware {
+		if middleware.Response != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the response hooks of the attached middleware.
+func (service *GoDataService) runResponseHooks(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+	for _, middleware := range service.Middleware {
+		if middleware.Response != nil {
+			if err := middleware.Response(r, request, response); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Shape a response for the format of the request, pass it through the
+// response hooks of the attached middleware, and serialize it as JSON with
+// its properties in a fixed order.
+func (service *GoDataService) serialize(r *http.Request, request *GoDataRequest, response *GoDataResponse) ([]byte, error) {
+	if err := service.applyFormat(r, request, response); err != nil {
+		return nil, err
+	}
+	if err := service.runResponseHooks(r, request, response); err != nil {
+		return nil, err
+	}
+	order, err := service.orderResponse(r, request, response)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeJsonObject(&buf, response.Fields, order); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
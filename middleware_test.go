@@ -0,0 +1,172 @@
+package godata
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A middleware that records the phases it is called in.
+func recordingMiddleware(name string, calls *[]string) *GoDataMiddleware {
+	return &GoDataMiddleware{
+		HTTP: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				*calls = append(*calls, name+" HTTP")
+				next.ServeHTTP(w, r)
+			})
+		},
+		Parsed: func(r *http.Request, request *GoDataRequest) error {
+			*calls = append(*calls, name+" Parsed")
+			return nil
+		},
+		Semanticized: func(r *http.Request, request *GoDataRequest) error {
+			*calls = append(*calls, name+" Semanticized")
+			return nil
+		},
+		Provider: func(r *http.Request, request *GoDataRequest, operation string, next GoDataProviderCall) (*GoDataResponseField, error) {
+			*calls = append(*calls, name+" "+operation)
+			return next()
+		},
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			*calls = append(*calls, name+" Response")
+			return nil
+		},
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	service, err := BuildService(&CustomerProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	calls := []string{}
+	service.AttachMiddleware(recordingMiddleware("first", &calls))
+	service.AttachMiddleware(recordingMiddleware("second", &calls))
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+
+	expected := []string{
+		"first HTTP", "second HTTP",
+		"first Parsed", "second Parsed",
+		"first Semanticized", "second Semanticized",
+		"first GetEntity", "second GetEntity",
+		"first Response", "second Response",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestMiddlewareSemanticizedRejects(t *testing.T) {
+	provider := &WritableCustomerProvider{}
+	service := buildWritableService(t, provider)
+	service.AttachMiddleware(&GoDataMiddleware{
+		Semanticized: func(r *http.Request, request *GoDataRequest) error {
+			set, ok := request.FirstSegment.SemanticReference.(*GoDataEntitySet)
+			if ok && set.Name == "Customers" && r.Method != "GET" {
+				return &GoDataError{ResponseCode: 403, Message: "Customers are read-only"}
+			}
+			return nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"Carol","Age":30}`))
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Expected status 403, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Created) != 0 {
+		t.Error("Provider was called for a rejected request")
+	}
+
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/odata/Customers('Bob')", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMiddlewareParsedRewritesQuery(t *testing.T) {
+	service, err := BuildService(&CustomerProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.AttachMiddleware(&GoDataMiddleware{
+		Parsed: func(r *http.Request, request *GoDataRequest) error {
+			// drop the unknown property before it is semanticized
+			request.Query.Select = nil
+			return nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')?$select=Missing", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMiddlewareProviderAndResponse(t *testing.T) {
+	service, err := BuildService(&CustomerProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.AttachMiddleware(&GoDataMiddleware{
+		Provider: func(r *http.Request, request *GoDataRequest, operation string, next GoDataProviderCall) (*GoDataResponseField, error) {
+			result, err := next()
+			if err != nil {
+				return nil, err
+			}
+			result.Value.(map[string]*GoDataResponseField)["Age"] = &GoDataResponseField{Value: 43}
+			return result, nil
+		},
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			response.Fields["@example.operation"] = &GoDataResponseField{Value: "read"}
+			return nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body["Age"] != 43.0 {
+		t.Errorf("Provider hook did not change the result: %s", w.Body.String())
+	}
+	if body["@example.operation"] != "read" {
+		t.Errorf("Response hook did not change the response: %s", w.Body.String())
+	}
+
+	// errors from the response hook are written to the client
+	service.AttachMiddleware(&GoDataMiddleware{
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			return InternalServerError("Response rejected")
+		},
+	})
+	status, errBody := serveError(t, service, "/Customers('Bob')")
+	if status != 500 || errBody.Error.Message != "Response rejected" {
+		t.Errorf("Expected response hook error, got %d: %+v", status, errBody.Error)
+	}
+}
@@ -0,0 +1,218 @@
+package godata
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Determine the page size for a collection request: the smaller of the
+// maximum page size of the service and the page size preferred by the client,
+// if any. Also returns whether the preference of the client was applied.
+func (service *GoDataService) pageSize(r *http.Request) (int, bool) {
+	preferences := parsePreferHeader(r.Header)
+	preferred, ok := preferences["odata.maxpagesize"]
+	if !ok {
+		// OData 4.01 clients may omit the odata prefix
+		preferred, ok = preferences["maxpagesize"]
+	}
+	if ok {
+		size, err := strconv.Atoi(preferred)
+		if err == nil && size > 0 && (service.MaxPageSize <= 0 || size <= service.MaxPageSize) {
+			return size, true
+		}
+	}
+	if service.MaxPageSize > 0 {
+		return service.MaxPageSize, false
+	}
+	return 0, false
+}
+
+// Cut the collection returned by a provider down to a single page, if the
+// request is paged. Returns the page, and a link to the next page, if any.
+func (service *GoDataService) pageCollection(
+	r *http.Request,
+	request *GoDataRequest,
+	collection *GoDataResponseField,
+) (*GoDataResponseField, string, error) {
+	if request.PageSize <= 0 && request.Query.SkipToken == nil {
+		return collection, "", nil
+	}
+
+	if collection == nil {
+		return nil, "", InternalServerError("Provider did not return a valid response from GetEntityCollection()")
+	}
+	entities, ok := collection.Value.([]*GoDataResponseField)
+	if !ok {
+		return nil, "", InternalServerError("Provider did not return a valid response from GetEntityCollection()")
+	}
+	page, nextLink, err := service.pageEntities(r, request, entities)
+	if err != nil {
+		return nil, "", err
+	}
+	return &GoDataResponseField{Value: page}, nextLink, nil
+}
+
+// Cut the entities returned by a provider down to a single page. Entities
+// that do not follow the skip token of the request are dropped, in case the
+// provider did not apply the skip token itself. If more entities remain after
+// the page, a link to the next page is returned as well.
+func (service *GoDataService) pageEntities(
+	r *http.Request,
+	request *GoDataRequest,
+	entities []*GoDataResponseField,
+) ([]*GoDataResponseField, string, error) {
+	pager, err := service.newCollectionPager(r, request)
+	if err != nil {
+		return nil, "", err
+	}
+	page := make([]*GoDataResponseField, 0, len(entities))
+	for _, entity := range entities {
+		fields, err := pager.add(entity)
+		if err != nil {
+			return nil, "", err
+		}
+		if pager.done {
+			break
+		}
+		if fields != nil {
+			page = append(page, entity)
+		}
+	}
+	return page, pager.nextLink, nil
+}
+
+// Cuts the entities of a collection down to a single page as they are
+// produced by a provider, so a streamed collection can be paged without
+// holding it in memory.
+type collectionPager struct {
+	service *GoDataService
+	r       *http.Request
+	request *GoDataRequest
+	keys    []string
+	// Whether an entity following the skip token has been seen.
+	started bool
+	// The number of entities on the page so far, and the last of them.
+	count int
+	last  map[string]*GoDataResponseField
+	// Set once the page is full and another entity follows it. No further
+	// entities should be added.
+	done     bool
+	nextLink string
+}
+
+func (service *GoDataService) newCollectionPager(r *http.Request, request *GoDataRequest) (*collectionPager, error) {
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return nil, err
+	}
+	return &collectionPager{
+		service: service,
+		r:       r,
+		request: request,
+		keys:    entityKeyNames(entityType),
+		started: request.Query.SkipToken == nil,
+	}, nil
+}
+
+// Add the next entity of the collection. Returns the properties of the entity
+// if it is on the page, or nil if it is dropped. If the page was already
+// full, the link to the next page is built and done is set instead.
+func (p *collectionPager) add(entity *GoDataResponseField) (map[string]*GoDataResponseField, error) {
+	var fields map[string]*GoDataResponseField
+	if entity != nil {
+		fields, _ = entity.Value.(map[string]*GoDataResponseField)
+	}
+	if fields == nil {
+		return nil, InternalServerError("Provider did not return a valid response from GetEntityCollection()")
+	}
+
+	if !p.started {
+		if !p.request.Query.SkipToken.precedes(fields, p.request.PageOrder) {
+			return nil, nil
+		}
+		p.started = true
+	}
+
+	if size := p.request.PageSize; size > 0 && p.count >= size {
+		nextLink, err := p.service.nextPageLink(p.r, p.request, p.last, p.keys)
+		if err != nil {
+			return nil, err
+		}
+		p.done = true
+		p.nextLink = nextLink
+		return nil, nil
+	}
+	p.count++
+	p.last = fields
+	return fields, nil
+}
+
+// Build the link to the page following a full page of a collection, given
+// the last entity on the page. Returns "" if the page exhausts $top.
+func (service *GoDataService) nextPageLink(
+	r *http.Request,
+	request *GoDataRequest,
+	last map[string]*GoDataResponseField,
+	keys []string,
+) (string, error) {
+	size := request.PageSize
+	top := -1
+	if request.Query.Top != nil {
+		top = int(*request.Query.Top)
+		if top <= size {
+			// $top is exhausted by this page
+			return "", nil
+		}
+	}
+
+	skiptoken, err := newSkipToken(last, request.Query.OrderBy, keys)
+	if err != nil {
+		return "", err
+	}
+
+	query := r.URL.Query()
+	query.Set("$skiptoken", skiptoken.RawValue)
+	// the skip token already positions the next page past any skipped entities
+	query.Del("$skip")
+	if top >= 0 {
+		query.Set("$top", strconv.Itoa(top-size))
+	}
+	// the resource path is already escaped
+	next, err := url.Parse(service.resourcePath(request))
+	if err != nil {
+		return "", InternalServerError("Cannot build a link to the next page").SetCause(err)
+	}
+	next.RawQuery = encodeQuery(query)
+	return service.BaseUrl.ResolveReference(next).String(), nil
+}
+
+// Encode a URL query like url.Values.Encode, but keep the $ prefix of system
+// query options readable.
+func encodeQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		key := url.QueryEscape(name)
+		if strings.HasPrefix(key, "%24") {
+			key = "$" + key[len("%24"):]
+		}
+		for _, value := range query[name] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(value))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,388 @@
+package godata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A provider that returns ten customers, named A to J, in order of their name,
+// and records the requests it receives.
+type PagedCustomerProvider struct {
+	DummyProvider
+	// Apply the skip token of the request, as a provider seeking directly to
+	// the page would.
+	seek     bool
+	requests []*GoDataRequest
+}
+
+func (p *PagedCustomerProvider) GetEntityCollection(r *GoDataRequest) (*GoDataResponseField, error) {
+	p.requests = append(p.requests, r)
+	customers := []*GoDataResponseField{}
+	for i := 0; i < 10; i++ {
+		name := string(rune('A' + i))
+		if p.seek && r.Query.SkipToken != nil && name <= r.Query.SkipToken.Key["Name"].(string) {
+			continue
+		}
+		customers = append(customers, &GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"Name": {Value: name},
+			"Age":  {Value: 20 + i%3},
+		}})
+	}
+	return &GoDataResponseField{Value: customers}, nil
+}
+
+type testPage struct {
+	NextLink string `json:"@odata.nextLink"`
+	Value    []struct {
+		Name string
+		Age  int
+	} `json:"value"`
+}
+
+// Request a page of customers, and return the names on the page.
+func getPage(t *testing.T, service *GoDataService, target string, prefer string) (*testPage, string) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	if prefer != "" {
+		r.Header.Set("Prefer", prefer)
+	}
+	service.GoDataHTTPHandler(w, r)
+	if w.Code != 200 {
+		t.Fatalf("%s: expected status 200, got %d: %s", target, w.Code, w.Body.String())
+	}
+
+	var page testPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	names := ""
+	for _, customer := range page.Value {
+		names += customer.Name
+	}
+	return &page, names
+}
+
+// Follow the next links from a collection request, and return the names on
+// every page.
+func getPages(t *testing.T, service *GoDataService, target string, prefer string) []string {
+	pages := []string{}
+	for target != "" && len(pages) < 20 {
+		page, names := getPage(t, service, target, prefer)
+		pages = append(pages, names)
+		target = page.NextLink
+	}
+	return pages
+}
+
+func TestPagingMaxPageSize(t *testing.T) {
+	for _, seek := range []bool{false, true} {
+		provider := &PagedCustomerProvider{seek: seek}
+		service := buildWritableService(t, provider)
+		service.MaxPageSize = 4
+
+		pages := getPages(t, service, "/odata/Customers", "")
+		if fmt.Sprint(pages) != "[ABCD EFGH IJ]" {
+			t.Errorf("seek %v: unexpected pages %v", seek, pages)
+		}
+
+		for i, request := range provider.requests {
+			if request.PageSize != 4 {
+				t.Errorf("seek %v: provider received page size %d", seek, request.PageSize)
+			}
+			if (i == 0) != (request.Query.SkipToken == nil) {
+				t.Errorf("seek %v: request %d has skip token %v", seek, i, request.Query.SkipToken)
+			}
+		}
+		if len(provider.requests) == 3 && provider.requests[2].Query.SkipToken.Key["Name"] != "H" {
+			t.Errorf("seek %v: last page starts after %v", seek, provider.requests[2].Query.SkipToken.Key)
+		}
+	}
+}
+
+func TestPagingPreference(t *testing.T) {
+	service := buildWritableService(t, &PagedCustomerProvider{})
+
+	// without a maximum page size, collections are not paged
+	_, names := getPage(t, service, "/odata/Customers", "")
+	if names != "ABCDEFGHIJ" {
+		t.Errorf("Unexpected customers %s", names)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/odata/Customers", nil)
+	r.Header.Set("Prefer", "odata.maxpagesize=3")
+	service.GoDataHTTPHandler(w, r)
+	if applied := w.Header().Get("Preference-Applied"); applied != "odata.maxpagesize=3" {
+		t.Errorf("Preference-Applied is %q", applied)
+	}
+
+	pages := getPages(t, service, "/odata/Customers", "odata.maxpagesize=3")
+	if fmt.Sprint(pages) != "[ABC DEF GHI J]" {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+
+	// the service maximum wins over a larger preference
+	service.MaxPageSize = 5
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/odata/Customers", nil)
+	r.Header.Set("Prefer", "odata.maxpagesize=8")
+	service.GoDataHTTPHandler(w, r)
+	if applied := w.Header().Get("Preference-Applied"); applied != "" {
+		t.Errorf("Preference-Applied is %q", applied)
+	}
+	pages = getPages(t, service, "/odata/Customers", "odata.maxpagesize=8")
+	if fmt.Sprint(pages) != "[ABCDE FGHIJ]" {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+}
+
+func TestPagingQueryOptions(t *testing.T) {
+	service := buildWritableService(t, &PagedCustomerProvider{})
+	service.MaxPageSize = 3
+
+	// the next link keeps the other query options, and counts down $top
+	page, _ := getPage(t, service, "/odata/Customers?$top=7&$skip=0&$filter=Age%20gt%200", "")
+	if !strings.HasPrefix(page.NextLink, "http://localhost/odata/Customers?") {
+		t.Errorf("Unexpected next link %s", page.NextLink)
+	}
+	for _, option := range []string{"$filter=Age+gt+0", "$top=4", "$skiptoken="} {
+		if !strings.Contains(page.NextLink, option) {
+			t.Errorf("Next link %s does not contain %s", page.NextLink, option)
+		}
+	}
+	if strings.Contains(page.NextLink, "$skip=") {
+		t.Errorf("Next link %s contains $skip", page.NextLink)
+	}
+
+	// a $top within the page size needs no next link
+	page, _ = getPage(t, service, "/odata/Customers?$top=2", "")
+	if page.NextLink != "" {
+		t.Errorf("Unexpected next link %s", page.NextLink)
+	}
+}
+
+func TestPagingOrderBy(t *testing.T) {
+	service := buildWritableService(t, &PagedCustomerProvider{})
+	service.MaxPageSize = 4
+
+	page, _ := getPage(t, service, "/odata/Customers?$orderby=Age%20desc", "")
+	start := strings.Index(page.NextLink, "$skiptoken=") + len("$skiptoken=")
+	skiptoken, err := ParseSkipTokenString(context.Background(), page.NextLink[start:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the fourth customer, D, is 20
+	if len(skiptoken.OrderByValues) != 1 || skiptoken.OrderByValues[0] != 20 {
+		t.Errorf("Unexpected $orderby values %v", skiptoken.OrderByValues)
+	}
+	if skiptoken.Key["Name"] != "D" {
+		t.Errorf("Unexpected key %v", skiptoken.Key)
+	}
+
+	// a skip token issued for another $orderby is rejected
+	status, body := serveError(t, service, "/odata/Customers?$skiptoken="+skiptoken.RawValue)
+	if status != 400 || body.Error.Target != "$skiptoken" {
+		t.Errorf("Expected 400 for $skiptoken, got %d: %+v", status, body.Error)
+	}
+
+	status, body = serveError(t, service, "/odata/Customers?$skiptoken=bogus!")
+	if status != 400 || body.Error.Target != "$skiptoken" {
+		t.Errorf("Expected 400 for $skiptoken, got %d: %+v", status, body.Error)
+	}
+}
+
+// A provider that returns six customers in order of the DateTimeOffset they
+// joined at, which is null for the first two and the same for the middle two.
+type JoinedCustomerProvider struct {
+	DummyProvider
+	requests []*GoDataRequest
+}
+
+func (p *JoinedCustomerProvider) GetEntityCollection(r *GoDataRequest) (*GoDataResponseField, error) {
+	p.requests = append(p.requests, r)
+	joined := []interface{}{
+		nil,
+		nil,
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC),
+	}
+	customers := []*GoDataResponseField{}
+	for i, value := range joined {
+		customers = append(customers, &GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"Name":   {Value: string(rune('A' + i))},
+			"Age":    {Value: 20},
+			"Joined": {Value: value},
+		}})
+	}
+	return &GoDataResponseField{Value: customers}, nil
+}
+
+func TestPagingOrderByDateTimeOffset(t *testing.T) {
+	provider := &JoinedCustomerProvider{}
+	service := buildWritableService(t, provider)
+	service.MaxPageSize = 2
+	customer, err := service.LookupEntityType("Customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := &GoDataProperty{Name: "Joined", Type: GoDataDateTimeOffset}
+	customer.Properties = append(customer.Properties, joined)
+	service.PropertyLookup[customer]["Joined"] = joined
+
+	pages := getPages(t, service, "/odata/Customers?$orderby=Joined", "")
+	if fmt.Sprint(pages) != "[AB CD EF]" {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+
+	// the provider is told to break ties by the key
+	for _, request := range provider.requests {
+		order := []string{}
+		for _, item := range request.PageOrder {
+			order = append(order, item.Field.Value+" "+item.Order)
+		}
+		if fmt.Sprint(order) != "[Joined asc Name asc]" {
+			t.Errorf("Unexpected page order %v", order)
+		}
+	}
+	// the skip token values have the types of their properties
+	if len(provider.requests) == 3 {
+		skiptoken := provider.requests[2].Query.SkipToken
+		if value, ok := skiptoken.OrderByValues[0].(time.Time); !ok || !value.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Unexpected $orderby values %v", skiptoken.OrderByValues)
+		}
+	}
+}
+
+func TestSkipTokenValue(t *testing.T) {
+	testCases := []struct {
+		edmType  string
+		value    interface{}
+		expected interface{}
+	}{
+		{GoDataGuid, [16]byte{0xab, 15: 1}, [16]byte{0xab, 15: 1}},
+		{GoDataDecimal, big.NewRat(-7, 4), big.NewRat(-7, 4)},
+		{GoDataDecimal, big.NewRat(25, 2), big.NewRat(25, 2)},
+		{GoDataInt64, int64(1) << 60, int64(1) << 60},
+		{GoDataDate, GoDataDateValue(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)), time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{GoDataDate, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{GoDataTimeOfDay, GoDataTimeOfDayValue(90 * time.Minute), GoDataTimeOfDayValue(90 * time.Minute)},
+		{GoDataDuration, 90 * time.Minute, 90 * time.Minute},
+		{GoDataBinary, []byte{1, 2, 255}, []byte{1, 2, 255}},
+		{GoDataString, "2020-01-02", "2020-01-02"},
+	}
+	for _, testCase := range testCases {
+		// a value written to a skip token is read back as the same value
+		raw, err := skipTokenJsonValue(testCase.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+		var decoded interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		value, err := skipTokenValue(testCase.edmType, decoded)
+		if err != nil {
+			t.Errorf("%s %s: %v", testCase.edmType, raw, err)
+			continue
+		}
+		if compareValues(value, testCase.expected) != 0 || reflect.TypeOf(value) != reflect.TypeOf(testCase.expected) {
+			t.Errorf("%s %s: got %#v, expected %#v", testCase.edmType, raw, value, testCase.expected)
+		}
+	}
+}
+
+// A provider of the test model that returns three orders for every customer,
+// and records the customer keys it receives.
+type CustomerOrdersProvider struct {
+	ModelProvider
+	customers []interface{}
+}
+
+func (p *CustomerOrdersProvider) GetEntityCollection(r *GoDataRequest) (*GoDataResponseField, error) {
+	name, _ := r.FirstSegment.GetKeyValue("Name")
+	p.customers = append(p.customers, name)
+	orders := []*GoDataResponseField{}
+	for i := 0; i < 3; i++ {
+		orders = append(orders, &GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"Id": {Value: [16]byte{15: byte(i)}},
+		}})
+	}
+	return &GoDataResponseField{Value: orders}, nil
+}
+
+func TestPagingNextLinkKey(t *testing.T) {
+	testCases := []struct {
+		keyAsSegment bool
+		target       string
+		next         string
+	}{
+		{false, "/odata/Customers('a%20b')/Orders", "http://localhost/odata/Customers('a%20b')/Orders?$skiptoken="},
+		{true, "/odata/Customers/a%20b/Orders", "http://localhost/odata/Customers/a%20b/Orders?$skiptoken="},
+	}
+	for _, testCase := range testCases {
+		metadata, err := buildTestModel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider := &CustomerOrdersProvider{ModelProvider: ModelProvider{metadata: metadata}}
+		service, err := BuildService(provider, "http://localhost/odata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.KeyAsSegment = testCase.keyAsSegment
+		service.MaxPageSize = 2
+
+		page, _ := getPage(t, service, testCase.target, "")
+		if !strings.HasPrefix(page.NextLink, testCase.next) {
+			t.Errorf("%s: unexpected next link %s", testCase.target, page.NextLink)
+		}
+		pages := getPages(t, service, testCase.target, "")
+		if len(pages) != 2 {
+			t.Errorf("%s: expected 2 pages, got %d", testCase.target, len(pages))
+		}
+		for _, customer := range provider.customers {
+			if customer != "a b" {
+				t.Errorf("%s: provider received customer %q", testCase.target, customer)
+			}
+		}
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	testCases := []struct {
+		a, b     interface{}
+		expected int
+	}{
+		{1, 2, -1},
+		{2, 1.5, 1},
+		{int64(1) << 60, (int64(1) << 60) + 1, -1},
+		{"a", "b", -1},
+		{"b", "b", 0},
+		{nil, 0, -1},
+		{nil, nil, 0},
+		{true, false, 1},
+		{[]byte{1}, []byte{2}, -1},
+		{big.NewRat(5, 2), 2, 1},
+		{big.NewRat(5, 2), 2.5, 0},
+		{[16]byte{1}, [16]byte{2}, -1},
+		{GoDataTimeOfDayValue(time.Hour), GoDataTimeOfDayValue(10 * time.Minute), 1},
+		{time.Date(2020, 1, 1, 1, 0, 0, 0, time.FixedZone("", 3600)), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 0},
+	}
+	for _, testCase := range testCases {
+		if c := compareValues(testCase.a, testCase.b); c != testCase.expected {
+			t.Errorf("compareValues(%v, %v) = %d, expected %d", testCase.a, testCase.b, c, testCase.expected)
+		}
+	}
+}
@@ -278,7 +278,7 @@ func (builder *MySQLGoDataProvider) ExposeManyToOne(a, b *MySQLGoDataEntity, aco
 	// as the key property in b so that it does not conflict with the property name
 	// given by aprop. A referential constraint will be added to the NavigationProperty
 	// in b that links back to this property in a.
-	constrainedProp := b.EntityType.Key.PropertyRef.Name
+	constrainedProp := b.EntityType.Key.PropertyRefs[0].Name
 	a.ExposeProperty(acol, constrainedProp, b.KeyType)
 	constraint := GoDataReferentialConstraint{Property: constrainedProp, ReferencedProperty: constrainedProp}
 	prop2.ReferentialConstraints = append(prop2.ReferentialConstraints, &constraint)
@@ -312,7 +312,7 @@ func (builder *MySQLGoDataProvider) BindProperty(a, b *MySQLGoDataEntitySet, apa
 // database to map to the property name in the OData entity, and the OData
 // type.
 func (entity *MySQLGoDataEntity) ExposeKey(colname, propname, t string) {
-	entity.EntityType.Key = &GoDataKey{PropertyRef: &GoDataPropertyRef{Name: propname}}
+	entity.EntityType.Key = &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: propname}}}
 	entity.KeyType = t
 	entity.ExposePrimitive(colname, propname, t)
 }
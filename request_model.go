@@ -15,6 +15,7 @@ const (
 	RequestKindPropertyValue
 	RequestKindRef
 	RequestKindCount
+	RequestKindBatch
 )
 
 type SemanticType int
@@ -31,6 +32,7 @@ const (
 	SemanticTypeRef
 	SemanticTypeCount
 	SemanticTypeMetadata
+	SemanticTypeBatch
 )
 
 type GoDataRequest struct {
@@ -38,6 +40,28 @@ type GoDataRequest struct {
 	LastSegment  *GoDataSegment
 	Query        *GoDataQuery
 	RequestKind  RequestKind
+	// The maximum number of entities in a page of a collection, or 0 if the
+	// collection is not paged. A provider that pages should return more than
+	// PageSize entities if more remain, e.g. by fetching PageSize+1, so the
+	// service knows to link to the next page.
+	PageSize int
+	// The order of the entities of a paged collection, which a provider must
+	// return them in for the service to page them correctly: the $orderby
+	// items, followed by the key properties they do not include, in
+	// ascending order, so that every entity has a distinct position. Null
+	// values sort before all other values. The skip token of the next page
+	// is a position in this order. nil if the collection is not paged.
+	PageOrder []*OrderByItem
+	// The ETags of the If-Match and If-None-Match headers of the request, or
+	// nil if it has none. The service checks them against the ETag returned
+	// by GetEntity before it updates or deletes an entity, but the entity may
+	// change in between. A provider that must not overwrite concurrent
+	// changes should make the change only if the entity still satisfies these
+	// preconditions, in the same operation, e.g. with the version in the
+	// WHERE clause of an UPDATE, and otherwise return a
+	// PreconditionFailedError. The wildcard * matches any existing entity.
+	IfMatch     []string
+	IfNoneMatch []string
 }
 
 // Represents a segment (slash-separated) part of the URI path. Each segment
@@ -61,6 +85,18 @@ type GoDataSegment struct {
 	// identifier, it will be nil.
 	Identifier *GoDataIdentifier
 
+	// The navigation property this segment follows from the entity addressed
+	// by the previous segment, e.g. Orders in Customers(1)/Orders, or nil if
+	// it is not a navigation segment. The SemanticReference of a navigation
+	// segment is the entity set the navigation property is bound to.
+	NavigationProperty *GoDataNavigationProperty
+
+	// The values of the key predicate of this segment, or nil if it has none.
+	// Once the segment is semanticized, each value is named after the key
+	// property it identifies and has a typed Value, and the values are in the
+	// order the key properties are declared.
+	Key []*GoDataKeyValue
+
 	// The next segment in the path.
 	Next *GoDataSegment
 	// The previous segment in the path.
@@ -81,6 +117,7 @@ type GoDataQuery struct {
 	Search      *GoDataSearchQuery
 	Compute     *GoDataComputeQuery
 	Format      *GoDataFormatQuery
+	SkipToken   *GoDataSkipTokenQuery
 }
 
 // GoDataExpression encapsulates the tree representation of an expression
@@ -138,7 +175,72 @@ type GoDataComputeQuery struct {
 	RawValue string
 }
 
+// Stores the format of a response, as given by $format or negotiated with
+// the Accept header of a request.
 type GoDataFormatQuery struct {
+	// The media type of the response, e.g. application/json
+	MediaType string
+	// The amount of control information in JSON responses: minimal, full or
+	// none. Empty means minimal.
+	Metadata string
+	// Whether the client prefers a response it can process as a stream,
+	// with control information before the data it describes.
+	Streaming bool
+	// Whether Int64 and Decimal values are written as strings in JSON
+	// responses, for clients that cannot represent them as IEEE 754 numbers.
+	IEEE754Compatible bool
+	// The raw format string
+	RawValue string
+}
+
+// Stores the position in a collection after which the next page starts, as
+// decoded from a $skiptoken issued in an @odata.nextLink. The position is
+// given by the $orderby values and key of the last entity on the previous
+// page, so a provider can seek directly to the page, e.g. with a WHERE clause,
+// instead of skipping over every preceding entity. A provider that supports it
+// should apply the skip token before $top. Once the request is semanticized,
+// the values have the Go types that GoDataSegment.GetKeyValue returns for the
+// types of their properties, e.g. a time.Time for an Edm.DateTimeOffset.
+type GoDataSkipTokenQuery struct {
+	// The values of the $orderby properties of the last entity, in the order
+	// of the $orderby items.
+	OrderByValues []interface{}
+	// The values of the key properties of the last entity, by name.
+	Key map[string]interface{}
+	// The raw skip token string
+	RawValue string
+	// The decoded skip token, whose values are converted to the types of
+	// their properties once the query is semanticized.
+	rawToken *skipTokenJson
+}
+
+// Return the value of a key property given in the key predicate of this
+// segment, converted to the Go type of the property. The segment must have
+// been semanticized.
+func (segment *GoDataSegment) GetKeyValue(name string) (interface{}, bool) {
+	for _, value := range segment.Key {
+		if value.Name == name {
+			return value.Value, true
+		}
+	}
+	return nil, false
+}
+
+// A value of a key predicate, e.g. Line=2 in OrderLines(OrderId=1,Line=2).
+type GoDataKeyValue struct {
+	// The name of the key property. It is empty for a key given positionally,
+	// e.g. Customers('ALFKI'), until the segment is semanticized.
+	Name string
+	// The literal as it appears in the URL, e.g. 'O''Neil' or Shop.Status'Open'.
+	Literal string
+	// The literal, as read by the expression tokenizer. Once the segment is
+	// semanticized, the token refers to the key property.
+	Token *Token
+	// The value of the literal, converted to the Go type of its key property
+	// when the segment is semanticized, e.g. an int64 for an Edm.Int32 or a
+	// string without quotes for an Edm.String. See parseKeyLiteral for the
+	// other types.
+	Value interface{}
 }
 
 // Check if this identifier has more than one key/value pair.
@@ -150,13 +252,18 @@ func (id *GoDataIdentifier) HasMultiple() bool {
 	return count > 1
 }
 
-// Return the first key in the map. This is how you should get the identifier
-// for single values, e.g. when the path is Employee(1), etc.
+// Return the first key in the map, in sorted order. This is how you should get
+// the identifier for single values, e.g. when the path is Employee(1), etc.
+// The typed values of a semanticized segment are available from
+// GoDataSegment.GetKeyValue.
 func (id *GoDataIdentifier) Get() string {
+	first, found := "", false
 	for k := range map[string]string(*id) {
-		return k
+		if !found || k < first {
+			first, found = k, true
+		}
 	}
-	return ""
+	return first
 }
 
 // Return a specific value for a specific key.
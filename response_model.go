@@ -2,7 +2,10 @@ package godata
 
 import (
 	"bytes"
-	"strconv"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"time"
 )
 
 // A response is a dictionary of keys to their corresponding fields. This will
@@ -14,11 +17,18 @@ type GoDataResponse struct {
 // Serialize the result as JSON for sending to the client. If an error
 // occurs during the serialization, it will be returned.
 func (r *GoDataResponse) Json() ([]byte, error) {
-	result, err := prepareJsonDict(r.Fields)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := r.WriteJson(&buf); err != nil {
 		return nil, err
 	}
-	return result, nil
+	return buf.Bytes(), nil
+}
+
+// Serialize the result as JSON directly to a writer, without building the
+// whole response in memory. If an error occurs, part of the response may
+// already have been written.
+func (r *GoDataResponse) WriteJson(w io.Writer) error {
+	return writeJsonDict(w, r.Fields)
 }
 
 // A response that is a primitive JSON type or a list or a dictionary. When
@@ -29,76 +39,152 @@ type GoDataResponseField struct {
 	Value interface{}
 }
 
-// Convert the response field to a JSON serialized form. If the type is not
-// string, []byte, int, float64, map[string]*GoDataResponseField, or
-// []*GoDataResponseField, then an error will be thrown.
-func (f *GoDataResponseField) Json() ([]byte, error) {
-	switch f.Value.(type) {
-	case string:
-		return prepareJsonString([]byte(f.Value.(string)))
-	case []byte:
-		return prepareJsonString(f.Value.([]byte))
-	case int:
-		return []byte(strconv.Itoa(f.Value.(int))), nil
-	case float64:
-		return []byte(strconv.FormatFloat(f.Value.(float64), 'f', -1, 64)), nil
-	case map[string]*GoDataResponseField:
-		return prepareJsonDict(f.Value.(map[string]*GoDataResponseField))
-	case []*GoDataResponseField:
-		return prepareJsonList(f.Value.([]*GoDataResponseField))
-	default:
-		return nil, InternalServerError("Response field type not recognized.")
+// Copy the properties of an entity into a new map, so that control
+// information can be added to a response without modifying the entity
+// returned by a provider, which may share it between requests.
+func copyFields(fields map[string]*GoDataResponseField) map[string]*GoDataResponseField {
+	result := make(map[string]*GoDataResponseField, len(fields)+1)
+	for name, field := range fields {
+		result[name] = field
 	}
+	return result
 }
 
-func prepareJsonString(s []byte) ([]byte, error) {
-	// escape double quotes
-	s = bytes.Replace(s, []byte("\""), []byte("\\\""), -1)
+// The value of an Edm.Date property, written as e.g. 2006-01-02. The time of
+// day and the time zone are ignored.
+type GoDataDateValue time.Time
+
+// The value of an Edm.TimeOfDay property, as the time since midnight, written
+// as e.g. 15:04:05.5.
+type GoDataTimeOfDayValue time.Duration
+
+// Convert the response field to a JSON serialized form. The value is written
+// in the wire format of the Edm type it corresponds to:
+//
+//   - nil as null, and strings, booleans and numbers of any size as such;
+//   - NaN and infinite floats as the strings NaN, INF and -INF;
+//   - []byte as base64url (Edm.Binary), [16]byte as a GUID (Edm.Guid);
+//   - time.Time as RFC 3339 (Edm.DateTimeOffset), GoDataDateValue as Edm.Date,
+//     GoDataTimeOfDayValue as Edm.TimeOfDay, time.Duration as an ISO 8601
+//     duration (Edm.Duration);
+//   - map[string]*GoDataResponseField as an object, and
+//     []*GoDataResponseField as an array;
+//   - values implementing json.Marshaler or encoding.TextMarshaler as they
+//     marshal themselves;
+//   - pointers as the value they point to, and other slices and maps with
+//     string keys as arrays and objects.
+//
+// If the type is not supported, then an error will be thrown.
+func (f *GoDataResponseField) Json() ([]byte, error) {
 	var buf bytes.Buffer
-	buf.WriteByte('"')
-	buf.Write(s)
-	buf.WriteByte('"')
+	if err := f.WriteJson(&buf); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
-func prepareJsonDict(d map[string]*GoDataResponseField) ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteByte('{')
-	count := 0
-	for k, v := range d {
-		buf.WriteByte('"')
-		buf.Write([]byte(k))
-		buf.WriteByte('"')
-		buf.WriteByte(':')
-		field, err := v.Json()
-		if err != nil {
-			return nil, err
-		}
-		buf.Write(field)
-		count++
-		if count < len(d) {
-			buf.WriteByte(',')
-		}
+// Serialize the response field as JSON directly to a writer. The supported
+// types are the same as for Json. If an error occurs, part of the field may
+// already have been written.
+func (f *GoDataResponseField) WriteJson(w io.Writer) error {
+	if f == nil {
+		return writeJsonRaw(w, "null")
 	}
-	buf.WriteByte('}')
-	return buf.Bytes(), nil
+	return writeJsonValue(w, f.Value)
 }
 
-func prepareJsonList(l []*GoDataResponseField) ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteByte('[')
-	count := 0
-	for _, v := range l {
-		field, err := v.Json()
+// Writes the entities of a collection one at a time, in a format with one
+// line per entity, such as CSV or NDJSON. Nothing is buffered beyond the
+// current entity, so large collections can be streamed to the client.
+type GoDataRowWriter interface {
+	// Write a single entity, given as a map from property names to values.
+	WriteEntity(map[string]*GoDataResponseField) error
+	// Finish writing the collection.
+	Close() error
+}
+
+// Create a row writer that writes entities as CSV records. The first record
+// is a header with the given column names, and each entity is written as the
+// values of those properties, in the same order.
+func NewCsvWriter(w io.Writer, columns []string) (GoDataRowWriter, error) {
+	writer := &csvRowWriter{csv.NewWriter(w), columns}
+	if err := writer.writer.Write(columns); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+type csvRowWriter struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func (c *csvRowWriter) WriteEntity(entity map[string]*GoDataResponseField) error {
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		value, err := csvValue(entity[column])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		buf.Write(field)
-		count++
-		if count < len(l) {
-			buf.WriteByte(',')
+		record[i] = value
+	}
+	if err := c.writer.Write(record); err != nil {
+		return err
+	}
+	// write every record through, rather than in large blocks
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvRowWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// Convert a response field to the text of a CSV cell. Values written as JSON
+// strings, e.g. dates, are written without quotes, and structured values are
+// written as JSON.
+func csvValue(field *GoDataResponseField) (string, error) {
+	if field == nil || field.Value == nil {
+		return "", nil
+	}
+	value, err := field.Json()
+	if err != nil {
+		return "", err
+	}
+	if len(value) > 0 && value[0] == '"' {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return "", err
 		}
+		return text, nil
 	}
-	buf.WriteByte(']')
-	return buf.Bytes(), nil
+	return string(value), nil
+}
+
+// Create a row writer that writes entities as newline-delimited JSON, i.e. one
+// JSON object per line. The properties of each entity are written in the
+// given order, after any control information.
+func NewNdjsonWriter(w io.Writer, order []string) GoDataRowWriter {
+	return &ndjsonRowWriter{w, order}
+}
+
+type ndjsonRowWriter struct {
+	writer io.Writer
+	order  []string
+}
+
+func (n *ndjsonRowWriter) WriteEntity(entity map[string]*GoDataResponseField) error {
+	// encode the entity before writing it, so a failed entity writes nothing
+	var line bytes.Buffer
+	if err := writeJsonObject(&line, entity, n.order); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	_, err := n.writer.Write(line.Bytes())
+	return err
+}
+
+func (n *ndjsonRowWriter) Close() error {
+	return nil
 }
@@ -0,0 +1,311 @@
+package godata
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Convert a Go value to a response field, so providers need not build maps of
+// response fields by hand. Structs become maps from property names to values,
+// slices and arrays become lists, and maps with string keys become maps.
+// Values such as strings, numbers and time.Time are used as they are.
+//
+// The properties of a struct are its exported fields, and the fields of its
+// embedded structs. The name of a property and its options are given by the
+// odata tag of the field, e.g.
+//
+//	Name   string  `odata:"FullName"`      // a property named FullName
+//	Email  string  `odata:",omitempty"`    // left out if it is empty
+//	Orders []Order `odata:",navigation"`   // a navigation property
+//	ETag   string  `odata:"@odata.etag"`   // control information
+//	Secret string  `odata:"-"`             // never written
+//
+// Fields without a tag keep their Go name. Nested structs that are not
+// navigation properties are complex values.
+func NewResponseField(value interface{}) (*GoDataResponseField, error) {
+	return reflectResponseField(reflect.ValueOf(value), nil, 0)
+}
+
+// Convert an entity or a collection of entities to a response field for the
+// response to a request, as NewResponseField does. Only the properties chosen
+// by $select are included, and navigation properties are only included if
+// they are chosen by $expand, along with the properties chosen by the
+// $select and $expand options of that expand item.
+func NewEntityResponseField(request *GoDataRequest, value interface{}) (*GoDataResponseField, error) {
+	var selection *reflectSelection
+	if request.Query != nil {
+		selection = newReflectSelection(request.Query.Select, request.Query.Expand)
+	} else {
+		selection = newReflectSelection(nil, nil)
+	}
+	return reflectResponseField(reflect.ValueOf(value), selection, 0)
+}
+
+// The properties of an entity chosen by $select and $expand. A nil selection
+// chooses every property, including navigation properties.
+type reflectSelection struct {
+	// The names of the selected structural properties, or nil for all of
+	// them.
+	selected map[string]bool
+	// The expanded navigation properties, by name.
+	expanded map[string]*ExpandItem
+}
+
+func newReflectSelection(sel *GoDataSelectQuery, expand *GoDataExpandQuery) *reflectSelection {
+	selection := &reflectSelection{expanded: map[string]*ExpandItem{}}
+	if sel != nil {
+		selection.selected = map[string]bool{}
+		for _, item := range sel.SelectItems {
+			if len(item.Segments) == 0 {
+				continue
+			}
+			if item.Segments[0].Value == "*" {
+				selection.selected = nil
+				break
+			}
+			selection.selected[item.Segments[0].Value] = true
+		}
+	}
+	if expand != nil {
+		for _, item := range expand.ExpandItems {
+			if len(item.Path) > 0 {
+				selection.expanded[item.Path[0].Value] = item
+			}
+		}
+	}
+	return selection
+}
+
+// A property of a struct type, as converted to a response field.
+type structProperty struct {
+	name string
+	// The index of the field, as for reflect.Value.FieldByIndex.
+	index      []int
+	omitEmpty  bool
+	navigation bool
+	// The options of the odata tag of the field, e.g. omitempty, or
+	// maxlength=10, which has the value "10".
+	options map[string]string
+}
+
+// The properties of struct types, by type.
+var structPropertyCache sync.Map
+
+var (
+	responseFieldType = reflect.TypeOf((*GoDataResponseField)(nil))
+	timeType          = reflect.TypeOf(time.Time{})
+	dateValueType     = reflect.TypeOf(GoDataDateValue{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Get the properties of a struct type, in the order they are declared. If
+// several fields have the same name, the least deeply embedded one wins, as
+// in encoding/json.
+func structProperties(t reflect.Type) []*structProperty {
+	if cached, ok := structPropertyCache.Load(t); ok {
+		return cached.([]*structProperty)
+	}
+
+	all := collectStructProperties(t, nil, map[reflect.Type]bool{t: true})
+	shallowest := map[string]int{}
+	for _, prop := range all {
+		if depth, ok := shallowest[prop.name]; !ok || len(prop.index) < depth {
+			shallowest[prop.name] = len(prop.index)
+		}
+	}
+	props := make([]*structProperty, 0, len(all))
+	for _, prop := range all {
+		if depth, ok := shallowest[prop.name]; ok && depth == len(prop.index) {
+			props = append(props, prop)
+			// later fields with the same name at the same depth are dropped
+			delete(shallowest, prop.name)
+		}
+	}
+
+	structPropertyCache.Store(t, props)
+	return props
+}
+
+func collectStructProperties(t reflect.Type, index []int, visited map[reflect.Type]bool) []*structProperty {
+	props := []*structProperty{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("odata")
+		if tag == "-" {
+			continue
+		}
+		name, options := parseStructTag(tag)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if !visited[embedded] {
+					visited[embedded] = true
+					props = append(props, collectStructProperties(embedded, fieldIndex, visited)...)
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props = append(props, &structProperty{
+			name:       name,
+			index:      fieldIndex,
+			omitEmpty:  hasTagOption(options, "omitempty"),
+			navigation: hasTagOption(options, "navigation"),
+			options:    options,
+		})
+	}
+	return props
+}
+
+// Split an odata struct tag into the property name and its options. An option
+// may have a value, as in maxlength=10; options without one have the value "".
+func parseStructTag(tag string) (string, map[string]string) {
+	parts := strings.Split(tag, ",")
+	options := map[string]string{}
+	for _, option := range parts[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		options[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(parts[0]), options
+}
+
+func hasTagOption(options map[string]string, name string) bool {
+	_, ok := options[name]
+	return ok
+}
+
+// Check if a type is written as a single value rather than converted, e.g.
+// time.Time, which is a struct.
+func isReflectLeaf(t reflect.Type) bool {
+	return t == timeType || t == dateValueType ||
+		t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+// The maximum depth of the values converted by NewResponseField, beyond which
+// a value is assumed to refer to itself.
+const maxReflectDepth = 100
+
+func reflectResponseField(v reflect.Value, selection *reflectSelection, depth int) (*GoDataResponseField, error) {
+	if depth > maxReflectDepth {
+		return nil, InternalServerError("The value is too deeply nested to be converted to a response field; " +
+			"it may contain a cycle")
+	}
+	if !v.IsValid() {
+		return &GoDataResponseField{Value: nil}, nil
+	}
+	if v.Type() == responseFieldType {
+		if v.IsNil() {
+			return &GoDataResponseField{Value: nil}, nil
+		}
+		return v.Interface().(*GoDataResponseField), nil
+	}
+	if isReflectLeaf(v.Type()) {
+		return &GoDataResponseField{Value: v.Interface()}, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return &GoDataResponseField{Value: nil}, nil
+		}
+		return reflectResponseField(v.Elem(), selection, depth)
+	case reflect.Struct:
+		return reflectStruct(v, selection, depth)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// binary data
+			return &GoDataResponseField{Value: v.Interface()}, nil
+		}
+		list := make([]*GoDataResponseField, v.Len())
+		for i := range list {
+			field, err := reflectResponseField(v.Index(i), selection, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = field
+		}
+		return &GoDataResponseField{Value: list}, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, InternalServerError("Only maps with string keys can be converted to response fields")
+		}
+		if v.IsNil() {
+			return &GoDataResponseField{Value: nil}, nil
+		}
+		fields := make(map[string]*GoDataResponseField, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			field, err := reflectResponseField(iter.Value(), nil, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields[iter.Key().String()] = field
+		}
+		return &GoDataResponseField{Value: fields}, nil
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil, InternalServerError("Values of type " + v.Type().String() + " cannot be converted to response fields")
+	default:
+		return &GoDataResponseField{Value: v.Interface()}, nil
+	}
+}
+
+func reflectStruct(v reflect.Value, selection *reflectSelection, depth int) (*GoDataResponseField, error) {
+	fields := map[string]*GoDataResponseField{}
+	for _, prop := range structProperties(v.Type()) {
+		value, ok := fieldByIndex(v, prop.index)
+		if !ok || (prop.omitEmpty && value.IsZero()) {
+			continue
+		}
+
+		// the selection of a complex value includes all of its properties
+		var nested *reflectSelection
+		if selection != nil && !strings.Contains(prop.name, "@") {
+			if prop.navigation {
+				item, ok := selection.expanded[prop.name]
+				if !ok {
+					continue
+				}
+				nested = newReflectSelection(item.Select, item.Expand)
+			} else if selection.selected != nil && !selection.selected[prop.name] {
+				continue
+			}
+		}
+
+		field, err := reflectResponseField(value, nested, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		fields[prop.name] = field
+	}
+	return &GoDataResponseField{Value: fields}, nil
+}
+
+// Get a field of a struct by its index, as reflect.Value.FieldByIndex, but
+// report a field of a nil embedded struct as missing rather than panic.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
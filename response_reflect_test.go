@@ -0,0 +1,131 @@
+package godata
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testAudit struct {
+	CreatedBy string
+}
+
+type testAddress struct {
+	Street string
+	City   string
+}
+
+type testOrder struct {
+	Id       string
+	Customer *testCustomer `odata:",navigation"`
+}
+
+type testCustomer struct {
+	testAudit
+	Name    string `odata:"FullName"`
+	Age     int    `odata:",omitempty"`
+	Email   string `odata:",omitempty"`
+	Secret  string `odata:"-"`
+	Address testAddress
+	Tags    []string
+	Joined  time.Time
+	Orders  []testOrder `odata:",navigation"`
+	ETag    string      `odata:"@odata.etag,omitempty"`
+	private string
+}
+
+func TestNewResponseField(t *testing.T) {
+	customer := &testCustomer{
+		testAudit: testAudit{"admin"},
+		Name:      "Bob",
+		Secret:    "hunter2",
+		Address:   testAddress{"Main St", "Springfield"},
+		Tags:      []string{"vip"},
+		Joined:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Orders:    []testOrder{{Id: "1"}},
+		ETag:      `W/"1"`,
+		private:   "hidden",
+	}
+	field, err := NewResponseField(customer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := field.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := `{"@odata.etag":"W/\"1\"","Address":{"City":"Springfield","Street":"Main St"},"CreatedBy":"admin",` +
+		`"FullName":"Bob","Joined":"2020-01-02T03:04:05Z","Orders":[{"Customer":null,"Id":"1"}],"Tags":["vip"]}`
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+
+	field, err = NewResponseField([]map[string]interface{}{{"a": 1}, nil})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result, _ := field.Json(); string(result) != `[{"a":1},null]` {
+		t.Errorf("Unexpected list %s", result)
+	}
+
+	// navigation properties refer back to the customer
+	customer.Orders[0].Customer = customer
+	if _, err := NewResponseField(customer); err == nil {
+		t.Error("Expected an error for a cycle")
+	}
+
+	if _, err := NewResponseField(map[int]string{1: "a"}); err == nil {
+		t.Error("Expected an error for a map with integer keys")
+	}
+}
+
+func TestNewEntityResponseField(t *testing.T) {
+	ctx := httptest.NewRequest("GET", "/", nil).Context()
+	sel, err := ParseSelectString(ctx, "FullName,Address")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expand, err := ParseExpandString(ctx, "Orders($select=Id;$expand=Customer($select=Age))")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request := &GoDataRequest{Query: &GoDataQuery{Select: sel, Expand: expand}}
+
+	customer := testCustomer{
+		Name:    "Bob",
+		Age:     42,
+		Address: testAddress{City: "Springfield"},
+		Tags:    []string{"vip"},
+	}
+	customer.Orders = []testOrder{{Id: "1", Customer: &customer}}
+	field, err := NewEntityResponseField(request, []testCustomer{customer})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := field.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := `[{"Address":{"City":"Springfield","Street":""},"FullName":"Bob",` +
+		`"Orders":[{"Customer":{"Age":42},"Id":"1"}]}]`
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+
+	// without $expand, navigation properties are left out
+	field, err = NewEntityResponseField(&GoDataRequest{Query: &GoDataQuery{}}, testOrder{Id: "2", Customer: &customer})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result, _ := field.Json(); string(result) != `{"Id":"2"}` {
+		t.Errorf("Unexpected entity %s", result)
+	}
+}
@@ -74,7 +74,8 @@ func SemanticizeSelectQuery(sel *GoDataSelectQuery, service *GoDataService, enti
 		}
 
 		if item.Segments[0].Value == "*" {
-			for _, prop := range service.PropertyLookup[entity] {
+			// in declaration order, so the order of the properties is stable
+			for _, prop := range entity.Properties {
 				newItems = append(newItems, &SelectItem{[]*Token{{Value: prop.Name}}})
 			}
 		} else {
@@ -2,15 +2,32 @@ package godata
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	ODataFieldContext string = "@odata.context"
-	ODataFieldCount   string = "@odata.count"
-	ODataFieldValue   string = "value"
+	ODataFieldContext        string = "@odata.context"
+	ODataFieldCount          string = "@odata.count"
+	ODataFieldValue          string = "value"
+	ODataFieldETag           string = "@odata.etag"
+	ODataFieldNextLink       string = "@odata.nextLink"
+	ODataFieldId             string = "@odata.id"
+	ODataFieldType           string = "@odata.type"
+	ODataFieldNavigationLink string = "@odata.navigationLink"
+)
+
+// The kinds of resources listed in the service document.
+const (
+	ServiceKindEntitySet      string = "EntitySet"
+	ServiceKindSingleton      string = "Singleton"
+	ServiceKindFunctionImport string = "FunctionImport"
 )
 
 // The basic interface for a GoData provider. All providers must implement
@@ -18,6 +35,11 @@ const (
 type GoDataProvider interface {
 	// Request a single entity from the provider. Should return a response field
 	// that contains the value mapping properties to values for the entity.
+	// The ETag of the entity may be given as a string in the @odata.etag
+	// field, in which case clients can make conditional requests for the
+	// entity, e.g. to avoid overwriting the changes of another client. The
+	// service does not modify the fields returned by a provider, so a
+	// provider may share them between requests, e.g. from a cache.
 	GetEntity(*GoDataRequest) (*GoDataResponseField, error)
 	// Request a collection of entities from the provider. Should return a
 	// response field that contains the value of a slice of every entity in the
@@ -30,6 +52,124 @@ type GoDataProvider interface {
 	GetMetadata() *GoDataMetadata
 }
 
+// A provider whose requests carry the context of the HTTP request they were
+// made for. The context is canceled when the client goes away or the request
+// timeout of the service expires, so a provider should stop any work for the
+// request, such as a database query, when it is done. A GoDataProvider can be
+// used as a GoDataContextProvider with AdaptProvider.
+type GoDataContextProvider interface {
+	// Request a single entity from the provider, as GoDataProvider.GetEntity.
+	GetEntity(context.Context, *GoDataRequest) (*GoDataResponseField, error)
+	// Request a collection of entities from the provider, as
+	// GoDataProvider.GetEntityCollection.
+	GetEntityCollection(context.Context, *GoDataRequest) (*GoDataResponseField, error)
+	// Request the number of entities in a collection, as
+	// GoDataProvider.GetCount.
+	GetCount(context.Context, *GoDataRequest) (int, error)
+	// Get the object model representation from the provider.
+	GetMetadata() *GoDataMetadata
+}
+
+// Use a GoDataProvider as a GoDataContextProvider. The context of each request
+// is ignored. The optional interfaces implemented by the given provider, e.g.
+// GoDataWritableProvider, are still used by the service.
+func AdaptProvider(provider GoDataProvider) GoDataContextProvider {
+	return &providerAdapter{provider}
+}
+
+type providerAdapter struct {
+	provider GoDataProvider
+}
+
+func (a *providerAdapter) GetEntity(ctx context.Context, request *GoDataRequest) (*GoDataResponseField, error) {
+	return a.provider.GetEntity(request)
+}
+
+func (a *providerAdapter) GetEntityCollection(ctx context.Context, request *GoDataRequest) (*GoDataResponseField, error) {
+	return a.provider.GetEntityCollection(request)
+}
+
+func (a *providerAdapter) GetCount(ctx context.Context, request *GoDataRequest) (int, error) {
+	return a.provider.GetCount(request)
+}
+
+func (a *providerAdapter) GetMetadata() *GoDataMetadata {
+	return a.provider.GetMetadata()
+}
+
+// An optional interface for providers that can retrieve a single property of
+// an entity without retrieving the entire entity. If a provider does not
+// implement it, properties are extracted from the result of GetEntity.
+type GoDataPropertyProvider interface {
+	// Request a single property of an entity. The property is addressed by
+	// the property segment of the request, which is either the last segment,
+	// or the segment preceding $value. Should return a response field that
+	// contains the value of the property, or nil if the property is null.
+	GetProperty(context.Context, *GoDataRequest) (*GoDataResponseField, error)
+}
+
+// An optional interface for providers that can create entities. If a
+// provider implements it, the service accepts POST requests to entity sets.
+type GoDataWritableProvider interface {
+	// Create an entity in the entity set addressed by the request. The
+	// entity is given as a response field containing a map from property
+	// names to values, which has been validated against the entity type.
+	// Should return a response field that contains the created entity,
+	// including any values generated by the provider, such as keys.
+	CreateEntity(context.Context, *GoDataRequest, *GoDataResponseField) (*GoDataResponseField, error)
+}
+
+// An optional interface for providers that can update entities. If a provider
+// implements it, the service accepts PATCH and PUT requests to entities.
+type GoDataUpdatableProvider interface {
+	// Update the entity addressed by the request, changing only the
+	// properties given in the entity (PATCH semantics). The entity is given
+	// as a response field containing a map from property names to values,
+	// which has been validated against the entity type. May return the
+	// updated entity, which is sent to clients that prefer a representation
+	// in the response. The preconditions of the request, if any, are given
+	// by its IfMatch and IfNoneMatch fields.
+	UpdateEntity(context.Context, *GoDataRequest, *GoDataResponseField) (*GoDataResponseField, error)
+	// Replace the entity addressed by the request, resetting any property
+	// missing from the entity to its default value (PUT semantics). The
+	// arguments and result are the same as for UpdateEntity.
+	ReplaceEntity(context.Context, *GoDataRequest, *GoDataResponseField) (*GoDataResponseField, error)
+}
+
+// An optional interface for providers that can delete entities. If a provider
+// implements it, the service accepts DELETE requests to entities.
+type GoDataDeletableProvider interface {
+	// Delete the entity addressed by the request, subject to the
+	// preconditions given by its IfMatch and IfNoneMatch fields, if any.
+	DeleteEntity(context.Context, *GoDataRequest) error
+}
+
+// An optional interface for providers that determine the order of the
+// properties of entities in responses, e.g. the order of the columns of a
+// query. If a provider does not implement it, properties are written in the
+// order they are declared in the entity type.
+type GoDataPropertyOrderProvider interface {
+	// Get the order of the properties of entities of the given type, which
+	// is the addressed entity type or an expanded one, in the response to a
+	// request. May return nil to use the order of the entity type.
+	PropertyOrder(context.Context, *GoDataRequest, *GoDataEntityType) []string
+}
+
+// An optional interface for providers that can produce the entities of a
+// collection one at a time, e.g. from a database cursor. If a provider
+// implements it, collections are streamed to the client as the entities are
+// produced, rather than built in memory first, unless a middleware with a
+// response hook needs the whole response.
+type GoDataStreamingProvider interface {
+	// Produce the entities of the collection addressed by the request, as
+	// GetEntityCollection would, by calling yield with each entity in order.
+	// If yield returns an error, e.g. because the client has received a full
+	// page, the provider must stop and return that error. The provider hooks
+	// of middleware see this call as the operation "StreamEntityCollection",
+	// which has no result.
+	StreamEntityCollection(ctx context.Context, request *GoDataRequest, yield func(*GoDataResponseField) error) error
+}
+
 // A GoDataService will spawn an HTTP listener, which will connect GoData
 // requests with a backend provider given to it.
 type GoDataService struct {
@@ -37,7 +177,7 @@ type GoDataService struct {
 	// service document.
 	BaseUrl *url.URL
 	// The provider for this service that is serving the data to the OData API.
-	Provider GoDataProvider
+	Provider GoDataContextProvider
 	// Metadata cache taken from the provider.
 	Metadata *GoDataMetadata
 	// A mapping from schema names to schema references
@@ -57,6 +197,37 @@ type GoDataService struct {
 	// A lookup for navigational properties if an entity type is given,
 	// lookup navigational properties by name
 	NavigationPropertyLookup map[*GoDataEntityType]map[string]*GoDataNavigationProperty
+	// Converts errors into the OData error responses sent to clients. If nil,
+	// DefaultErrorFormatter is used.
+	ErrorFormatter GoDataErrorFormatter
+	// Logs the errors that are reported to clients as internal server errors,
+	// whose causes are not sent to the client. If nil, the standard logger of
+	// the log package is used.
+	ErrorLog *log.Logger
+	// The middleware attached to the service, in the order it is run.
+	Middleware []*GoDataMiddleware
+	// The maximum duration of a request. When it expires, the context passed
+	// to the provider is canceled, and the client receives an error. Zero
+	// means no limit.
+	RequestTimeout time.Duration
+	// The maximum number of entities in a page of a collection. If a
+	// collection has more entities, the response links to the next page with
+	// @odata.nextLink. Clients may prefer smaller pages with the
+	// odata.maxpagesize preference. Zero means collections are only paged
+	// if the client prefers it.
+	MaxPageSize int
+	// The maximum size in bytes of the body of a $batch request. Zero means
+	// DefaultMaxBatchSize.
+	MaxBatchSize int64
+	// The maximum number of requests of a JSON $batch request that are
+	// executed at the same time. Zero means DefaultMaxBatchConcurrency.
+	MaxBatchConcurrency int
+	// Whether the key of an entity may be given as a segment of its own, e.g.
+	// Customers/42 rather than Customers(42). A segment following an entity
+	// set is read as a key if it is not a property, a navigation property or a
+	// $-segment. The URLs generated for entities with a single key property,
+	// e.g. @odata.id, then follow the same convention.
+	KeyAsSegment bool
 }
 
 type providerChannelResponse struct {
@@ -64,13 +235,87 @@ type providerChannelResponse struct {
 	Error error
 }
 
+// Call a provider method in a new goroutine and return a channel that will
+// receive its result. The call passes through the provider hooks of the
+// attached middleware, which are given the name of the provider method. A
+// panic in the provider is recovered and delivered as an error. If the context
+// of the HTTP request is done before the provider returns, the channel
+// receives the error of the context instead. The channels are buffered so no
+// goroutine blocks if the caller stops waiting for the result.
+func (service *GoDataService) callProvider(
+	r *http.Request,
+	request *GoDataRequest,
+	operation string,
+	call GoDataProviderCall,
+) <-chan *providerChannelResponse {
+	for i := len(service.Middleware) - 1; i >= 0; i-- {
+		if hook := service.Middleware[i].Provider; hook != nil {
+			next := call
+			call = func() (*GoDataResponseField, error) {
+				return hook(r, request, operation, next)
+			}
+		}
+	}
+
+	responses := make(chan *providerChannelResponse, 1)
+	go func() {
+		defer close(responses)
+		defer func() {
+			if p := recover(); p != nil {
+				responses <- &providerChannelResponse{nil,
+					InternalServerError("The provider encountered an unexpected error").SetCause(fmt.Errorf("%v", p))}
+			}
+		}()
+		result, err := call()
+		responses <- &providerChannelResponse{result, err}
+	}()
+
+	ctx := r.Context()
+	if ctx.Done() == nil {
+		// the context can never be canceled
+		return responses
+	}
+	results := make(chan *providerChannelResponse, 1)
+	go func() {
+		defer close(results)
+		select {
+		case result := <-responses:
+			results <- result
+		case <-ctx.Done():
+			results <- &providerChannelResponse{nil, contextError(ctx.Err())}
+		}
+	}()
+	return results
+}
+
+// The provider of the service whose optional interfaces are used, e.g.
+// GoDataWritableProvider. For a GoDataProvider used through AdaptProvider,
+// this is the adapted provider.
+func (service *GoDataService) providerImplementation() interface{} {
+	if adapter, ok := service.Provider.(*providerAdapter); ok {
+		return adapter.provider
+	}
+	return service.Provider
+}
+
 // Create a new service from a given provider. This step builds lookups for
 // all parts of the data model, so constant time lookups can be performed. This
 // step only happens once when the server starts up, so the overall cost is
 // minimal. The given url will be treated as the base URL for all service
-// requests, and used for building context URLs, etc.
+// requests, and used for building context URLs, etc. If the metadata of the
+// provider is not valid, the problems found by GoDataMetadata.Validate are
+// returned instead.
 func BuildService(provider GoDataProvider, serviceUrl string) (*GoDataService, error) {
+	return BuildContextService(AdaptProvider(provider), serviceUrl)
+}
+
+// Create a new service from a provider that is passed the context of each
+// request, as BuildService.
+func BuildContextService(provider GoDataContextProvider, serviceUrl string) (*GoDataService, error) {
 	metadata := provider.GetMetadata()
+	if err := metadata.Validate(); err != nil {
+		return nil, err
+	}
 
 	// build the lookups from the metadata
 	schemaLookup := map[string]*GoDataSchema{}
@@ -80,7 +325,7 @@ func BuildService(provider GoDataProvider, serviceUrl string) (*GoDataService, e
 	propertyLookup := map[*GoDataEntityType]map[string]*GoDataProperty{}
 	navPropLookup := map[*GoDataEntityType]map[string]*GoDataNavigationProperty{}
 
-	for _, schema := range metadata.DataServices.Schemas {
+	for _, schema := range metadata.schemas() {
 		schemaLookup[schema.Namespace] = schema
 
 		for _, entity := range schema.EntityTypes {
@@ -127,27 +372,66 @@ func BuildService(provider GoDataProvider, serviceUrl string) (*GoDataService, e
 		return nil, err
 	}
 
+	// The service root is a directory, so relative URLs resolve beneath it.
+	if !strings.HasSuffix(parsedUrl.Path, "/") {
+		parsedUrl.Path += "/"
+	}
+
 	return &GoDataService{
-		parsedUrl,
-		provider,
-		provider.GetMetadata(),
-		schemaLookup,
-		entityLookup,
-		containerLookup,
-		entitySetLookup,
-		propertyLookup,
-		navPropLookup,
+		BaseUrl:                  parsedUrl,
+		Provider:                 provider,
+		Metadata:                 metadata,
+		SchemaLookup:             schemaLookup,
+		EntityTypeLookup:         entityLookup,
+		EntityContainerLookup:    containerLookup,
+		EntitySetLookup:          entitySetLookup,
+		PropertyLookup:           propertyLookup,
+		NavigationPropertyLookup: navPropLookup,
+		ErrorFormatter:           DefaultErrorFormatter,
 	}, nil
 }
 
 // The default handler for parsing requests as GoDataRequests, passing them
-// to a GoData provider, and then building a response.
+// to a GoData provider, and then building a response. Requests pass through
+// the attached middleware. Any error, including a panic in the provider, is
+// written to the client as an OData error response.
 func (service *GoDataService) GoDataHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	request, err := ParseRequest(ctx, r.URL.Path, r.URL.Query())
+	defer func() {
+		if p := recover(); p != nil {
+			service.writeError(w, r, InternalServerError("The service encountered an unexpected error").
+				SetCause(fmt.Errorf("%v", p)))
+		}
+	}()
+
+	handler := service.wrapHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := service.handleRequest(w, r); err != nil {
+			service.writeError(w, r, err)
+		}
+	}))
+	handler.ServeHTTP(w, r)
+}
+
+// Parse, semanticize and dispatch a single HTTP request, and write the
+// response. If an error is returned, nothing has been written yet.
+func (service *GoDataService) handleRequest(w http.ResponseWriter, r *http.Request) error {
+	if service.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), service.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// split the escaped path, so an escaped slash, e.g. in a key segment,
+	// does not separate segments
+	request, err := parseEscapedRequest(r.Context(), service.requestPath(r.URL.EscapedPath()), r.URL.Query())
 
 	if err != nil {
-		panic(err) // TODO: return proper error
+		return err
+	}
+	request.IfMatch = parseETags(r.Header.Get("If-Match"))
+	request.IfNoneMatch = parseETags(r.Header.Get("If-None-Match"))
+
+	if err := service.runParsedHooks(r, request); err != nil {
+		return err
 	}
 
 	// Semanticize all tokens in the request, connecting them with their
@@ -155,166 +439,799 @@ func (service *GoDataService) GoDataHTTPHandler(w http.ResponseWriter, r *http.R
 	err = request.SemanticizeRequest(service)
 
 	if err != nil {
-		panic(err) // TODO: return proper error
+		return err
+	}
+
+	if err := service.runSemanticizedHooks(r, request); err != nil {
+		return err
+	}
+
+	if err := service.negotiateFormat(r, request); err != nil {
+		return err
 	}
 
-	// TODO: differentiate GET and POST requests
+	if request.RequestKind == RequestKindBatch {
+		if r.Method != http.MethodPost {
+			return MethodNotAllowedError("Batch requests must use POST")
+		}
+		return service.handleBatch(w, r)
+	}
+
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead:
+		return service.handleRead(w, r, request)
+	case http.MethodPost:
+		if request.RequestKind == RequestKindCollection {
+			return service.handleCreate(w, r, request)
+		}
+		return MethodNotAllowedError("Entities can only be created in an entity set")
+	case http.MethodPatch, http.MethodPut:
+		if request.RequestKind == RequestKindEntity {
+			return service.handleUpdate(w, r, request, r.Method == http.MethodPut)
+		}
+		return MethodNotAllowedError("Only single entities can be updated")
+	case http.MethodDelete:
+		if request.RequestKind == RequestKindEntity {
+			return service.handleDelete(w, r, request)
+		}
+		return MethodNotAllowedError("Only single entities can be deleted")
+	default:
+		return MethodNotAllowedError("Method " + r.Method + " is not supported")
+	}
+}
+
+// Build and write the response to a request that reads a resource.
+func (service *GoDataService) handleRead(w http.ResponseWriter, r *http.Request, request *GoDataRequest) error {
+	var err error
 	var response []byte = []byte{}
+	var preferenceApplied, etag string
 	if request.RequestKind == RequestKindMetadata {
-		response, err = service.buildMetadataResponse(request)
+		response, err = service.buildMetadataResponse(r, request)
 	} else if request.RequestKind == RequestKindService {
-		response, err = service.buildServiceResponse(request)
+		response, err = service.buildServiceResponse(r, request)
 	} else if request.RequestKind == RequestKindCollection {
-		response, err = service.buildCollectionResponse(request)
+		var applied bool
+		request.PageSize, applied = service.pageSize(r)
+		if applied {
+			preferenceApplied = "odata.maxpagesize=" + strconv.Itoa(request.PageSize)
+		}
+		if request.PageSize > 0 || request.Query.SkipToken != nil {
+			entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+			entityType, err := service.LookupEntityType(entitySet.EntityType)
+			if err != nil {
+				return err
+			}
+			request.PageOrder = service.pageOrder(request, entityType)
+		}
+		if format := request.Query.Format; format != nil && format.MediaType != "application/json" {
+			return service.writeCollectionRows(w, r, request, preferenceApplied)
+		}
+		if service.streamsCollections() {
+			return service.writeCollectionStream(w, r, request, preferenceApplied)
+		}
+		response, err = service.buildCollectionResponse(r, request)
 	} else if request.RequestKind == RequestKindEntity {
-		response, err = service.buildEntityResponse(request)
+		response, etag, err = service.buildEntityResponse(r, request)
 	} else if request.RequestKind == RequestKindProperty {
-		response, err = service.buildPropertyResponse(request)
+		response, err = service.buildPropertyResponse(r, request)
 	} else if request.RequestKind == RequestKindPropertyValue {
-		response, err = service.buildPropertyValueResponse(request)
+		response, err = service.buildPropertyValueResponse(r, request)
 	} else if request.RequestKind == RequestKindCount {
-		response, err = service.buildCountResponse(request)
+		response, err = service.buildCountResponse(r, request)
 	} else if request.RequestKind == RequestKindRef {
-		response, err = service.buildRefResponse(request)
+		response, err = service.buildRefResponse(r, request)
 	} else {
 		err = NotImplementedError("Request type not understood.")
 	}
 
 	if err != nil {
-		panic(err) // TODO: return proper error
+		return err
+	}
+
+	if preferenceApplied != "" {
+		w.Header().Set("Preference-Applied", preferenceApplied)
+	}
+
+	if request.RequestKind == RequestKindEntity {
+		notModified, err := checkPreconditions(r, etag)
+		if err != nil {
+			return err
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	if response == nil {
+		// e.g. a null property
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", responseContentType(request))
+	// The client may have gone away; there is no one left to report this to.
+	_, _ = w.Write(response)
+	return nil
+}
+
+// Create an entity in the entity set addressed by the request from the entity
+// in the request body, and write the created entity, unless the client
+// prefers a minimal response.
+func (service *GoDataService) handleCreate(w http.ResponseWriter, r *http.Request, request *GoDataRequest) error {
+	provider, ok := service.providerImplementation().(GoDataWritableProvider)
+	if !ok {
+		return MethodNotAllowedError("The service does not support creating entities")
 	}
 
-	_, err = w.Write(response)
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
 	if err != nil {
-		panic(err) // TODO: return proper error
+		return err
+	}
+
+	fields, err := ParseEntity(r.Body, service, entityType)
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredProperties(entityType, fields); err != nil {
+		return err
+	}
+
+	result := <-service.callProvider(r, request, "CreateEntity", func() (*GoDataResponseField, error) {
+		return provider.CreateEntity(r.Context(), request, &GoDataResponseField{Value: fields})
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.Field == nil {
+		return InternalServerError("Provider did not return a valid response from CreateEntity()")
+	}
+	created, ok := result.Field.Value.(map[string]*GoDataResponseField)
+	if !ok {
+		return InternalServerError("Provider did not return a valid response from CreateEntity()")
+	}
+	created = copyFields(created)
+
+	location, err := service.entityUrl(entitySet, entityType, created)
+	if err != nil {
+		return err
+	}
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	if etag := entityETag(created); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if parsePreferHeader(r.Header)["return"] == "minimal" {
+		if location != "" {
+			w.Header().Set("OData-EntityId", location)
+		}
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	// build context URL
+	path, err := url.Parse("./$metadata#" + entitySet.Name + "/$entity")
+	if err != nil {
+		return err
+	}
+	created[ODataFieldContext] = &GoDataResponseField{Value: service.BaseUrl.ResolveReference(path).String()}
+
+	response, err := service.serialize(r, request, &GoDataResponse{Fields: created})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", responseContentType(request))
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(response)
+	return nil
+}
+
+// Update the entity addressed by the request with the entity in the request
+// body. If replace is true, properties missing from the body are reset to
+// their default values (PUT), otherwise only the given properties are changed
+// (PATCH). Nothing is written in the response, unless the client prefers to
+// receive the updated entity.
+func (service *GoDataService) handleUpdate(w http.ResponseWriter, r *http.Request, request *GoDataRequest, replace bool) error {
+	provider, ok := service.providerImplementation().(GoDataUpdatableProvider)
+	if !ok {
+		return MethodNotAllowedError("The service does not support updating entities")
+	}
+
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return err
+	}
+
+	fields, err := ParseEntity(r.Body, service, entityType)
+	if err != nil {
+		return err
+	}
+	if replace {
+		if err := validateRequiredProperties(entityType, fields); err != nil {
+			return err
+		}
+	}
+	if err := validateKeyProperties(request.LastSegment.Key, fields); err != nil {
+		return err
 	}
+	if err := service.checkEntityPreconditions(r, request); err != nil {
+		return err
+	}
+
+	operation, update := "UpdateEntity", provider.UpdateEntity
+	if replace {
+		operation, update = "ReplaceEntity", provider.ReplaceEntity
+	}
+	result := <-service.callProvider(r, request, operation, func() (*GoDataResponseField, error) {
+		return update(r.Context(), request, &GoDataResponseField{Value: fields})
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var updated map[string]*GoDataResponseField
+	if result.Field != nil {
+		updated, _ = result.Field.Value.(map[string]*GoDataResponseField)
+	}
+	if etag := entityETag(updated); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if parsePreferHeader(r.Header)["return"] != "representation" || result.Field == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if updated == nil {
+		return InternalServerError("Provider did not return a valid response when updating an entity")
+	}
+	updated = copyFields(updated)
+
+	// build context URL
+	path, err := url.Parse("./$metadata#" + entitySet.Name + "/$entity")
+	if err != nil {
+		return err
+	}
+	updated[ODataFieldContext] = &GoDataResponseField{Value: service.BaseUrl.ResolveReference(path).String()}
+
+	response, err := service.serialize(r, request, &GoDataResponse{Fields: updated})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", responseContentType(request))
+	w.Header().Set("Preference-Applied", "return=representation")
+	_, _ = w.Write(response)
+	return nil
 }
 
-func (service *GoDataService) buildMetadataResponse(request *GoDataRequest) ([]byte, error) {
+// Delete the entity addressed by the request.
+func (service *GoDataService) handleDelete(w http.ResponseWriter, r *http.Request, request *GoDataRequest) error {
+	provider, ok := service.providerImplementation().(GoDataDeletableProvider)
+	if !ok {
+		return MethodNotAllowedError("The service does not support deleting entities")
+	}
+
+	if err := service.checkEntityPreconditions(r, request); err != nil {
+		return err
+	}
+
+	result := <-service.callProvider(r, request, "DeleteEntity", func() (*GoDataResponseField, error) {
+		return nil, provider.DeleteEntity(r.Context(), request)
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Check that an update does not change the key of an entity. Key properties
+// may only be given in the body of an update if they have the value of the key
+// in the URL, however either is written.
+func validateKeyProperties(key []*GoDataKeyValue, fields map[string]*GoDataResponseField) error {
+	for _, value := range key {
+		field, ok := fields[value.Name]
+		if !ok {
+			continue
+		}
+		if field.Value == nil || !keyValueMatches(value, field.Value) {
+			return BadRequestError("Key property " + value.Name + " cannot be updated").SetTarget(value.Name)
+		}
+	}
+	return nil
+}
+
+// Build the canonical URL of an entity from the values of its key properties.
+// If the entity does not contain a value for every key property, an empty
+// string is returned.
+func (service *GoDataService) entityUrl(
+	entitySet *GoDataEntitySet,
+	entityType *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+) (string, error) {
+	keys := entityKeyNames(entityType)
+	if len(keys) == 0 {
+		return "", nil
+	}
+
+	literals := make([]string, 0, len(keys))
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok || field == nil || field.Value == nil {
+			return "", nil
+		}
+		literal := formatKeyLiteral(field.Value)
+		if len(keys) > 1 {
+			literal = key + "=" + literal
+		}
+		literals = append(literals, literal)
+	}
+
+	segment := escapePathSegment(entitySet.Name + "(" + strings.Join(literals, ",") + ")")
+	if service.KeyAsSegment && len(keys) == 1 {
+		segment = url.PathEscape(entitySet.Name) + "/" + url.PathEscape(formatKeySegment(fields[keys[0]].Value))
+	}
+	path, err := url.Parse(segment)
+	if err != nil {
+		return "", err
+	}
+	return service.BaseUrl.ResolveReference(path).String(), nil
+}
+
+// The names of the key properties of an entity type, in declaration order.
+func entityKeyNames(entity *GoDataEntityType) []string {
+	if entity.Key == nil {
+		return nil
+	}
+	names := make([]string, 0, len(entity.Key.PropertyRefs))
+	for _, ref := range entity.Key.PropertyRefs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// Format a key value as a literal in a key predicate, e.g. strings are
+// quoted.
+func formatKeyLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Format a key value as a key segment, e.g. Customers/ALFKI. Unlike in a key
+// predicate, strings are not quoted.
+func formatKeySegment(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return formatKeyLiteral(value)
+}
+
+// Format a segment with its key predicate in parentheses, even if it was given
+// as a key segment, as it appears in a context URL.
+func keyPredicateSegment(segment *GoDataSegment) string {
+	if segment.Key == nil {
+		return segment.Name
+	}
+	literals := make([]string, len(segment.Key))
+	for i, value := range segment.Key {
+		literals[i] = value.Literal
+		if len(segment.Key) > 1 {
+			literals[i] = value.Name + "=" + value.Literal
+		}
+	}
+	return segment.Name + "(" + strings.Join(literals, ",") + ")"
+}
+
+// Build the path of the resource addressed by a segment, as it appears in a
+// context URL, e.g. Orders(5)/Customer.
+func contextPath(last *GoDataSegment) string {
+	parts := []string{}
+	for segment := last; segment != nil; segment = segment.Prev {
+		parts = append([]string{escapePathSegment(keyPredicateSegment(segment))}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Build the resource path of a request from its segments, relative to the
+// service root, with keys written the way the service writes them, e.g. as key
+// segments if KeyAsSegment is set.
+func (service *GoDataService) resourcePath(request *GoDataRequest) string {
+	parts := []string{}
+	for segment := request.FirstSegment; segment != nil; segment = segment.Next {
+		switch {
+		case segment.Key == nil:
+			parts = append(parts, url.PathEscape(segment.RawValue))
+		case service.KeyAsSegment && len(segment.Key) == 1:
+			value := segment.Key[0].Literal
+			if s, ok := segment.Key[0].Value.(string); ok {
+				value = s
+			}
+			parts = append(parts, url.PathEscape(segment.Name), url.PathEscape(value))
+		default:
+			parts = append(parts, escapePathSegment(keyPredicateSegment(segment)))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+var pathSegmentUnescaper = strings.NewReplacer("%27", "'", "%28", "(", "%29", ")")
+
+// Escape a path segment, leaving the characters used in key predicates intact.
+func escapePathSegment(segment string) string {
+	return pathSegmentUnescaper.Replace(url.PathEscape(segment))
+}
+
+// Parse the preferences in the Prefer header of a request into a map from
+// preference names to values. Preferences without a value map to an empty
+// string.
+func parsePreferHeader(header http.Header) map[string]string {
+	result := map[string]string{}
+	for _, line := range header.Values("Prefer") {
+		for _, preference := range strings.Split(line, ",") {
+			// ignore any parameters of the preference
+			preference = strings.TrimSpace(strings.SplitN(preference, ";", 2)[0])
+			if preference == "" {
+				continue
+			}
+			parts := strings.SplitN(preference, "=", 2)
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			value := ""
+			if len(parts) > 1 {
+				value = strings.Trim(strings.TrimSpace(parts[1]), "\"")
+			}
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// Determine the content type of the response to a request.
+func responseContentType(request *GoDataRequest) string {
+	if request.RequestKind == RequestKindMetadata && request.Query.Format != nil {
+		// CSDL JSON has no format parameters
+		return request.Query.Format.MediaType
+	}
+	if request.Query.Format != nil {
+		return request.Query.Format.ContentType()
+	}
+	switch request.RequestKind {
+	case RequestKindMetadata:
+		return "application/xml"
+	case RequestKindCount:
+		return "text/plain"
+	case RequestKindPropertyValue:
+		if request.LastSegment.SemanticReference.(*GoDataProperty).Type == GoDataBinary {
+			return "application/octet-stream"
+		}
+		return "text/plain;charset=utf-8"
+	default:
+		return "application/json;odata.metadata=minimal"
+	}
+}
+
+// Strip the path of the service base URL from an escaped request path, so
+// that only the resource path relative to the service root remains.
+func (service *GoDataService) requestPath(path string) string {
+	path = strings.TrimPrefix(path, strings.TrimSuffix(service.BaseUrl.EscapedPath(), "/"))
+	return strings.TrimPrefix(path, "/")
+}
+
+// Write an error to the client using the service error formatter.
+func (service *GoDataService) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	formatter := service.ErrorFormatter
+	if formatter == nil {
+		formatter = DefaultErrorFormatter
+	}
+	response := formatter(r, err)
+	if response.StatusCode == http.StatusInternalServerError {
+		service.logf("godata: %s %s: %v", r.Method, r.URL.RequestURI(), err)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		body = []byte(`{"error":{"code":"InternalServerError","message":"Failed to serialize error"}}`)
+		response.StatusCode = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(body)
+}
+
+// Log a message to the error log of the service.
+func (service *GoDataService) logf(format string, args ...interface{}) {
+	if service.ErrorLog != nil {
+		service.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Build the metadata document, as CSDL XML or, if the client asks for JSON, as
+// CSDL JSON.
+func (service *GoDataService) buildMetadataResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
+	if format := request.Query.Format; format != nil && format.MediaType == "application/json" {
+		return service.Metadata.JSON()
+	}
 	return service.Metadata.Bytes()
 }
 
-func (service *GoDataService) buildServiceResponse(request *GoDataRequest) ([]byte, error) {
-	// TODO
-	return nil, NotImplementedError("Service responses are not implemented yet.")
+// Build the service document, which lists every entity set, singleton and
+// function import in the entity containers of the service that should be
+// included in the service document.
+func (service *GoDataService) buildServiceResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
+	path, err := url.Parse("./$metadata")
+	if err != nil {
+		return nil, err
+	}
+	contextUrl := service.BaseUrl.ResolveReference(path).String()
+
+	resources := []*GoDataResponseField{}
+	addResource := func(name, kind string) {
+		resources = append(resources, &GoDataResponseField{
+			Value: map[string]*GoDataResponseField{
+				"name": {Value: name},
+				"kind": {Value: kind},
+				"url":  {Value: url.PathEscape(name)},
+			},
+		})
+	}
+
+	for _, schema := range service.Metadata.DataServices.Schemas {
+		for _, container := range schema.EntityContainers {
+			// Entity sets are included unless explicitly excluded
+			for _, set := range container.EntitySets {
+				if set.IncludeInServiceDocument != "false" {
+					addResource(set.Name, ServiceKindEntitySet)
+				}
+			}
+			for _, singleton := range container.Singletons {
+				addResource(singleton.Name, ServiceKindSingleton)
+			}
+			// Function imports are excluded unless explicitly included
+			for _, function := range container.FunctionImports {
+				if function.IncludeInServiceDocument == "true" {
+					addResource(function.Name, ServiceKindFunctionImport)
+				}
+			}
+		}
+	}
+
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		ODataFieldContext: {Value: contextUrl},
+		ODataFieldValue:   {Value: resources},
+	}}
+
+	return service.serialize(r, request, response)
 }
 
-func (service *GoDataService) buildCollectionResponse(request *GoDataRequest) ([]byte, error) {
+func (service *GoDataService) buildCollectionResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
 	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{}}
 	// get request from provider
-	responses := make(chan *providerChannelResponse)
-	go func() {
-		result, err := service.Provider.GetEntityCollection(request)
-		responses <- &providerChannelResponse{result, err}
-		close(responses)
-	}()
+	responses := service.callProvider(r, request, "GetEntityCollection", func() (*GoDataResponseField, error) {
+		return service.Provider.GetEntityCollection(r.Context(), request)
+	})
 
-	if bool(*request.Query.Count) {
+	if request.Query.Count != nil && bool(*request.Query.Count) {
 		// if count is true, also include the count result
-		counts := make(chan *providerChannelResponse)
-
-		go func() {
-			result, err := service.Provider.GetCount(request)
-			counts <- &providerChannelResponse{&GoDataResponseField{result}, err}
-			close(counts)
-		}()
-
-		r := <-counts
-		if r.Error != nil {
-			return nil, r.Error
+		counts := service.callProvider(r, request, "GetCount", func() (*GoDataResponseField, error) {
+			result, err := service.Provider.GetCount(r.Context(), request)
+			return &GoDataResponseField{result}, err
+		})
+
+		count := <-counts
+		if count.Error != nil {
+			return nil, count.Error
 		}
 
-		response.Fields[ODataFieldCount] = r.Field
+		response.Fields[ODataFieldCount] = count.Field
 	}
 	// build context URL
-	context := request.LastSegment.SemanticReference.(*GoDataEntitySet).Name
-	path, err := url.Parse("./$metadata#" + context)
+	contextUrl, err := service.collectionContextUrl(request)
 	if err != nil {
 		return nil, err
 	}
-	contextUrl := service.BaseUrl.ResolveReference(path).String()
 	response.Fields[ODataFieldContext] = &GoDataResponseField{Value: contextUrl}
 
 	// wait for a response from the provider
-	r := <-responses
+	result := <-responses
 
-	if r.Error != nil {
-		return nil, r.Error
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	value, nextLink, err := service.pageCollection(r, request, result.Field)
+	if err != nil {
+		return nil, err
+	}
+	if nextLink != "" {
+		response.Fields[ODataFieldNextLink] = &GoDataResponseField{Value: nextLink}
 	}
 
-	response.Fields[ODataFieldValue] = r.Field
+	response.Fields[ODataFieldValue] = value
 
-	return response.Json()
+	return service.serialize(r, request, response)
+}
+
+// The context URL of a response to a collection request.
+func (service *GoDataService) collectionContextUrl(request *GoDataRequest) (string, error) {
+	context := request.LastSegment.SemanticReference.(*GoDataEntitySet).Name
+	path, err := url.Parse("./$metadata#" + context)
+	if err != nil {
+		return "", err
+	}
+	return service.BaseUrl.ResolveReference(path).String(), nil
 }
 
-func (service *GoDataService) buildEntityResponse(request *GoDataRequest) ([]byte, error) {
+// Build the response to a request for an entity, and return it with the ETag
+// of the entity, if any.
+func (service *GoDataService) buildEntityResponse(r *http.Request, request *GoDataRequest) ([]byte, string, error) {
 	// get request from provider
-	responses := make(chan *providerChannelResponse)
-	go func() {
-		result, err := service.Provider.GetEntity(request)
-		responses <- &providerChannelResponse{result, err}
-		close(responses)
-	}()
+	responses := service.callProvider(r, request, "GetEntity", func() (*GoDataResponseField, error) {
+		return service.Provider.GetEntity(r.Context(), request)
+	})
 
 	// build context URL
 	context := request.LastSegment.SemanticReference.(*GoDataEntitySet).Name
 	path, err := url.Parse("./$metadata#" + context + "/$entity")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	contextUrl := service.BaseUrl.ResolveReference(path).String()
 
 	// wait for a response from the provider
-	r := <-responses
+	result := <-responses
 
-	if r.Error != nil {
-		return nil, r.Error
+	if result.Error != nil {
+		return nil, "", result.Error
 	}
 
-	// Add context field to result and create the response
-	switch r.Field.Value.(type) {
+	if result.Field == nil {
+		return nil, "", InternalServerError("Provider did not return a valid response from GetEntity()")
+	}
+
+	// Add context field to a copy of the result and create the response
+	switch value := result.Field.Value.(type) {
 	case map[string]*GoDataResponseField:
-		fields := r.Field.Value.(map[string]*GoDataResponseField)
+		fields := copyFields(value)
 		fields[ODataFieldContext] = &GoDataResponseField{Value: contextUrl}
 		response := &GoDataResponse{Fields: fields}
 
-		return response.Json()
+		body, err := service.serialize(r, request, response)
+		return body, entityETag(fields), err
 	default:
-		return nil, InternalServerError("Provider did not return a valid response" +
+		return nil, "", InternalServerError("Provider did not return a valid response" +
 			" from GetEntity()")
 	}
 }
 
-func (service *GoDataService) buildPropertyResponse(request *GoDataRequest) ([]byte, error) {
-	// TODO
-	return nil, NotImplementedError("Property responses are not implemented yet.")
+// Build the response for a single property of an entity. A null property
+// produces no response body.
+func (service *GoDataService) buildPropertyResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
+	segment := request.LastSegment
+	field, err := service.getProperty(r, request, segment)
+	if err != nil {
+		return nil, err
+	}
+	if field == nil || field.Value == nil {
+		return nil, nil
+	}
+
+	// build context URL
+	path, err := url.Parse("./$metadata#" + contextPath(segment.Prev) + "/" + segment.Name)
+	if err != nil {
+		return nil, err
+	}
+	contextUrl := service.BaseUrl.ResolveReference(path).String()
+
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		ODataFieldContext: {Value: contextUrl},
+		ODataFieldValue:   field,
+	}}
+
+	return service.serialize(r, request, response)
 }
 
-func (service *GoDataService) buildPropertyValueResponse(request *GoDataRequest) ([]byte, error) {
-	// TODO
-	return nil, NotImplementedError("Property value responses are not implemented yet.")
+// Build the response for the raw value of a primitive property. A null
+// property produces no response body.
+func (service *GoDataService) buildPropertyValueResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
+	field, err := service.getProperty(r, request, request.LastSegment.Prev)
+	if err != nil {
+		return nil, err
+	}
+	if field == nil || field.Value == nil {
+		return nil, nil
+	}
+
+	prop := request.LastSegment.SemanticReference.(*GoDataProperty)
+	return formatRawValue(prop.Type, field.Value)
+}
+
+// Retrieve the value of the property addressed by the given segment. If the
+// provider cannot retrieve properties directly, the property is extracted
+// from the entity returned by GetEntity.
+func (service *GoDataService) getProperty(r *http.Request, request *GoDataRequest, segment *GoDataSegment) (*GoDataResponseField, error) {
+	if provider, ok := service.providerImplementation().(GoDataPropertyProvider); ok {
+		result := <-service.callProvider(r, request, "GetProperty", func() (*GoDataResponseField, error) {
+			return provider.GetProperty(r.Context(), request)
+		})
+		return result.Field, result.Error
+	}
+
+	entityRequest := truncateRequest(request, segment.Prev, RequestKindEntity)
+	result := <-service.callProvider(r, entityRequest, "GetEntity", func() (*GoDataResponseField, error) {
+		return service.Provider.GetEntity(r.Context(), entityRequest)
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.Field == nil {
+		return nil, InternalServerError("Provider did not return a valid response from GetEntity()")
+	}
+	fields, ok := result.Field.Value.(map[string]*GoDataResponseField)
+	if !ok {
+		return nil, InternalServerError("Provider did not return a valid response from GetEntity()")
+	}
+	return fields[segment.SemanticReference.(*GoDataProperty).Name], nil
+}
+
+// Build a copy of a request whose resource path ends at the given segment, so
+// that a part of the path can be passed to a provider on its own. The query of
+// the copy is shared with the original request.
+func truncateRequest(request *GoDataRequest, last *GoDataSegment, kind RequestKind) *GoDataRequest {
+	result := &GoDataRequest{Query: request.Query, RequestKind: kind}
+	var prev *GoDataSegment
+	for segment := request.FirstSegment; segment != nil; segment = segment.Next {
+		clone := *segment
+		clone.Prev = prev
+		clone.Next = nil
+		if prev == nil {
+			result.FirstSegment = &clone
+		} else {
+			prev.Next = &clone
+		}
+		prev = &clone
+		if segment == last {
+			break
+		}
+	}
+	result.LastSegment = prev
+	return result
 }
 
-func (service *GoDataService) buildCountResponse(request *GoDataRequest) ([]byte, error) {
+func (service *GoDataService) buildCountResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
 	// get request from provider
-	responses := make(chan *providerChannelResponse)
-	go func() {
-		result, err := service.Provider.GetCount(request)
-		responses <- &providerChannelResponse{&GoDataResponseField{result}, err}
-		close(responses)
-	}()
+	responses := service.callProvider(r, request, "GetCount", func() (*GoDataResponseField, error) {
+		result, err := service.Provider.GetCount(r.Context(), request)
+		return &GoDataResponseField{result}, err
+	})
 
 	// wait for a response from the provider
-	r := <-responses
+	result := <-responses
 
-	if r.Error != nil {
-		return nil, r.Error
+	if result.Error != nil {
+		return nil, result.Error
 	}
 
-	return r.Field.Json()
+	return result.Field.Json()
 }
 
-func (service *GoDataService) buildRefResponse(request *GoDataRequest) ([]byte, error) {
+func (service *GoDataService) buildRefResponse(r *http.Request, request *GoDataRequest) ([]byte, error) {
 	// TODO
 	return nil, NotImplementedError("Ref responses are not implemented yet.")
 }
@@ -1,9 +1,19 @@
 package godata
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type DummyProvider struct {
@@ -86,7 +96,7 @@ func (*DummyProvider) GetMetadata() *GoDataMetadata {
 									NavigationPropertyBindings: []*GoDataNavigationPropertyBinding{
 										{
 											Path:   "Customer",
-											Target: "Customer",
+											Target: "Customers",
 										},
 									},
 								},
@@ -237,6 +247,968 @@ func TestSemanticizeRequestWildcard(t *testing.T) {
 
 }
 
+func TestKeyAsSegment(t *testing.T) {
+	provider := &EditableCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	// key segments are only read when the service opts in
+	status, _ := serveError(t, service, "/odata/Customers/Bob/Age")
+	if status != 400 {
+		t.Errorf("Expected status 400, got %d", status)
+	}
+	service.KeyAsSegment = true
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/odata/Customers/Bob/Age", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"@odata.context":"http://localhost/odata/$metadata#Customers('Bob')/Age"`) {
+		t.Errorf("Unexpected property response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = getWithAccept(service, "/odata/Customers/Bob", "application/json;odata.metadata=full")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"@odata.id":"http://localhost/odata/Customers/Bob"`) {
+		t.Errorf("Unexpected entity response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"O'Neil","Age":30}`)))
+	if location := w.Header().Get("Location"); location != "http://localhost/odata/Customers/O%27Neil" {
+		t.Errorf("Location is %q", location)
+	}
+
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("DELETE", "/odata/Customers/Bob", nil))
+	if w.Code != 204 || len(provider.Deleted) != 1 || provider.Deleted[0] != "'Bob'" {
+		t.Errorf("Unexpected delete %d: %v", w.Code, provider.Deleted)
+	}
+
+	// an escaped slash in a key segment is part of the key, so the links the
+	// service builds can be followed
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"e/f","Age":30}`)))
+	location := w.Header().Get("Location")
+	if location != "http://localhost/odata/Customers/e%2Ff" {
+		t.Errorf("Location is %q", location)
+	}
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("PATCH", location, strings.NewReader(`{"Name":"e/f","Age":31}`)))
+	if w.Code != 204 || len(provider.Updated) != 1 || provider.Updated[0]["Name"].Value != "e/f" {
+		t.Errorf("Unexpected update %d: %v", w.Code, provider.Updated)
+	}
+
+	// properties and $-segments are not keys
+	if status, _ := serveError(t, service, "/odata/Customers/Age"); status != 400 {
+		t.Errorf("Expected status 400, got %d", status)
+	}
+	if status, _ := serveError(t, service, "/odata/Customers/$count"); status != 501 {
+		t.Errorf("Expected $count to reach the provider, got %d", status)
+	}
+
+	// key predicates in parentheses are still accepted, and links such as
+	// nextLinks are built from the path with key segments
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/odata/Customers('Bob')/Age", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, keyAsSegment := range []bool{true, false} {
+		service.KeyAsSegment = keyAsSegment
+		request, err := ParseRequest(context.Background(), "Customers('O''Neil')/Age", url.Values{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := request.SemanticizeRequest(service); err != nil {
+			t.Error(err)
+			return
+		}
+		expected := "Customers('O''Neil')/Age"
+		if keyAsSegment {
+			expected = "Customers/O%27Neil/Age"
+		}
+		if path := service.resourcePath(request); path != expected {
+			t.Errorf("Expected resource path %s, got %s", expected, path)
+		}
+	}
+}
+
+// A provider of the test model that returns the same customer for every
+// entity, and no entities for every collection.
+type NavigationProvider struct {
+	ModelProvider
+}
+
+func (*NavigationProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Name": {Value: "Bob"},
+		"Age":  {Value: 42},
+	}}, nil
+}
+
+func (*NavigationProvider) GetEntityCollection(r *GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: []*GoDataResponseField{}}, nil
+}
+
+func TestNavigationContextUrl(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service, err := BuildService(&NavigationProvider{ModelProvider{metadata: metadata}}, "http://localhost/odata")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	const order = "01234567-89ab-cdef-0123-456789abcdef"
+
+	testCases := []struct {
+		url     string
+		context string
+	}{
+		{"/odata/Customers('Bob')/Orders", "http://localhost/odata/$metadata#Orders"},
+		{"/odata/Orders(" + order + ")/Customer", "http://localhost/odata/$metadata#Customers/$entity"},
+		{"/odata/Customers('Bob')/Orders(" + order + ")/Customer/Age",
+			"http://localhost/odata/$metadata#Customers('Bob')/Orders(" + order + ")/Customer/Age"},
+	}
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest("GET", testCase.url, nil))
+		if w.Code != 200 {
+			t.Errorf("%s: expected status 200, got %d: %s", testCase.url, w.Code, w.Body.String())
+			continue
+		}
+		var body struct {
+			Context string `json:"@odata.context"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Error(err)
+			continue
+		}
+		if body.Context != testCase.context {
+			t.Errorf("%s: expected @odata.context %s, got %s", testCase.url, testCase.context, body.Context)
+		}
+	}
+}
+
+func TestNavigationBindingPath(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service, err := BuildService(&NavigationProvider{ModelProvider{metadata: metadata}}, "http://localhost/odata")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	customers, err := service.LookupEntitySet("Customers")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"Orders", 200},
+		{"Shop.modelCustomer/Orders", 200},
+		// a cast to another type, and paths that are not walked
+		{"Shop.modelOrder/Orders", 501},
+		{"Shop.Derived/Orders", 501},
+		{"Address/Orders", 501},
+		{"Shop.modelCustomer/Address/Orders", 501},
+	}
+	for _, testCase := range testCases {
+		customers.NavigationPropertyBindings[0].Path = testCase.path
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/odata/Customers('Bob')/Orders", nil))
+		if w.Code != testCase.status {
+			t.Errorf("%s: expected status %d, got %d: %s", testCase.path, testCase.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+type PanicProvider struct {
+	DummyProvider
+}
+
+func (*PanicProvider) GetEntityCollection(*GoDataRequest) (*GoDataResponseField, error) {
+	panic("provider exploded")
+}
+
+// Serve a request with the given service and decode the OData error body.
+func serveError(t *testing.T, service *GoDataService, target string) (int, *GoDataErrorResponse) {
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", target, nil))
+
+	var body GoDataErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode error body %q: %v", w.Body.String(), err)
+	}
+	if body.Error == nil {
+		t.Fatalf("Error body %q has no error member", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	return w.Code, &body
+}
+
+func TestHTTPHandlerErrors(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost/odata")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		url    string
+		status int
+		code   string
+		target string
+	}{
+		{"/odata/Customers?$filter=Name%20eq", 400, "BadRequest", "$filter"},
+		{"/odata/Customers?$filter=Missing%20eq%20'Bob'", 400, "BadRequest", "$filter"},
+		{"/odata/Customers?$orderby=Missing", 400, "BadRequest", "$orderby"},
+		{"/odata/Customers?$bogus=1", 400, "UnsupportedQueryParameter", "$bogus"},
+		{"/odata/Customers?$top=1&$top=2", 400, "DuplicateQueryParameter", "$top"},
+		{"/odata/Customers?$format=atom", 406, "NotAcceptable", "$format"},
+		{"/odata/Customers?$format=application/json%3Bodata.metadata=bogus", 406, "NotAcceptable", "$format"},
+		{"/odata/Nowhere", 400, "BadRequest", ""},
+		{"/odata/Customers", 501, "NotImplemented", ""},
+	}
+
+	for _, testCase := range testCases {
+		status, body := serveError(t, service, testCase.url)
+		if status != testCase.status {
+			t.Errorf("%s: expected status %d, got %d", testCase.url, testCase.status, status)
+		}
+		if body.Error.Code != testCase.code {
+			t.Errorf("%s: expected code %q, got %q", testCase.url, testCase.code, body.Error.Code)
+		}
+		if body.Error.Target != testCase.target {
+			t.Errorf("%s: expected target %q, got %q", testCase.url, testCase.target, body.Error.Target)
+		}
+		if body.Error.Message == "" {
+			t.Errorf("%s: error message is empty", testCase.url)
+		}
+		for _, detail := range body.Error.Details {
+			if detail.Code != testCase.code {
+				t.Errorf("%s: expected detail code %q, got %q", testCase.url, testCase.code, detail.Code)
+			}
+		}
+	}
+}
+
+func TestHTTPHandlerProviderPanic(t *testing.T) {
+	service, err := BuildService(&PanicProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var logged bytes.Buffer
+	service.ErrorLog = log.New(&logged, "", 0)
+
+	status, body := serveError(t, service, "/Customers")
+	if status != 500 {
+		t.Errorf("Expected status 500, got %d", status)
+	}
+	if body.Error.Code != "InternalServerError" {
+		t.Errorf("Expected code InternalServerError, got %q", body.Error.Code)
+	}
+	if strings.Contains(body.Error.Message, "provider exploded") || len(body.Error.Details) != 0 {
+		t.Errorf("Expected the panic value to be withheld from the client, got %+v", body.Error)
+	}
+	if !strings.Contains(logged.String(), "provider exploded") {
+		t.Errorf("Expected the panic value to be logged, got %q", logged.String())
+	}
+}
+
+func TestDefaultErrorFormatterWrapped(t *testing.T) {
+	r := httptest.NewRequest("GET", "/Customers", nil)
+
+	response := DefaultErrorFormatter(r, fmt.Errorf("loading customers: %w", NotFoundError("No such customer")))
+	if response.StatusCode != 404 || response.Error.Code != "NotFound" || response.Error.Message != "No such customer" {
+		t.Errorf("Unexpected response to a wrapped error: %d %+v", response.StatusCode, response.Error)
+	}
+
+	response = DefaultErrorFormatter(r, fmt.Errorf("query failed: %w", &UnsupportedQueryParameterError{"$bogus"}))
+	if response.StatusCode != 400 || response.Error.Target != "$bogus" {
+		t.Errorf("Unexpected response to a wrapped parameter error: %d %+v", response.StatusCode, response.Error)
+	}
+
+	response = DefaultErrorFormatter(r, errors.New("dial tcp 10.0.0.1:5432: connection refused"))
+	if response.StatusCode != 500 || strings.Contains(response.Error.Message, "10.0.0.1") {
+		t.Errorf("Unexpected response to an internal error: %d %+v", response.StatusCode, response.Error)
+	}
+
+	// the causes of client errors are described only if they are OData errors
+	response = DefaultErrorFormatter(r, BadRequestError("Invalid customer").
+		SetCause(fmt.Errorf("query failed: %w", errors.New("dial tcp 10.0.0.1:5432: connection refused"))))
+	if response.StatusCode != 400 || len(response.Error.Details) != 0 {
+		t.Errorf("Unexpected response to a client error: %d %+v", response.StatusCode, response.Error)
+	}
+	response = DefaultErrorFormatter(r, BadRequestError("Invalid customer").SetCause(&GoDataError{Message: "Too old"}))
+	if len(response.Error.Details) != 1 || response.Error.Details[0].Code != "BadRequest" ||
+		response.Error.Details[0].Message != "Too old" {
+		t.Errorf("Unexpected details of a client error: %+v", response.Error.Details)
+	}
+}
+
+func TestHTTPHandlerErrorFormatter(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.ErrorFormatter = func(r *http.Request, err error) *GoDataErrorResponse {
+		response := DefaultErrorFormatter(r, err)
+		response.Error.InnerError = map[string]interface{}{
+			"request-id": r.Header.Get("X-Request-Id"),
+		}
+		return response
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/Customers?$bogus=1", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+	service.GoDataHTTPHandler(w, r)
+
+	var body GoDataErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if body.Error.InnerError["request-id"] != "abc123" {
+		t.Errorf("Expected request id in innererror, got %v", body.Error.InnerError)
+	}
+}
+
+func TestServiceDocument(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	container := service.Metadata.DataServices.Schemas[0].EntityContainers[0]
+	container.Singletons = []*GoDataSingleton{{Name: "Me", Type: "Store.Customer"}}
+	container.FunctionImports = []*GoDataFunctionImport{
+		{Name: "TopCustomers", Function: "Store.TopCustomers", IncludeInServiceDocument: "true"},
+		{Name: "Hidden", Function: "Store.Hidden"},
+	}
+	container.EntitySets = append(container.EntitySets, &GoDataEntitySet{
+		Name: "Internal", EntityType: "Store.Order", IncludeInServiceDocument: "false",
+	})
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+
+	var body struct {
+		Context string `json:"@odata.context"`
+		Value   []struct {
+			Name string `json:"name"`
+			Kind string `json:"kind"`
+			Url  string `json:"url"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if body.Context != "http://localhost/$metadata" {
+		t.Errorf("@odata.context is %q", body.Context)
+	}
+
+	expected := []string{
+		"Customers EntitySet Customers",
+		"Orders EntitySet Orders",
+		"Me Singleton Me",
+		"TopCustomers FunctionImport TopCustomers",
+	}
+	if len(body.Value) != len(expected) {
+		t.Errorf("Expected %d resources, got %+v", len(expected), body.Value)
+		return
+	}
+	for i, v := range body.Value {
+		if actual := v.Name + " " + v.Kind + " " + v.Url; actual != expected[i] {
+			t.Errorf("Expected resource %q, got %q", expected[i], actual)
+		}
+	}
+}
+
+func TestServiceDocumentFormat(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.AttachMiddleware(&GoDataMiddleware{
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			response.Fields["@Store.version"] = &GoDataResponseField{Value: "2"}
+			return nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/?$format=application/json%3Bodata.metadata=none", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := body[ODataFieldContext]; ok {
+		t.Errorf("Expected no @odata.context with odata.metadata=none, got %s", w.Body.String())
+	}
+	if body["@Store.version"] != "2" {
+		t.Errorf("Expected the response middleware to run, got %s", w.Body.String())
+	}
+}
+
+// A provider serving a fixed set of customers, keyed by name.
+type CustomerProvider struct {
+	DummyProvider
+}
+
+var testCustomers = map[string]map[string]*GoDataResponseField{
+	"'Bob'":   {"Name": {Value: "Bob"}, "Age": {Value: 42}},
+	"'Alice'": {"Name": {Value: "Alice"}},
+}
+
+func (*CustomerProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	if r.LastSegment.Next != nil {
+		return nil, InternalServerError("GetEntity received a request for more than an entity")
+	}
+	customer, ok := testCustomers[r.LastSegment.Identifier.Get()]
+	if !ok {
+		return nil, NotFoundError("No such customer")
+	}
+	fields := map[string]*GoDataResponseField{}
+	for k, v := range customer {
+		fields[k] = v
+	}
+	return &GoDataResponseField{Value: fields}, nil
+}
+
+// A provider that can retrieve properties directly.
+type CustomerPropertyProvider struct {
+	CustomerProvider
+}
+
+func (*CustomerPropertyProvider) GetProperty(ctx context.Context, r *GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: "direct"}, nil
+}
+
+func TestPropertyResponse(t *testing.T) {
+	service, err := BuildService(&CustomerProvider{}, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')/Age", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+
+	var body struct {
+		Context string `json:"@odata.context"`
+		Value   int    `json:"value"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body.Context != "http://localhost/$metadata#Customers('Bob')/Age" {
+		t.Errorf("@odata.context is %q", body.Context)
+	}
+	if body.Value != 42 {
+		t.Errorf("value is %d", body.Value)
+	}
+
+	// a null property has no content
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Alice')/Age", nil))
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 204 response, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// errors from the provider are passed through
+	status, _ := serveError(t, service, "/Customers('Carol')/Age")
+	if status != 404 {
+		t.Errorf("Expected status 404, got %d", status)
+	}
+
+	// properties must be addressed from a single entity
+	status, _ = serveError(t, service, "/Customers/Age")
+	if status != 400 {
+		t.Errorf("Expected status 400, got %d", status)
+	}
+}
+
+func TestPropertyValueResponse(t *testing.T) {
+	service, err := BuildService(&CustomerProvider{}, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		url         string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/Customers('Bob')/Name/$value", 200, "text/plain;charset=utf-8", "Bob"},
+		{"/Customers('Bob')/Age/$value", 200, "text/plain;charset=utf-8", "42"},
+		{"/Customers('Alice')/Age/$value", 204, "", ""},
+	}
+
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest("GET", testCase.url, nil))
+		if w.Code != testCase.status {
+			t.Errorf("%s: expected status %d, got %d", testCase.url, testCase.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != testCase.contentType {
+			t.Errorf("%s: expected content type %q, got %q", testCase.url, testCase.contentType, ct)
+		}
+		if w.Body.String() != testCase.body {
+			t.Errorf("%s: expected body %q, got %q", testCase.url, testCase.body, w.Body.String())
+		}
+	}
+
+	status, _ := serveError(t, service, "/Customers('Bob')/$value")
+	if status != 400 {
+		t.Errorf("Expected status 400 for $value without property, got %d", status)
+	}
+}
+
+// A provider that returns the same entity to every request, as a cache would.
+type SharedCustomerProvider struct {
+	CustomerProvider
+	Shared map[string]*GoDataResponseField
+}
+
+func (p *SharedCustomerProvider) GetEntity(r *GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: p.Shared}, nil
+}
+
+func (p *SharedCustomerProvider) GetEntityCollection(r *GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: []*GoDataResponseField{{Value: p.Shared}}}, nil
+}
+
+func TestSharedProviderResult(t *testing.T) {
+	provider := &SharedCustomerProvider{Shared: map[string]*GoDataResponseField{
+		"Name": {Value: "Bob"}, "Age": {Value: 42}, ODataFieldETag: {Value: `W/"1"`},
+	}}
+	service, err := BuildService(provider, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')", nil))
+			if w.Code != 200 || !strings.Contains(w.Body.String(), ODataFieldContext) {
+				t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(provider.Shared) != 3 {
+		t.Errorf("Expected the provider result to be left unchanged, got %v", provider.Shared)
+	}
+}
+
+func TestPropertyProvider(t *testing.T) {
+	service, err := BuildService(&CustomerPropertyProvider{}, "http://localhost/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers('Bob')/Name/$value", nil))
+	if w.Body.String() != "direct" {
+		t.Errorf("Expected value from GetProperty, got %q", w.Body.String())
+	}
+}
+
+// A provider that records the entities created through it.
+type WritableCustomerProvider struct {
+	CustomerProvider
+	Created []map[string]*GoDataResponseField
+}
+
+func (p *WritableCustomerProvider) CreateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	fields := entity.Value.(map[string]*GoDataResponseField)
+	p.Created = append(p.Created, fields)
+	return entity, nil
+}
+
+// A provider that records the updates and deletions made through it.
+type EditableCustomerProvider struct {
+	WritableCustomerProvider
+	Updated  []map[string]*GoDataResponseField
+	Replaced []map[string]*GoDataResponseField
+	Deleted  []string
+}
+
+func (p *EditableCustomerProvider) UpdateEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	p.Updated = append(p.Updated, entity.Value.(map[string]*GoDataResponseField))
+	return entity, nil
+}
+
+func (p *EditableCustomerProvider) ReplaceEntity(ctx context.Context, r *GoDataRequest, entity *GoDataResponseField) (*GoDataResponseField, error) {
+	p.Replaced = append(p.Replaced, entity.Value.(map[string]*GoDataResponseField))
+	return entity, nil
+}
+
+func (p *EditableCustomerProvider) DeleteEntity(ctx context.Context, r *GoDataRequest) error {
+	if _, ok := testCustomers[r.LastSegment.Identifier.Get()]; !ok {
+		return NotFoundError("No such customer")
+	}
+	p.Deleted = append(p.Deleted, r.LastSegment.Identifier.Get())
+	return nil
+}
+
+// Build a service whose customers are keyed by name and must have an age.
+func buildWritableService(t *testing.T, provider GoDataProvider) *GoDataService {
+	service, err := BuildService(provider, "http://localhost/odata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, err := service.LookupEntityType("Customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer.Key = &GoDataKey{PropertyRefs: []*GoDataPropertyRef{{Name: "Name"}}}
+	service.PropertyLookup[customer]["Age"].Nullable = "false"
+	return service
+}
+
+func TestCreateEntity(t *testing.T) {
+	provider := &WritableCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"O'Neil","Age":30,"@odata.type":"#Store.Customer"}`))
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 201 {
+		t.Errorf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if location := w.Header().Get("Location"); location != "http://localhost/odata/Customers('O''Neil')" {
+		t.Errorf("Location is %q", location)
+	}
+
+	var body struct {
+		Context string `json:"@odata.context"`
+		Name    string
+		Age     int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body.Context != "http://localhost/odata/$metadata#Customers/$entity" {
+		t.Errorf("@odata.context is %q", body.Context)
+	}
+	if body.Name != "O'Neil" || body.Age != 30 {
+		t.Errorf("Unexpected entity in response: %s", w.Body.String())
+	}
+
+	if len(provider.Created) != 1 {
+		t.Errorf("Expected 1 created entity, got %d", len(provider.Created))
+		return
+	}
+	if age := provider.Created[0]["Age"].Value; age != 30 {
+		t.Errorf("Provider received age %#v", age)
+	}
+	if _, ok := provider.Created[0]["@odata.type"]; ok {
+		t.Error("Provider received an annotation as a property")
+	}
+}
+
+func TestCreateEntityMinimal(t *testing.T) {
+	service := buildWritableService(t, &WritableCustomerProvider{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"Carol","Age":30}`))
+	r.Header.Set("Prefer", "return=minimal")
+	service.GoDataHTTPHandler(w, r)
+
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 204 response, got %d: %s", w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "http://localhost/odata/Customers('Carol')" {
+		t.Errorf("Location is %q", location)
+	}
+	if applied := w.Header().Get("Preference-Applied"); applied != "return=minimal" {
+		t.Errorf("Preference-Applied is %q", applied)
+	}
+}
+
+func TestCreateEntityErrors(t *testing.T) {
+	service := buildWritableService(t, &WritableCustomerProvider{})
+
+	testCases := []struct {
+		url    string
+		body   string
+		status int
+		target string
+	}{
+		{"/odata/Customers", `{"Name":"Carol","Age":"old"}`, 400, "Age"},
+		{"/odata/Customers", `{"Name":"Carol","Age":3000000000}`, 400, "Age"},
+		{"/odata/Customers", `{"Name":"Carol","Age":null}`, 400, "Age"},
+		{"/odata/Customers", `{"Name":"Carol"}`, 400, "Age"},
+		{"/odata/Customers", `{"Name":"Carol","Age":1,"Height":180}`, 400, "Height"},
+		{"/odata/Customers", `{"Name":"Carol","Age":1,"Orders":[]}`, 501, "Orders"},
+		{"/odata/Customers", `[{"Name":"Carol"}]`, 400, ""},
+		{"/odata/Customers('Bob')", `{"Name":"Carol","Age":1}`, 405, ""},
+	}
+
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest("POST", testCase.url, strings.NewReader(testCase.body)))
+
+		var body GoDataErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == nil {
+			t.Errorf("%s: failed to decode error body %q", testCase.body, w.Body.String())
+			continue
+		}
+		if w.Code != testCase.status {
+			t.Errorf("%s: expected status %d, got %d", testCase.body, testCase.status, w.Code)
+		}
+		if body.Error.Target != testCase.target {
+			t.Errorf("%s: expected target %q, got %q", testCase.body, testCase.target, body.Error.Target)
+		}
+	}
+
+	// providers must opt in to writes
+	service = buildWritableService(t, &CustomerProvider{})
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("POST", "/odata/Customers", strings.NewReader(`{"Name":"Carol","Age":1}`)))
+	if w.Code != 405 {
+		t.Errorf("Expected status 405 for read-only provider, got %d", w.Code)
+	}
+}
+
+func TestUpdateEntity(t *testing.T) {
+	provider := &EditableCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	// PATCH merges, so required properties may be omitted
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("PATCH", "/odata/Customers('Bob')", strings.NewReader(`{"Age":43}`)))
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 204 response, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Updated) != 1 || provider.Updated[0]["Age"].Value != 43 {
+		t.Errorf("Provider did not receive the update: %v", provider.Updated)
+	}
+
+	// PUT replaces, so required properties must be present
+	w = httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("PUT", "/odata/Customers('Bob')", strings.NewReader(`{"Name":"Bob"}`)))
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for incomplete PUT, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/odata/Customers('Bob')", strings.NewReader(`{"Name":"Bob","Age":44}`))
+	r.Header.Set("Prefer", "return=representation")
+	service.GoDataHTTPHandler(w, r)
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Replaced) != 1 || provider.Replaced[0]["Age"].Value != 44 {
+		t.Errorf("Provider did not receive the replacement: %v", provider.Replaced)
+	}
+	var body struct {
+		Context string `json:"@odata.context"`
+		Age     int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Error(err)
+		return
+	}
+	if body.Context != "http://localhost/odata/$metadata#Customers/$entity" || body.Age != 44 {
+		t.Errorf("Unexpected representation: %s", w.Body.String())
+	}
+}
+
+func TestUpdateEntityErrors(t *testing.T) {
+	service := buildWritableService(t, &EditableCustomerProvider{})
+
+	testCases := []struct {
+		method string
+		url    string
+		body   string
+		status int
+		target string
+	}{
+		{"PATCH", "/odata/Customers('Bob')", `{"Name":"Robert"}`, 400, "Name"},
+		{"PATCH", "/odata/Customers('Bob')", `{"Name":null}`, 400, "Name"},
+		{"PATCH", "/odata/Customers('Bob')", `{"Age":null}`, 400, "Age"},
+		{"PATCH", "/odata/Customers", `{"Age":1}`, 405, ""},
+		{"PUT", "/odata/Customers", `{"Age":1}`, 405, ""},
+		{"DELETE", "/odata/Customers", ``, 405, ""},
+		{"DELETE", "/odata/Customers('Carol')", ``, 404, ""},
+		{"OPTIONS", "/odata/Customers", ``, 405, ""},
+	}
+
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest(testCase.method, testCase.url, strings.NewReader(testCase.body)))
+
+		var body GoDataErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == nil {
+			t.Errorf("%s %s: failed to decode error body %q", testCase.method, testCase.body, w.Body.String())
+			continue
+		}
+		if w.Code != testCase.status {
+			t.Errorf("%s %s: expected status %d, got %d", testCase.method, testCase.body, testCase.status, w.Code)
+		}
+		if body.Error.Target != testCase.target {
+			t.Errorf("%s %s: expected target %q, got %q", testCase.method, testCase.body, testCase.target, body.Error.Target)
+		}
+	}
+
+	// the key may be repeated if it is unchanged
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("PATCH", "/odata/Customers('Bob')", strings.NewReader(`{"Name":"Bob"}`)))
+	if w.Code != 204 {
+		t.Errorf("Expected status 204 for unchanged key, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// providers must opt in to updates and deletes
+	service = buildWritableService(t, &WritableCustomerProvider{})
+	for _, method := range []string{"PATCH", "PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		service.GoDataHTTPHandler(w, httptest.NewRequest(method, "/odata/Customers('Bob')", strings.NewReader(`{"Age":1}`)))
+		if w.Code != 405 {
+			t.Errorf("%s: expected status 405 for provider without support, got %d", method, w.Code)
+		}
+	}
+}
+
+func TestDeleteEntity(t *testing.T) {
+	provider := &EditableCustomerProvider{}
+	service := buildWritableService(t, provider)
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("DELETE", "/odata/Customers('Bob')", nil))
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 204 response, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(provider.Deleted) != 1 || provider.Deleted[0] != "'Bob'" {
+		t.Errorf("Provider did not receive the deletion: %v", provider.Deleted)
+	}
+}
+
+// A provider that blocks every request until its context is done.
+type BlockingProvider struct {
+	DummyProvider
+	done chan error
+}
+
+func (p *BlockingProvider) GetEntity(ctx context.Context, r *GoDataRequest) (*GoDataResponseField, error) {
+	return nil, nil
+}
+
+func (p *BlockingProvider) GetEntityCollection(ctx context.Context, r *GoDataRequest) (*GoDataResponseField, error) {
+	<-ctx.Done()
+	p.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (p *BlockingProvider) GetCount(ctx context.Context, r *GoDataRequest) (int, error) {
+	return 0, nil
+}
+
+func TestContextProviderTimeout(t *testing.T) {
+	provider := &BlockingProvider{done: make(chan error, 1)}
+	service, err := BuildContextService(provider, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.RequestTimeout = 10 * time.Millisecond
+
+	status, body := serveError(t, service, "/Customers")
+	if status != 504 {
+		t.Errorf("Expected status 504, got %d", status)
+	}
+	if body.Error.Code != "GatewayTimeout" {
+		t.Errorf("Expected code GatewayTimeout, got %q", body.Error.Code)
+	}
+
+	select {
+	case err := <-provider.done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Provider context ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Provider context was not canceled")
+	}
+}
+
+func TestContextProviderCanceled(t *testing.T) {
+	provider := &BlockingProvider{done: make(chan error, 1)}
+	service, err := BuildContextService(provider, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the client goes away while the provider is working
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	w := httptest.NewRecorder()
+	service.GoDataHTTPHandler(w, httptest.NewRequest("GET", "/Customers", nil).WithContext(ctx))
+	if w.Code != 503 {
+		t.Errorf("Expected status 503, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case err := <-provider.done:
+		if err != context.Canceled {
+			t.Errorf("Provider context ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Provider context was not canceled")
+	}
+}
+
 func BenchmarkBuildProvider(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		provider := &DummyProvider{}
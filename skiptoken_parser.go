@@ -0,0 +1,420 @@
+package godata
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// The serialized form of a skip token. Skip tokens are opaque to clients, so
+// the format only needs to be understood by this package.
+type skipTokenJson struct {
+	OrderBy []interface{}          `json:"o,omitempty"`
+	Key     map[string]interface{} `json:"k"`
+}
+
+// Decode a $skiptoken issued by the service in an @odata.nextLink.
+func ParseSkipTokenString(ctx context.Context, skiptoken string) (*GoDataSkipTokenQuery, error) {
+	data, err := base64.RawURLEncoding.DecodeString(skiptoken)
+	if err != nil {
+		return nil, BadRequestError("Invalid $skiptoken query option").SetCause(err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var token skipTokenJson
+	if err := decoder.Decode(&token); err != nil || token.Key == nil {
+		return nil, BadRequestError("Invalid $skiptoken query option").SetCause(err)
+	}
+
+	result := &GoDataSkipTokenQuery{
+		Key:      map[string]interface{}{},
+		RawValue: skiptoken,
+		rawToken: &token,
+	}
+	for _, value := range token.OrderBy {
+		result.OrderByValues = append(result.OrderByValues, parseDynamicValue(value))
+	}
+	for name, value := range token.Key {
+		result.Key[name] = parseDynamicValue(value)
+	}
+	return result, nil
+}
+
+// Check that a skip token belongs to the collection it is used with, i.e. it
+// has a value for every $orderby item and key property, and convert each
+// value to the Go representation of the type of its property.
+func SemanticizeSkipTokenQuery(skiptoken *GoDataSkipTokenQuery, orderby *GoDataOrderByQuery, entity *GoDataEntityType) error {
+	if skiptoken == nil {
+		return nil
+	}
+
+	items := 0
+	if orderby != nil {
+		items = len(orderby.OrderByItems)
+	}
+	if len(skiptoken.OrderByValues) != items {
+		return BadRequestError("The $skiptoken does not match the $orderby query option")
+	}
+
+	keys := entityKeyNames(entity)
+	if len(skiptoken.Key) != len(keys) {
+		return BadRequestError("The $skiptoken does not match the key of entity " + entity.Name)
+	}
+	for _, name := range keys {
+		if _, ok := skiptoken.Key[name]; !ok {
+			return BadRequestError("The $skiptoken does not match the key of entity " + entity.Name)
+		}
+	}
+
+	if skiptoken.rawToken == nil {
+		// not parsed from a $skiptoken, so the values are already typed
+		return nil
+	}
+	for i, item := range orderbyItems(orderby) {
+		value, err := skipTokenValue(propertyType(item.Field), skiptoken.rawToken.OrderBy[i])
+		if err != nil {
+			return BadRequestError("Invalid $skiptoken query option").SetCause(err)
+		}
+		skiptoken.OrderByValues[i] = value
+	}
+	for _, name := range keys {
+		edmType := ""
+		for _, prop := range entity.Properties {
+			if prop.Name == name {
+				edmType = prop.Type
+			}
+		}
+		value, err := skipTokenValue(edmType, skiptoken.rawToken.Key[name])
+		if err != nil {
+			return BadRequestError("Invalid $skiptoken query option").SetCause(err)
+		}
+		skiptoken.Key[name] = value
+	}
+	return nil
+}
+
+// Convert a value of a skip token, or of an entity it is compared with, to
+// the Go representation of the given type: the representation of key values
+// for primitive types, as described for parseKeyLiteral, and []byte for
+// Edm.Binary. JSON has no type for e.g. a Guid or date, so the value of a
+// skip token is a string, and providers may return such values as strings
+// too.
+func skipTokenValue(edmType string, value interface{}) (interface{}, error) {
+	var literal string
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		literal = string(v)
+	case string:
+		if edmType == GoDataString {
+			return v, nil
+		}
+		literal = v
+	case GoDataDateValue:
+		return time.Time(v), nil
+	case GoDataTimeOfDayValue:
+		if edmType == GoDataDuration {
+			return time.Duration(v), nil
+		}
+		return v, nil
+	case time.Duration:
+		if edmType == GoDataTimeOfDay {
+			return GoDataTimeOfDayValue(v), nil
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+
+	if edmType == GoDataBinary {
+		return base64.URLEncoding.DecodeString(literal)
+	}
+	if _, ok := keyPropertyTokenTypes[edmType]; !ok {
+		// an enum or another type without a distinct representation
+		return parseDynamicValue(value), nil
+	}
+	if edmType == GoDataDate && len(literal) > len("2006-01-02") {
+		// a date held in a time.Time is written as a DateTimeOffset
+		edmType = GoDataDateTimeOffset
+	}
+	return parseKeyLiteral(edmType, &GoDataKeyValue{Literal: literal, Token: &Token{Value: literal}})
+}
+
+// Get the type of the property a semanticized token refers to, or "" if it
+// does not refer to a property.
+func propertyType(token *Token) string {
+	if prop, ok := token.SemanticReference.(*GoDataProperty); ok {
+		return prop.Type
+	}
+	return ""
+}
+
+// Get the items of an $orderby query option, which may be missing.
+func orderbyItems(orderby *GoDataOrderByQuery) []*OrderByItem {
+	if orderby == nil {
+		return nil
+	}
+	return orderby.OrderByItems
+}
+
+// Build the order of the entities of a paged collection, as described for
+// GoDataRequest.PageOrder.
+func (service *GoDataService) pageOrder(request *GoDataRequest, entity *GoDataEntityType) []*OrderByItem {
+	order := append([]*OrderByItem{}, orderbyItems(request.Query.OrderBy)...)
+	for _, name := range entityKeyNames(entity) {
+		ordered := false
+		for _, item := range order {
+			ordered = ordered || item.Field.Value == name
+		}
+		if ordered {
+			continue
+		}
+		field := &Token{Value: name}
+		if prop, ok := service.PropertyLookup[entity][name]; ok {
+			field.SemanticType = SemanticTypeProperty
+			field.SemanticReference = prop
+		}
+		order = append(order, &OrderByItem{Field: field, Order: ASC})
+	}
+	return order
+}
+
+// Build the skip token for the page following the given entity, which must
+// contain the $orderby and key properties of the collection.
+func newSkipToken(entity map[string]*GoDataResponseField, orderby *GoDataOrderByQuery, keys []string) (*GoDataSkipTokenQuery, error) {
+	result := &GoDataSkipTokenQuery{Key: map[string]interface{}{}}
+	if orderby != nil {
+		for _, item := range orderby.OrderByItems {
+			result.OrderByValues = append(result.OrderByValues, fieldValue(entity[item.Field.Value]))
+		}
+	}
+	for _, name := range keys {
+		field, ok := entity[name]
+		if !ok || field == nil || field.Value == nil {
+			return nil, InternalServerError("Provider did not return key property " + name +
+				", so no link to the next page can be built")
+		}
+		result.Key[name] = field.Value
+	}
+
+	// values are written as in a response, so they can be converted back by
+	// the type of their property
+	token := &skipTokenJson{Key: map[string]interface{}{}}
+	for _, value := range result.OrderByValues {
+		raw, err := skipTokenJsonValue(value)
+		if err != nil {
+			return nil, err
+		}
+		token.OrderBy = append(token.OrderBy, raw)
+	}
+	for name, value := range result.Key {
+		raw, err := skipTokenJsonValue(value)
+		if err != nil {
+			return nil, err
+		}
+		token.Key[name] = raw
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, InternalServerError("Cannot build a link to the next page").SetCause(err)
+	}
+	result.RawValue = base64.RawURLEncoding.EncodeToString(data)
+	return result, nil
+}
+
+// Write a value of a skip token as JSON.
+func skipTokenJsonValue(value interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := writeJsonValue(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Check if the position of a skip token precedes an entity in the given
+// order of the collection, which starts with the $orderby items the skip
+// token has values for, followed by key properties.
+func (skiptoken *GoDataSkipTokenQuery) precedes(entity map[string]*GoDataResponseField, order []*OrderByItem) bool {
+	for i, item := range order {
+		var position interface{}
+		if i < len(skiptoken.OrderByValues) {
+			position = skiptoken.OrderByValues[i]
+		} else {
+			position = skiptoken.Key[item.Field.Value]
+		}
+		value := fieldValue(entity[item.Field.Value])
+		if typed, err := skipTokenValue(propertyType(item.Field), value); err == nil {
+			value = typed
+		}
+		c := compareValues(position, value)
+		if item.Order == DESC {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// Get the value of a response field, which may be missing.
+func fieldValue(field *GoDataResponseField) interface{} {
+	if field == nil {
+		return nil
+	}
+	return field.Value
+}
+
+// Compare two primitive values, returning -1, 0 or 1. Null is less than any
+// other value. Values that are not both numbers, strings, booleans, binary,
+// Guids, times or durations are compared by their string representation.
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	_, aRat := a.(*big.Rat)
+	_, bRat := b.(*big.Rat)
+	if aRat || bRat {
+		// a Decimal, which may be compared with another number
+		ar, aNum := ratValue(a)
+		br, bNum := ratValue(b)
+		if aNum && bNum {
+			return ar.Cmp(br)
+		}
+	}
+
+	ai, aInt := integerValue(a)
+	bi, bInt := integerValue(b)
+	if aInt && bInt {
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		default:
+			return 0
+		}
+	}
+	af, aNum := floatValue(a)
+	bf, bNum := floatValue(b)
+	if aNum && bNum {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0
+			case bv:
+				return -1
+			default:
+				return 1
+			}
+		}
+	case []byte:
+		if bv, ok := b.([]byte); ok {
+			return bytes.Compare(av, bv)
+		}
+	case [16]byte:
+		if bv, ok := b.([16]byte); ok {
+			return bytes.Compare(av[:], bv[:])
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1
+			case av.After(bv):
+				return 1
+			default:
+				return 0
+			}
+		}
+	case GoDataTimeOfDayValue:
+		if bv, ok := b.(GoDataTimeOfDayValue); ok {
+			return compareValues(int64(av), int64(bv))
+		}
+	case time.Duration:
+		if bv, ok := b.(time.Duration); ok {
+			return compareValues(int64(av), int64(bv))
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func integerValue(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func ratValue(value interface{}) (*big.Rat, bool) {
+	if r, ok := value.(*big.Rat); ok {
+		return r, r != nil
+	}
+	if i, ok := integerValue(value); ok {
+		return new(big.Rat).SetInt64(i), true
+	}
+	if f, ok := floatValue(value); ok {
+		r := new(big.Rat).SetFloat64(f)
+		return r, r != nil
+	}
+	return nil, false
+}
+
+func floatValue(value interface{}) (float64, bool) {
+	if i, ok := integerValue(value); ok {
+		return float64(i), true
+	}
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
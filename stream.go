@@ -0,0 +1,406 @@
+package godata
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+)
+
+// Returned by yield to a streaming provider once the service needs no more
+// entities, e.g. because a page is full.
+var errStreamStopped = errors.New("the service stopped reading the collection")
+
+// Check if collections can be streamed to the client as JSON. This requires a
+// streaming provider, and no middleware that needs the whole response.
+func (service *GoDataService) streamsCollections() bool {
+	if _, ok := service.providerImplementation().(GoDataStreamingProvider); !ok {
+		return false
+	}
+	return !service.hasResponseHooks()
+}
+
+// Pass each entity on the requested page of a collection to a function, in
+// order, and return the link to the next page, if any. A streaming provider
+// produces the entities one at a time; any other provider is asked for the
+// whole collection with GetEntityCollection. If the function returns an
+// error, the collection is abandoned and the error is returned.
+func (service *GoDataService) eachCollectionEntity(
+	r *http.Request,
+	request *GoDataRequest,
+	fn func(map[string]*GoDataResponseField) error,
+) (string, error) {
+	pager, err := service.newCollectionPager(r, request)
+	if err != nil {
+		return "", err
+	}
+	add := func(entity *GoDataResponseField) error {
+		fields, err := pager.add(entity)
+		if err != nil {
+			return err
+		}
+		if pager.done {
+			return errStreamStopped
+		}
+		if fields == nil {
+			return nil
+		}
+		return fn(fields)
+	}
+
+	provider, ok := service.providerImplementation().(GoDataStreamingProvider)
+	if !ok {
+		result := <-service.callProvider(r, request, "GetEntityCollection", func() (*GoDataResponseField, error) {
+			return service.Provider.GetEntityCollection(r.Context(), request)
+		})
+		if result.Error != nil {
+			return "", result.Error
+		}
+		var entities []*GoDataResponseField
+		if result.Field != nil {
+			entities, ok = result.Field.Value.([]*GoDataResponseField)
+		}
+		if !ok {
+			return "", InternalServerError("Provider did not return a valid response from GetEntityCollection()")
+		}
+		for _, entity := range entities {
+			if err := add(entity); err == errStreamStopped {
+				break
+			} else if err != nil {
+				return "", err
+			}
+		}
+		return pager.nextLink, nil
+	}
+
+	// The provider runs in its own goroutine, so the entities are handed over
+	// to this one, which owns the response writer. Once stop is closed, the
+	// provider is told to stop rather than left blocked.
+	entities := make(chan *GoDataResponseField)
+	stop := make(chan struct{})
+	results := service.callProvider(r, request, "StreamEntityCollection", func() (*GoDataResponseField, error) {
+		return nil, provider.StreamEntityCollection(r.Context(), request, func(entity *GoDataResponseField) error {
+			select {
+			case entities <- entity:
+				return nil
+			case <-stop:
+				return errStreamStopped
+			}
+		})
+	})
+	for {
+		select {
+		case entity := <-entities:
+			if err := add(entity); err != nil {
+				// wait for the provider to stop, or the request to end
+				close(stop)
+				<-results
+				if err == errStreamStopped {
+					return pager.nextLink, nil
+				}
+				return "", err
+			}
+		case result := <-results:
+			close(stop)
+			if result.Error != nil && result.Error != errStreamStopped {
+				return "", result.Error
+			}
+			return pager.nextLink, nil
+		}
+	}
+}
+
+// Write a collection as JSON one entity at a time, as it is produced by a
+// streaming provider. Each entity is written as soon as it is produced, and
+// the link to the next page follows the entities. Once the first entity has
+// been written, errors can no longer be reported to the client, so the
+// response is cut short instead.
+func (service *GoDataService) writeCollectionStream(w http.ResponseWriter, r *http.Request, request *GoDataRequest, preferenceApplied string) error {
+	format := request.Query.Format
+	if format == nil {
+		format = &GoDataFormatQuery{MediaType: "application/json"}
+	}
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return err
+	}
+
+	header := map[string]*GoDataResponseField{}
+	if format.Metadata != ODataMetadataNone {
+		contextUrl, err := service.collectionContextUrl(request)
+		if err != nil {
+			return err
+		}
+		header[ODataFieldContext] = &GoDataResponseField{Value: contextUrl}
+	}
+	if request.Query.Count != nil && bool(*request.Query.Count) {
+		count := <-service.callProvider(r, request, "GetCount", func() (*GoDataResponseField, error) {
+			result, err := service.Provider.GetCount(r.Context(), request)
+			return &GoDataResponseField{result}, err
+		})
+		if count.Error != nil {
+			return count.Error
+		}
+		if format.IEEE754Compatible {
+			count.Field = &GoDataResponseField{Value: formatIEEE754(GoDataInt64, count.Field.Value)}
+		}
+		header[ODataFieldCount] = count.Field
+	}
+
+	// The opening of the response is written along with the first entity,
+	// so an error before then can still be reported.
+	var buf bytes.Buffer
+	written := false
+	begin := func() error {
+		w.Header().Set("Content-Type", responseContentType(request))
+		if preferenceApplied != "" {
+			w.Header().Set("Preference-Applied", preferenceApplied)
+		}
+		buf.WriteByte('{')
+		if err := writeJsonMembers(&buf, header, nil, true); err != nil {
+			return err
+		}
+		if len(header) > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + ODataFieldValue + `":[`)
+		return nil
+	}
+
+	shaped := format.Metadata == ODataMetadataFull || format.Metadata == ODataMetadataNone || format.IEEE754Compatible
+	order := service.propertyOrder(r, request, entityType)
+	nextLink, err := service.eachCollectionEntity(r, request, func(fields map[string]*GoDataResponseField) error {
+		if shaped {
+			var err error
+			if fields, err = service.formatEntity(format, entitySet, entityType, fields); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+		if !written {
+			if err := begin(); err != nil {
+				return err
+			}
+		} else {
+			buf.WriteByte(',')
+		}
+		fields = service.orderExpanded(r, request, fields, entityType)
+		if err := writeJsonObject(&buf, fields, order); err != nil {
+			return err
+		}
+		written = true
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		if !written {
+			return err
+		}
+		return nil
+	}
+
+	buf.Reset()
+	if !written {
+		if err := begin(); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	if nextLink != "" {
+		link := map[string]*GoDataResponseField{ODataFieldNextLink: {Value: nextLink}}
+		if err := writeJsonMembers(&buf, link, nil, false); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	// The client may have gone away; there is no one left to report this to.
+	_, _ = w.Write(buf.Bytes())
+	return nil
+}
+
+// Write a collection as CSV or NDJSON, one entity at a time. A link to the
+// next page is given in a Link header, as these formats have no place for
+// control information, so a count cannot be requested. A paged collection is
+// collected before it is written, as the header must precede it; otherwise
+// each entity is written as soon as it is produced. If middleware has response
+// hooks, the collection is collected and passed to them as the JSON response
+// would be, so they apply to every format. Once the first entity has been
+// written, errors can no longer be reported to the client, so the response is
+// cut short instead.
+func (service *GoDataService) writeCollectionRows(w http.ResponseWriter, r *http.Request, request *GoDataRequest, preferenceApplied string) error {
+	format := request.Query.Format
+	if request.Query.Count != nil && bool(*request.Query.Count) {
+		return BadRequestError("A count cannot be included in a " + format.MediaType + " response").
+			SetTarget("$count")
+	}
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return err
+	}
+
+	var writer GoDataRowWriter
+	if format.MediaType == "text/csv" {
+		columns, err := service.csvColumns(request)
+		if err != nil {
+			return err
+		}
+		if writer, err = NewCsvWriter(w, columns); err != nil {
+			return err
+		}
+	} else {
+		writer = NewNdjsonWriter(w, service.propertyOrder(r, request, entityType))
+	}
+	setHeaders := func(nextLink string) {
+		w.Header().Set("Content-Type", responseContentType(request))
+		if preferenceApplied != "" {
+			w.Header().Set("Preference-Applied", preferenceApplied)
+		}
+		if nextLink != "" {
+			w.Header().Set("Link", "<"+nextLink+">; rel=\"next\"")
+		}
+	}
+	shaped := format.Metadata == ODataMetadataFull || format.Metadata == ODataMetadataNone || format.IEEE754Compatible
+	shape := func(fields map[string]*GoDataResponseField) (map[string]*GoDataResponseField, error) {
+		if shaped {
+			var err error
+			if fields, err = service.formatEntity(format, entitySet, entityType, fields); err != nil {
+				return nil, err
+			}
+		}
+		return service.orderExpanded(r, request, fields, entityType), nil
+	}
+
+	if hooked := service.hasResponseHooks(); hooked || request.PageSize > 0 {
+		// the page is no larger than the page size, or the hooks need all of
+		// the collection at once
+		page := []*GoDataResponseField{}
+		nextLink, err := service.eachCollectionEntity(r, request, func(fields map[string]*GoDataResponseField) error {
+			page = append(page, &GoDataResponseField{Value: fields})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if page, nextLink, err = service.runCollectionHooks(r, request, page, nextLink); err != nil {
+			return err
+		}
+		setHeaders(nextLink)
+		for i, entity := range page {
+			fields, ok := entity.Value.(map[string]*GoDataResponseField)
+			if !ok {
+				return InternalServerError("A response hook did not return a valid collection")
+			}
+			if hooked {
+				// the page was shaped along with the response passed to the hooks
+				fields = service.orderExpanded(r, request, fields, entityType)
+			} else if fields, err = shape(fields); err != nil {
+				return err
+			}
+			if err := writer.WriteEntity(fields); err != nil {
+				if i == 0 {
+					// nothing has been written yet
+					return err
+				}
+				return nil
+			}
+		}
+		_ = writer.Close()
+		return nil
+	}
+
+	written := false
+	_, err = service.eachCollectionEntity(r, request, func(fields map[string]*GoDataResponseField) error {
+		fields, err := shape(fields)
+		if err != nil {
+			return err
+		}
+		if !written {
+			setHeaders("")
+		}
+		if err := writer.WriteEntity(fields); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
+	if err != nil {
+		if !written {
+			return err
+		}
+		return nil
+	}
+	if !written {
+		setHeaders("")
+	}
+	_ = writer.Close()
+	return nil
+}
+
+// Pass a page of a collection written as rows to the response hooks of the
+// attached middleware, as part of the JSON response it would otherwise be
+// written as, and return the page and next link the hooks leave.
+func (service *GoDataService) runCollectionHooks(
+	r *http.Request,
+	request *GoDataRequest,
+	page []*GoDataResponseField,
+	nextLink string,
+) ([]*GoDataResponseField, string, error) {
+	if !service.hasResponseHooks() {
+		return page, nextLink, nil
+	}
+	contextUrl, err := service.collectionContextUrl(request)
+	if err != nil {
+		return nil, "", err
+	}
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		ODataFieldContext: {Value: contextUrl},
+		ODataFieldValue:   {Value: page},
+	}}
+	if nextLink != "" {
+		response.Fields[ODataFieldNextLink] = &GoDataResponseField{Value: nextLink}
+	}
+	if err := service.applyFormat(r, request, response); err != nil {
+		return nil, "", err
+	}
+	if err := service.runResponseHooks(r, request, response); err != nil {
+		return nil, "", err
+	}
+
+	value := response.Fields[ODataFieldValue]
+	if value == nil {
+		return nil, "", InternalServerError("A response hook did not return a valid collection")
+	}
+	if page, _ = value.Value.([]*GoDataResponseField); page == nil {
+		return nil, "", InternalServerError("A response hook did not return a valid collection")
+	}
+	nextLink = ""
+	if link := response.Fields[ODataFieldNextLink]; link != nil {
+		nextLink, _ = link.Value.(string)
+	}
+	return page, nextLink, nil
+}
+
+// The columns of a CSV response: the selected properties, or else every
+// property of the entity type, in declaration order.
+func (service *GoDataService) csvColumns(request *GoDataRequest) ([]string, error) {
+	columns := []string{}
+	if request.Query.Select != nil {
+		for _, item := range request.Query.Select.SelectItems {
+			if prop, ok := item.Segments[0].SemanticReference.(*GoDataProperty); ok {
+				columns = append(columns, prop.Name)
+			}
+		}
+		return columns, nil
+	}
+
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return nil, err
+	}
+	for _, prop := range entityType.Properties {
+		columns = append(columns, prop.Name)
+	}
+	return columns, nil
+}
@@ -0,0 +1,273 @@
+package godata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A provider that streams its customers, as well as returning them from
+// GetEntityCollection.
+type StreamingCustomerProvider struct {
+	PagedCustomerProvider
+	// Fail with an error after this many entities, if positive.
+	failAfter int
+	// The number of entities yielded, and the error returned by yield, by
+	// the last stream.
+	yielded int
+	stopped error
+}
+
+func (p *StreamingCustomerProvider) StreamEntityCollection(
+	ctx context.Context,
+	r *GoDataRequest,
+	yield func(*GoDataResponseField) error,
+) error {
+	p.yielded, p.stopped = 0, nil
+	for i := 0; i < 10; i++ {
+		name := string(rune('A' + i))
+		if p.seek && r.Query.SkipToken != nil && name <= r.Query.SkipToken.Key["Name"].(string) {
+			continue
+		}
+		if p.failAfter > 0 && p.yielded == p.failAfter {
+			return InternalServerError("The stream broke")
+		}
+		err := yield(&GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"Name": {Value: name},
+			"Age":  {Value: 20 + i%3},
+		}})
+		if err != nil {
+			p.stopped = err
+			return err
+		}
+		p.yielded++
+	}
+	return nil
+}
+
+func (p *StreamingCustomerProvider) GetCount(r *GoDataRequest) (int, error) {
+	return 10, nil
+}
+
+func TestResponseWriteJson(t *testing.T) {
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		"value": {Value: []*GoDataResponseField{
+			{Value: map[string]*GoDataResponseField{"Name": {Value: `"Bob"`}, "Age": {Value: 42}}},
+			{Value: 1.5},
+		}},
+	}}
+	expected, err := response.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := response.WriteJson(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != string(expected) {
+		t.Errorf("WriteJson wrote %s, Json returned %s", buf.String(), expected)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Error(err)
+	}
+
+	field := &GoDataResponseField{Value: struct{}{}}
+	if err := field.WriteJson(&buf); err == nil {
+		t.Error("Expected an error for an unsupported type")
+	}
+}
+
+func TestStreamingPages(t *testing.T) {
+	for _, seek := range []bool{false, true} {
+		provider := &StreamingCustomerProvider{PagedCustomerProvider: PagedCustomerProvider{seek: seek}}
+		service := buildWritableService(t, provider)
+		service.MaxPageSize = 4
+
+		pages := getPages(t, service, "/odata/Customers", "")
+		if fmt.Sprint(pages) != "[ABCD EFGH IJ]" {
+			t.Errorf("seek %v: unexpected pages %v", seek, pages)
+		}
+		if len(provider.requests) != 0 {
+			t.Errorf("seek %v: GetEntityCollection was called", seek)
+		}
+
+		// the provider is stopped once it produces an entity past the page
+		getPage(t, service, "/odata/Customers", "")
+		if provider.yielded != 5 || provider.stopped != errStreamStopped {
+			t.Errorf("seek %v: provider yielded %d entities and stopped with %v", seek, provider.yielded, provider.stopped)
+		}
+	}
+}
+
+func TestStreamingControlInformation(t *testing.T) {
+	service := buildWritableService(t, &StreamingCustomerProvider{})
+
+	var body map[string]interface{}
+	w := getWithAccept(service, "/odata/Customers?$count=true", "application/json;IEEE754Compatible=true")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Errorf("%v: %s", err, w.Body.String())
+		return
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if body["@odata.context"] != "http://localhost/odata/$metadata#Customers" {
+		t.Errorf("Unexpected context %v", body["@odata.context"])
+	}
+	if body["@odata.count"] != "10" {
+		t.Errorf("Unexpected count %#v", body["@odata.count"])
+	}
+	if value, _ := body["value"].([]interface{}); len(value) != 10 {
+		t.Errorf("Unexpected value %v", body["value"])
+	}
+
+	body = nil
+	w = getWithAccept(service, "/odata/Customers", "application/json;odata.metadata=none")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Errorf("%v: %s", err, w.Body.String())
+		return
+	}
+	if _, ok := body["@odata.context"]; ok || len(body) != 1 {
+		t.Errorf("Unexpected control information: %s", w.Body.String())
+	}
+}
+
+func TestStreamingErrors(t *testing.T) {
+	provider := &StreamingCustomerProvider{failAfter: 3}
+	service := buildWritableService(t, provider)
+
+	// the response is cut short once entities have been written
+	w := getWithAccept(service, "/odata/Customers", "")
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.HasSuffix(body, `}`) || json.Valid(w.Body.Bytes()) {
+		t.Errorf("Expected a truncated response, got %s", body)
+	}
+
+	// before then, the error is reported
+	provider.failAfter = 0
+	service.AttachMiddleware(&GoDataMiddleware{
+		Provider: func(r *http.Request, request *GoDataRequest, operation string, next GoDataProviderCall) (*GoDataResponseField, error) {
+			if operation == "StreamEntityCollection" {
+				return nil, GoneError("The collection is gone")
+			}
+			return next()
+		},
+	})
+	w = getWithAccept(service, "/odata/Customers", "")
+	if w.Code != 410 {
+		t.Errorf("Expected status 410, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStreamingResponseHook(t *testing.T) {
+	provider := &StreamingCustomerProvider{}
+	service := buildWritableService(t, provider)
+	service.AttachMiddleware(&GoDataMiddleware{
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			response.Fields["@test.hooked"] = &GoDataResponseField{Value: "yes"}
+			return nil
+		},
+	})
+
+	_, names := getPage(t, service, "/odata/Customers", "")
+	if names != "ABCDEFGHIJ" {
+		t.Errorf("Unexpected customers %s", names)
+	}
+	if len(provider.requests) != 1 || provider.yielded != 0 {
+		t.Error("Expected the collection to be read with GetEntityCollection")
+	}
+}
+
+func TestStreamingRows(t *testing.T) {
+	service := buildWritableService(t, &StreamingCustomerProvider{})
+
+	w := getWithAccept(service, "/odata/Customers?$format=csv&$select=Name", "")
+	if body := w.Body.String(); body != "Name\nA\nB\nC\nD\nE\nF\nG\nH\nI\nJ\n" {
+		t.Errorf("Unexpected CSV %q", body)
+	}
+
+	service.MaxPageSize = 4
+	w = getWithAccept(service, "/odata/Customers?$format=ndjson", "")
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 4 {
+		t.Errorf("Expected 4 lines, got %q", w.Body.String())
+	}
+	if link := w.Header().Get("Link"); !strings.Contains(link, "$skiptoken=") {
+		t.Errorf("Unexpected Link header %q", link)
+	}
+}
+
+func TestRowsResponseHook(t *testing.T) {
+	service := buildWritableService(t, &StreamingCustomerProvider{})
+	service.MaxPageSize = 4
+	// a hook that redacts the age of every customer, and keeps the rest of
+	// the collection from clients that are not authorized
+	service.AttachMiddleware(&GoDataMiddleware{
+		Response: func(r *http.Request, request *GoDataRequest, response *GoDataResponse) error {
+			if r.Header.Get("Authorization") == "" {
+				return NotFoundError("No such collection")
+			}
+			for _, entity := range response.Fields[ODataFieldValue].Value.([]*GoDataResponseField) {
+				delete(entity.Value.(map[string]*GoDataResponseField), "Age")
+			}
+			delete(response.Fields, ODataFieldNextLink)
+			return nil
+		},
+	})
+
+	for _, format := range []string{"csv", "ndjson"} {
+		target := "/odata/Customers?$format=" + format
+		if status, _ := serveError(t, service, target); status != 404 {
+			t.Errorf("%s: expected status 404, got %d", format, status)
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "yes")
+		service.GoDataHTTPHandler(w, r)
+		if w.Code != 200 || strings.Contains(w.Body.String(), "2") {
+			t.Errorf("%s: expected no ages, got %d: %q", format, w.Code, w.Body.String())
+		}
+		if lines := strings.Count(w.Body.String(), "\n"); lines < 4 {
+			t.Errorf("%s: expected the customers, got %q", format, w.Body.String())
+		}
+		if link := w.Header().Get("Link"); link != "" {
+			t.Errorf("%s: expected the hook to remove the next link, got %q", format, link)
+		}
+	}
+}
+
+func TestRowsFormat(t *testing.T) {
+	service := buildWritableService(t, &StreamingCustomerProvider{})
+	customer, err := service.LookupEntityType("Customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.PropertyLookup[customer]["Age"].Type = GoDataInt64
+
+	// NDJSON entities are shaped like the entities of a JSON response
+	w := getWithAccept(service, "/odata/Customers?$format=application/x-ndjson%3BIEEE754Compatible=true%3Bodata.metadata=full", "")
+	line := strings.SplitN(w.Body.String(), "\n", 2)[0]
+	if !strings.Contains(line, `"@odata.id":"http://localhost/odata/Customers('A')"`) || !strings.Contains(line, `"Age":"20"`) {
+		t.Errorf("Unexpected NDJSON entity %q", line)
+	}
+
+	// there is no place for a count
+	for _, format := range []string{"csv", "ndjson"} {
+		status, body := serveError(t, service, "/odata/Customers?$count=true&$format="+format)
+		if status != 400 || body.Error.Target != "$count" {
+			t.Errorf("%s: expected status 400 for $count, got %d: %+v", format, status, body.Error)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package godata
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
@@ -33,6 +34,16 @@ func (req *GoDataRequest) SemanticizeRequest(service *GoDataService) error {
 		if err != nil {
 			return err
 		}
+		if segment.Next == nil {
+			// a key segment may have been folded into the last segment
+			req.LastSegment = segment
+		}
+	}
+
+	if req.LastSegment == nil {
+		// the request is for the service root
+		req.RequestKind = RequestKindService
+		return nil
 	}
 
 	switch req.LastSegment.SemanticReference.(type) {
@@ -44,33 +55,39 @@ func (req *GoDataRequest) SemanticizeRequest(service *GoDataService) error {
 		}
 		err = SemanticizeFilterQuery(req.Query.Filter, service, entityType)
 		if err != nil {
-			return err
+			return queryOptionError(err, "$filter")
 		}
 		err = SemanticizeExpandQuery(req.Query.Expand, service, entityType)
 		if err != nil {
-			return err
+			return queryOptionError(err, "$expand")
 		}
 		err = SemanticizeSelectQuery(req.Query.Select, service, entityType)
 		if err != nil {
-			return err
+			return queryOptionError(err, "$select")
 		}
 		err = SemanticizeOrderByQuery(req.Query.OrderBy, service, entityType)
 		if err != nil {
-			return err
+			return queryOptionError(err, "$orderby")
+		}
+		err = SemanticizeSkipTokenQuery(req.Query.SkipToken, req.Query.OrderBy, entityType)
+		if err != nil {
+			return queryOptionError(err, "$skiptoken")
 		}
 		// TODO: disallow invalid query params
 	case *GoDataEntityType:
 		entityType := req.LastSegment.SemanticReference.(*GoDataEntityType)
 		if err := SemanticizeExpandQuery(req.Query.Expand, service, entityType); err != nil {
-			return err
+			return queryOptionError(err, "$expand")
 		}
 		if err := SemanticizeSelectQuery(req.Query.Select, service, entityType); err != nil {
-			return err
+			return queryOptionError(err, "$select")
 		}
 	}
 
 	if req.LastSegment.SemanticType == SemanticTypeMetadata {
 		req.RequestKind = RequestKindMetadata
+	} else if req.LastSegment.SemanticType == SemanticTypeBatch {
+		req.RequestKind = RequestKindBatch
 	} else if req.LastSegment.SemanticType == SemanticTypeRef {
 		req.RequestKind = RequestKindRef
 	} else if req.LastSegment.SemanticType == SemanticTypeEntitySet {
@@ -79,41 +96,83 @@ func (req *GoDataRequest) SemanticizeRequest(service *GoDataService) error {
 		} else {
 			req.RequestKind = RequestKindEntity
 		}
+	} else if req.LastSegment.SemanticType == SemanticTypeEntity {
+		// a single-valued navigation property
+		req.RequestKind = RequestKindEntity
 	} else if req.LastSegment.SemanticType == SemanticTypeCount {
 		req.RequestKind = RequestKindCount
-	} else if req.FirstSegment == nil && req.LastSegment == nil {
-		req.RequestKind = RequestKindService
+	} else if req.LastSegment.SemanticType == SemanticTypeProperty {
+		req.RequestKind = RequestKindProperty
+	} else if req.LastSegment.SemanticType == SemanticTypePropertyValue {
+		req.RequestKind = RequestKindPropertyValue
 	}
 
 	return nil
 }
 
+// Parse the resource path of a request, relative to the service root, into a
+// linked list of segments. An empty path addresses the service root, and
+// leaves the request without any segments.
 func (req *GoDataRequest) ParseUrlPath(path string) error {
-	parts := strings.Split(path, "/")
-	req.FirstSegment = &GoDataSegment{
-		RawValue:   parts[0],
-		Name:       ParseName(parts[0]),
-		Identifier: ParseIdentifiers(parts[0]),
+	if path == "" {
+		req.FirstSegment = nil
+		req.LastSegment = nil
+		return nil
 	}
-	currSegment := req.FirstSegment
-	for _, v := range parts[1:] {
-		temp := &GoDataSegment{
-			RawValue:   v,
-			Name:       ParseName(v),
-			Identifier: ParseIdentifiers(v),
-			Prev:       currSegment,
+
+	return req.parseUrlSegments(splitPath(path, false))
+}
+
+// Parse a request like ParseRequest, given the escaped resource path of its
+// URL, e.g. from url.URL.EscapedPath. Each segment is unescaped once the path
+// is split, so an escaped slash, e.g. in the key segment Files/a%2Fb, does not
+// separate segments.
+func parseEscapedRequest(ctx context.Context, path string, query url.Values) (*GoDataRequest, error) {
+	r := &GoDataRequest{
+		RequestKind: RequestKindUnknown,
+	}
+
+	if path != "" {
+		parts := splitPath(path, true)
+		for i, part := range parts {
+			unescaped, err := url.PathUnescape(part)
+			if err != nil {
+				return nil, BadRequestError("Invalid escape sequence in segment " + part).SetCause(err)
+			}
+			parts[i] = unescaped
+		}
+		if err := r.parseUrlSegments(parts); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.ParseUrlQuery(ctx, query); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Parse the segments of a resource path into a linked list.
+func (req *GoDataRequest) parseUrlSegments(parts []string) error {
+	var prev *GoDataSegment
+	for _, part := range parts {
+		segment, err := parsePathSegment(part)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			req.FirstSegment = segment
+		} else {
+			segment.Prev = prev
+			prev.Next = segment
 		}
-		currSegment.Next = temp
-		currSegment = temp
+		prev = segment
 	}
-	req.LastSegment = currSegment
+	req.LastSegment = prev
 
 	return nil
 }
 
 func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) error {
-	var err error
-
 	if segment.RawValue == "$metadata" {
 		if segment.Next != nil || segment.Prev != nil {
 			return BadRequestError("A metadata segment must be alone.")
@@ -124,6 +183,15 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 		return nil
 	}
 
+	if segment.RawValue == "$batch" {
+		if segment.Next != nil || segment.Prev != nil {
+			return BadRequestError("A batch segment must be alone.")
+		}
+
+		segment.SemanticType = SemanticTypeBatch
+		return nil
+	}
+
 	if segment.RawValue == "$ref" {
 		// this is a ref segment
 		if segment.Next != nil {
@@ -152,46 +220,45 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 		return nil
 	}
 
-	if _, ok := service.EntitySetLookup[segment.Name]; ok {
+	if _, ok := service.EntitySetLookup[segment.Name]; ok && segment.Prev == nil {
 		// this is an entity set
-		segment.SemanticType = SemanticTypeEntitySet
-		segment.SemanticReference, err = service.LookupEntitySet(segment.Name)
+		entitySet, err := service.LookupEntitySet(segment.Name)
 		if err != nil {
 			return err
 		}
-
-		if segment.Prev == nil {
-			// this is the first segment
-			if segment.Next == nil {
-				// this is the only segment
-				return nil
-			} else {
-				// there is at least one more segment
-				if segment.Identifier != nil {
-					return BadRequestError("An entity set must be the last segment.")
-				}
-				// if it has an identifier, it is allowed
-				return nil
-			}
-		} else if segment.Next == nil {
-			// this is the last segment in a sequence of more than one
-			return nil
-		} else {
-			// this is a middle segment
-			if segment.Identifier != nil {
-				return BadRequestError("An entity set must be the last segment.")
-			}
-			// if it has an identifier, it is allowed
-			return nil
+		entity, err := service.LookupEntityType(entitySet.EntityType)
+		if err != nil {
+			return err
 		}
+		return semanticizeEntitiesSegment(segment, entitySet, entity, true, service)
 	}
 
-	if segment.Prev != nil && segment.Prev.SemanticType == SemanticTypeEntitySet {
-		// previous segment was an entity set
-		semanticRef := segment.Prev.SemanticReference.(*GoDataEntitySet)
+	if segment.RawValue == "$value" {
+		// this is a raw value segment
+		if segment.Next != nil {
+			return BadRequestError("A $value segment must be last.")
+		}
+		if segment.Prev == nil || segment.Prev.SemanticType != SemanticTypeProperty {
+			return BadRequestError("A $value segment must be preceded by a property.")
+		}
+		prop := segment.Prev.SemanticReference.(*GoDataProperty)
+		if !strings.HasPrefix(prop.Type, "Edm.") {
+			return BadRequestError("The raw value of property " + prop.Name + " cannot be requested.")
+		}
 
-		entity, err := service.LookupEntityType(semanticRef.EntityType)
+		segment.SemanticType = SemanticTypePropertyValue
+		segment.SemanticReference = prop
+		return nil
+	}
 
+	if segment.Prev != nil && (segment.Prev.SemanticType == SemanticTypeEntitySet ||
+		segment.Prev.SemanticType == SemanticTypeEntity) {
+		// previous segment was an entity set, or an entity reached by
+		// navigation
+		if segment.Prev.SemanticType == SemanticTypeEntitySet && segment.Prev.Identifier == nil {
+			return BadRequestError("A property must follow a single entity.")
+		}
+		entity, err := segmentEntityType(segment.Prev, service)
 		if err != nil {
 			return err
 		}
@@ -204,12 +271,112 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 			}
 		}
 
+		if nav, ok := service.NavigationPropertyLookup[entity][segment.Name]; ok {
+			return semanticizeNavigationSegment(segment, entity, nav, service)
+		}
+
 		return BadRequestError("A valid entity property must follow entity set.")
 	}
 
 	return BadRequestError("Invalid segment " + segment.RawValue)
 }
 
+// Semanticize a segment that addresses entities of an entity set: the entity
+// set itself, or a navigation property bound to it. A collection may be
+// followed by a key, either in parentheses or, if the service allows it, as a
+// segment of its own.
+func semanticizeEntitiesSegment(segment *GoDataSegment, entitySet *GoDataEntitySet, entity *GoDataEntityType,
+	collection bool, service *GoDataService) error {
+
+	segment.SemanticReference = entitySet
+	if !collection {
+		if segment.Key != nil {
+			return BadRequestError("Navigation property " + segment.Name + " addresses a single entity, so it " +
+				"cannot have a key.")
+		}
+		segment.SemanticType = SemanticTypeEntity
+		return nil
+	}
+
+	segment.SemanticType = SemanticTypeEntitySet
+	if service.KeyAsSegment && segment.Key == nil {
+		if err := foldKeySegment(segment, entity, service); err != nil {
+			return err
+		}
+	}
+	if err := semanticizeKeyPredicate(segment, entity, service); err != nil {
+		return err
+	}
+
+	if segment.Next != nil && segment.Identifier == nil && !strings.HasPrefix(segment.Next.RawValue, "$") {
+		// only a key or a $-segment (e.g. $count) may address into a
+		// collection
+		return BadRequestError("An entity set must have a key to be followed by another segment.")
+	}
+	return nil
+}
+
+// Semanticize a segment that follows a navigation property of the given
+// entity type from the entity addressed by the previous segment. The entities
+// it leads to are those of the entity set the navigation property is bound to
+// by the entity set of the previous segment.
+func semanticizeNavigationSegment(segment *GoDataSegment, entity *GoDataEntityType, nav *GoDataNavigationProperty,
+	service *GoDataService) error {
+
+	source := segment.Prev.SemanticReference.(*GoDataEntitySet)
+	var binding *GoDataNavigationPropertyBinding
+	for _, b := range source.NavigationPropertyBindings {
+		if bindingPathMatches(b.Path, entity, nav, service) {
+			binding = b
+			break
+		}
+	}
+	if binding == nil {
+		return NotImplementedError("Navigation property " + nav.Name + " is not bound to an entity set in " +
+			source.Name + ".")
+	}
+
+	// the target may be qualified, e.g. Shop.Container/Orders
+	target, err := service.LookupEntitySet(strings.ReplaceAll(binding.Target, "/", "."))
+	if err != nil {
+		return err
+	}
+	targetEntity, err := service.LookupEntityType(nav.Type)
+	if err != nil {
+		return err
+	}
+	segment.NavigationProperty = nav
+	return semanticizeEntitiesSegment(segment, target, targetEntity, strings.HasPrefix(nav.Type, "Collection("), service)
+}
+
+// Check if the path of a navigation property binding is the path walked to a
+// navigation property of the given entity type. The path may start with a
+// type cast, e.g. Shop.VipCustomer/Orders, which only matches if it casts to
+// the entity type. Paths through complex properties, e.g. Address/Orders,
+// cannot be walked, so they never match.
+func bindingPathMatches(path string, entity *GoDataEntityType, nav *GoDataNavigationProperty,
+	service *GoDataService) bool {
+
+	if path == nav.Name {
+		return true
+	}
+	i := strings.Index(path, "/")
+	if i < 0 || path[i+1:] != nav.Name || !strings.Contains(path[:i], ".") {
+		return false
+	}
+	cast, err := service.LookupEntityType(path[:i])
+	return err == nil && cast == entity
+}
+
+// Get the type of the entities addressed by a semanticized entity set or
+// navigation segment.
+func segmentEntityType(segment *GoDataSegment, service *GoDataService) (*GoDataEntityType, error) {
+	if segment.NavigationProperty != nil {
+		return service.LookupEntityType(segment.NavigationProperty.Type)
+	}
+	return service.LookupEntityType(segment.SemanticReference.(*GoDataEntitySet).EntityType)
+}
+
 var supportedOdataKeywords = map[string]bool{
 	"$filter":      true,
 	"$apply":       true,
@@ -223,6 +390,7 @@ var supportedOdataKeywords = map[string]bool{
 	"$search":      true,
 	"$compute":     true,
 	"$format":      true,
+	"$skiptoken":   true,
 	"at":           true,
 	"tags":         true,
 }
@@ -286,6 +454,7 @@ func (req *GoDataRequest) ParseUrlQuery(ctx context.Context, query url.Values) e
 	search := query.Get("$search")
 	compute := query.Get("$compute")
 	format := query.Get("$format")
+	skiptoken := query.Get("$skiptoken")
 
 	result := &GoDataQuery{}
 
@@ -294,115 +463,186 @@ func (req *GoDataRequest) ParseUrlQuery(ctx context.Context, query url.Values) e
 		result.Filter, err = ParseFilterString(ctx, filter)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$filter")
 	}
 	if at != "" {
 		result.At, err = ParseFilterString(ctx, at)
 	}
 	if err != nil {
-		return err
-	}
-	if at != "" {
-		result.At, err = ParseFilterString(ctx, at)
-	}
-	if err != nil {
-		return err
+		return queryOptionError(err, "at")
 	}
 	if apply != "" {
 		result.Apply, err = ParseApplyString(ctx, apply)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$apply")
 	}
 	if expand != "" {
 		result.Expand, err = ParseExpandString(ctx, expand)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$expand")
 	}
 	if sel != "" {
 		result.Select, err = ParseSelectString(ctx, sel)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$select")
 	}
 	if orderby != "" {
 		result.OrderBy, err = ParseOrderByString(ctx, orderby)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$orderby")
 	}
 	if top != "" {
 		result.Top, err = ParseTopString(ctx, top)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$top")
 	}
 	if skip != "" {
 		result.Skip, err = ParseSkipString(ctx, skip)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$skip")
 	}
 	if count != "" {
 		result.Count, err = ParseCountString(ctx, count)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$count")
 	}
 	if inlinecount != "" {
 		result.InlineCount, err = ParseInlineCountString(ctx, inlinecount)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$inlinecount")
 	}
 	if search != "" {
 		result.Search, err = ParseSearchString(ctx, search)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$search")
 	}
 	if compute != "" {
 		result.Compute, err = ParseComputeString(ctx, compute)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$compute")
+	}
+	if skiptoken != "" {
+		result.SkipToken, err = ParseSkipTokenString(ctx, skiptoken)
+	}
+	if err != nil {
+		return queryOptionError(err, "$skiptoken")
 	}
 	if format != "" {
-		err = NotImplementedError("Format is not supported")
+		result.Format, err = ParseFormatString(ctx, format)
 	}
 	if err != nil {
-		return err
+		return queryOptionError(err, "$format")
 	}
 	req.Query = result
 	return err
 }
 
+// Record the query option that caused a parse or semantic error as the error
+// target. Errors that are not a GoDataError are reported as bad requests, since
+// they were caused by the value of the query option.
+func queryOptionError(err error, option string) error {
+	var e *GoDataError
+	if errors.As(err, &e) {
+		if e.Target == "" {
+			e.Target = option
+		}
+		return err
+	}
+	return BadRequestError(fmt.Sprintf("Invalid %s query option", option)).SetCause(inputError(err)).SetTarget(option)
+}
+
+// Split a resource path into its segments. Slashes within the string literals
+// of key predicates, e.g. Files('a/b'), do not separate segments. Quotes
+// outside of parentheses, e.g. in the key segment Customers/O'Neil, are part
+// of the segment. If the path is escaped, the quotes and parentheses of key
+// predicates may be escaped too.
+func splitPath(path string, escaped bool) []string {
+	parts := []string{}
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if escaped && c == '%' && i+2 < len(path) {
+			switch strings.ToUpper(path[i+1 : i+3]) {
+			case "27":
+				c = '\''
+			case "28":
+				c = '('
+			case "29":
+				c = ')'
+			}
+		}
+		switch {
+		case c == '\'' && depth > 0:
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == '/' && depth == 0:
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, path[start:])
+}
+
+// Parse a path segment, and the key predicate it ends with, if any.
+func parsePathSegment(raw string) (*GoDataSegment, error) {
+	segment := &GoDataSegment{RawValue: raw, Name: ParseName(raw)}
+	open := strings.Index(raw, "(")
+	if open < 0 {
+		return segment, nil
+	}
+	if !strings.HasSuffix(raw, ")") {
+		return nil, BadRequestError("Invalid key predicate in segment " + raw)
+	}
+	key, err := ParseKeyPredicate(context.Background(), raw[open+1:len(raw)-1])
+	if err != nil {
+		return nil, err
+	}
+	segment.Key = key
+	segment.Identifier = keyIdentifier(key)
+	return segment, nil
+}
+
+// Parse the identifiers in the key predicate of a segment, e.g. Employee(1).
+// Returns nil if the segment has no key predicate, or an invalid one.
 func ParseIdentifiers(segment string) *GoDataIdentifier {
-	if !(strings.Contains(segment, "(") && strings.Contains(segment, ")")) {
+	parsed, err := parsePathSegment(segment)
+	if err != nil {
 		return nil
 	}
+	return parsed.Identifier
+}
 
-	rawIds := segment[strings.LastIndex(segment, "(")+1 : strings.LastIndex(segment, ")")]
-	parts := strings.Split(rawIds, ",")
-
+// Map each named key value to its literal, and each positional key value to
+// an empty string.
+func keyIdentifier(key []*GoDataKeyValue) *GoDataIdentifier {
 	result := make(GoDataIdentifier)
-
-	for _, v := range parts {
-		if strings.Contains(v, "=") {
-			split := strings.SplitN(v, "=", 2)
-			result[split[0]] = split[1]
+	for _, value := range key {
+		if value.Name == "" {
+			result[value.Literal] = ""
 		} else {
-			result[v] = ""
+			result[value.Name] = value.Literal
 		}
 	}
-
 	return &result
 }
 
 func ParseName(segment string) string {
 	if strings.Contains(segment, "(") {
-		return segment[:strings.LastIndex(segment, "(")]
+		return segment[:strings.Index(segment, "(")]
 	} else {
 		return segment
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -235,6 +236,94 @@ func TestUrlParserStrictValidation(t *testing.T) {
 
 // TestUnescapeStringTokens tests string encoding rules specified in the ODATA ABNF:
 // http://docs.oasis-open.org/odata/odata/v4.01/odata-v4.01-part2-url-conventions.html#sec_URLSyntax
+func TestSemanticizeNavigation(t *testing.T) {
+	metadata, err := buildTestModel()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service, err := BuildService(&ModelProvider{metadata: metadata}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	const order = "01234567-89ab-cdef-0123-456789abcdef"
+
+	testCases := []struct {
+		path         string
+		keyAsSegment bool
+		kind         RequestKind
+		// the entity set or property of each segment
+		references []string
+	}{
+		{"Customers('Bob')/Orders", false, RequestKindCollection, []string{"Customers", "Orders"}},
+		{"Customers('Bob')/Orders(" + order + ")", false, RequestKindEntity, []string{"Customers", "Orders"}},
+		{"Orders(" + order + ")/Customer", false, RequestKindEntity, []string{"Orders", "Customers"}},
+		{"Orders(" + order + ")/Customer/Orders", false, RequestKindCollection,
+			[]string{"Orders", "Customers", "Orders"}},
+		{"Customers('Bob')/Orders(" + order + ")/Customer/Age", false, RequestKindProperty,
+			[]string{"Customers", "Orders", "Customers", "Age"}},
+		{"Customers('Bob')/Orders/$count", false, RequestKindCount, []string{"Customers", "Orders", ""}},
+		{"Customers/Bob/Orders/" + order + "/Total", true, RequestKindProperty,
+			[]string{"Customers", "Orders", "Total"}},
+	}
+	for _, testCase := range testCases {
+		service.KeyAsSegment = testCase.keyAsSegment
+		req, err := ParseRequest(context.Background(), testCase.path, url.Values{})
+		if err == nil {
+			err = req.SemanticizeRequest(service)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testCase.path, err)
+			continue
+		}
+		if req.RequestKind != testCase.kind {
+			t.Errorf("%s: expected request kind %v, got %v", testCase.path, testCase.kind, req.RequestKind)
+		}
+		references := []string{}
+		for segment := req.FirstSegment; segment != nil; segment = segment.Next {
+			switch ref := segment.SemanticReference.(type) {
+			case *GoDataEntitySet:
+				references = append(references, ref.Name)
+			case *GoDataProperty:
+				references = append(references, ref.Name)
+			default:
+				references = append(references, "")
+			}
+			if segment.Prev != nil && segment.Prev.SemanticType == SemanticTypeEntitySet &&
+				segment.SemanticType == SemanticTypeEntitySet && segment.NavigationProperty == nil {
+				t.Errorf("%s: expected %s to be a navigation segment", testCase.path, segment.Name)
+			}
+		}
+		if strings.Join(references, ",") != strings.Join(testCase.references, ",") {
+			t.Errorf("%s: expected segments %v, got %v", testCase.path, testCase.references, references)
+		}
+	}
+	service.KeyAsSegment = false
+
+	invalid := []struct {
+		path    string
+		message string
+	}{
+		{"Customers/Orders", "must have a key"},
+		{"Customers('Bob')/Orders/Customer", "must have a key"},
+		{"Orders(" + order + ")/Customer('Bob')", "cannot have a key"},
+		{"Orders(" + order + ")/Lines", "not bound to an entity set"},
+		{"Customers('Bob')/Orders(1)", "not a valid Edm.Guid"},
+		{"Customers('Bob')/Products", "valid entity property"},
+		{"Customers('Bob')/Customers", "valid entity property"},
+	}
+	for _, testCase := range invalid {
+		req, err := ParseRequest(context.Background(), testCase.path, url.Values{})
+		if err == nil {
+			err = req.SemanticizeRequest(service)
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", testCase.path, testCase.message, err)
+		}
+	}
+}
+
 func TestUnescapeStringTokens(t *testing.T) {
 
 	testCases := []struct {